@@ -28,15 +28,22 @@ func GetRSAPublicKey(filepath string) *rsa.PublicKey {
 
 func GetRSAPrivateKey(filepath string) *rsa.PrivateKey {
 
-	key_file, err_1 := ioutil.ReadFile(filepath)
-	if err_1 != nil {
+	priv_rsa_key, err := LoadRSAPrivateKey(filepath)
+	if err != nil {
 		fmt.Println(filepath)
-		panic(errors.New("The provided file path does not point to an existing file"))
+		panic(err)
 	}
+	return priv_rsa_key
+}
+
+// LoadRSAPrivateKey reads a PEM encoded RSA private key from filepath. Unlike GetRSAPrivateKey it returns an error
+// instead of panicking.
+func LoadRSAPrivateKey(filepath string) (*rsa.PrivateKey, error) {
 
-	priv_rsa_key, err := jwt.ParseRSAPrivateKeyFromPEM(key_file)
+	key_file, err := ioutil.ReadFile(filepath)
 	if err != nil {
-		panic(err)
+		return nil, errors.New("The provided file path does not point to an existing file")
 	}
-	return priv_rsa_key
+
+	return jwt.ParseRSAPrivateKeyFromPEM(key_file)
 }
\ No newline at end of file
@@ -0,0 +1,726 @@
+package security
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guidola/go-utils/database"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"github.com/mediocregopher/radix.v2/redis"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Account token purposes
+const (
+	PurposePasswordReset     = "password_reset"
+	PurposeEmailVerification = "email_verification"
+)
+
+// DefaultAccountTokensCollection is the collection the mongo account token store keeps tokens on
+const DefaultAccountTokensCollection = "account_tokens"
+
+// ErrInvalidAccountToken is returned for account tokens that are unknown, expired or already used
+var ErrInvalidAccountToken = errors.New("invalid or expired token")
+
+type (
+	// AccountTokenConfig defines the config for the password reset and email verification flows. Both hand out
+	// single use, time limited tokens by email, of which only a hash is stored.
+	AccountTokenConfig struct {
+		// Store keeping the tokens handed out.
+		// Optional. Default value a RedisAccountTokenStore.
+		Store AccountTokenStore
+
+		// Mailer delivering the tokens.
+		// Required.
+		Mailer Mailer
+
+		// Lifetime of the password reset tokens.
+		// Optional. Default value 1 hour.
+		ResetTTL time.Duration
+
+		// Lifetime of the email verification tokens.
+		// Optional. Default value 24 hours.
+		VerificationTTL time.Duration
+
+		// URLs of the pages consuming the tokens, which get the token appended on the `token` query parameter.
+		// Optional. Default value empty, the bare token is sent.
+		ResetURL        string
+		VerificationURL string
+
+		// Compose returns the message delivering link, either the URL carrying the token or the bare token, to
+		// email for purpose, one of PurposePasswordReset or PurposeEmailVerification.
+		// Optional. Default value a plain text message in english.
+		Compose func(purpose string, email string, link string, ttl time.Duration) MailMessage
+
+		// Limiter counting the password reset requests per email and per client IP.
+		// Optional. Default value a RedisRateLimiter running SlidingWindowLog.
+		Limiter RateLimiter
+
+		// Password reset requests allowed per email within RequestWindow, whether the email is registered or not.
+		// Optional. Default value 3.
+		MaxRequestsPerEmail int
+
+		// Password reset requests allowed per client IP within RequestWindow.
+		// Optional. Default value 20.
+		MaxRequestsPerIP int
+
+		// Window the password reset request limits apply to.
+		// Optional. Default value 1 hour.
+		RequestWindow time.Duration
+	}
+
+	// AccountTokenRecord is the stored half of an account token.
+	AccountTokenRecord struct {
+		Purpose   string `json:"purpose" bson:"purpose"`
+		Subject   string `json:"subject" bson:"subject"`
+		Email     string `json:"email" bson:"email"`
+		ExpiresAt int64  `json:"expires_at" bson:"expires_at"`
+		// Generation of the tokens of Purpose handed out to Subject when the token was, see
+		// AccountTokenStore.Invalidate.
+		Generation int64 `json:"generation" bson:"generation"`
+	}
+
+	// AccountTokenStore abstracts the backend keeping the account tokens handed out.
+	AccountTokenStore interface {
+		// Save stores record under hash until it expires.
+		Save(hash string, record AccountTokenRecord) error
+
+		// Consume removes and returns the record stored under hash, reporting whether there was one, so each token
+		// can only be used once.
+		Consume(hash string) (AccountTokenRecord, bool, error)
+
+		// Generation returns the current generation of the tokens of purpose handed out to subject, 0 if they were
+		// never invalidated.
+		Generation(purpose string, subject string) (int64, error)
+
+		// Invalidate bumps the generation of the tokens of purpose handed out to subject, so every token handed out
+		// so far is rejected. The generation has to be kept for ttl, the lifetime of the tokens.
+		Invalidate(purpose string, subject string, ttl time.Duration) error
+	}
+
+	// EmailVerifier is implemented by credential stores able to flag the email of an account as verified.
+	EmailVerifier interface {
+		// MarkEmailVerified flags email as verified on the account identified by subject, as long as it is still
+		// the email of the account.
+		MarkEmailVerified(subject string, email string) error
+	}
+
+	passwordForgotRequest struct {
+		Email string `json:"email" form:"email"`
+	}
+
+	passwordResetRequest struct {
+		Token string `json:"token" form:"token"`
+		Pwd   string `json:"pwd" form:"pwd"`
+	}
+
+	emailVerifyRequest struct {
+		Token string `json:"token" form:"token"`
+	}
+)
+
+// withDefaults returns config with its unset fields set to the defaults
+func (config AccountTokenConfig) withDefaults() AccountTokenConfig {
+	if config.Mailer == nil {
+		panic("account token flows require a mailer")
+	}
+	if config.Store == nil {
+		config.Store = NewRedisAccountTokenStore()
+	}
+	if config.ResetTTL == 0 {
+		config.ResetTTL = time.Hour
+	}
+	if config.VerificationTTL == 0 {
+		config.VerificationTTL = 24 * time.Hour
+	}
+	if config.Compose == nil {
+		config.Compose = composeAccountMessage
+	}
+	if config.Limiter == nil {
+		config.Limiter = NewRedisRateLimiter(SlidingWindowLog)
+	}
+	if config.MaxRequestsPerEmail == 0 {
+		config.MaxRequestsPerEmail = 3
+	}
+	if config.MaxRequestsPerIP == 0 {
+		config.MaxRequestsPerIP = 20
+	}
+	if config.RequestWindow == 0 {
+		config.RequestWindow = time.Hour
+	}
+	return config
+}
+
+// hashAccountToken returns the key a token handed out for purpose is stored under, so tokens of one purpose are
+// never found when consumed for another
+func hashAccountToken(purpose string, token string) string {
+	sum := sha256.Sum256([]byte(purpose + ":" + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// accountTokenGeneration returns the key the generation of the tokens of purpose handed out to subject is stored
+// under, which never collides with the one of a token
+func accountTokenGeneration(purpose string, subject string) string {
+	return "generation:" + purpose + ":" + subject
+}
+
+// composeAccountMessage is the default AccountTokenConfig.Compose
+func composeAccountMessage(purpose string, email string, link string, ttl time.Duration) MailMessage {
+
+	if purpose == PurposePasswordReset {
+		return MailMessage{
+			To:      email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Use the following to reset your password, it expires in %s:\n\n%s\n\n"+
+				"If you did not ask to reset it you can ignore this email.", ttl, link),
+		}
+	}
+	return MailMessage{
+		To:      email,
+		Subject: "Verify your email",
+		Body:    fmt.Sprintf("Use the following to verify your email, it expires in %s:\n\n%s", ttl, link),
+	}
+}
+
+// SendAccountToken hands out a token for purpose to the account of subject, mailing it to email
+func (config AccountTokenConfig) SendAccountToken(purpose string, subject string, email string) error {
+
+	config = config.withDefaults()
+
+	ttl, link := config.VerificationTTL, config.VerificationURL
+	if purpose == PurposePasswordReset {
+		ttl, link = config.ResetTTL, config.ResetURL
+	}
+
+	token, err := randomString(32)
+	if err != nil {
+		return err
+	}
+	generation, err := config.Store.Generation(purpose, subject)
+	if err != nil {
+		return err
+	}
+	record := AccountTokenRecord{
+		Purpose:    purpose,
+		Subject:    subject,
+		Email:      email,
+		ExpiresAt:  time.Now().Add(ttl).Unix(),
+		Generation: generation,
+	}
+	if err := config.Store.Save(hashAccountToken(purpose, token), record); err != nil {
+		return err
+	}
+
+	switch {
+	case link == "":
+		link = token
+	case strings.Contains(link, "?"):
+		link += "&token=" + url.QueryEscape(token)
+	default:
+		link += "?token=" + url.QueryEscape(token)
+	}
+	return config.Mailer.Send(config.Compose(purpose, email, link, ttl))
+}
+
+// ConsumeAccountToken uses up token, handed out for purpose, and returns its record. ErrInvalidAccountToken is
+// returned for unknown, expired, already used or invalidated tokens.
+func (config AccountTokenConfig) ConsumeAccountToken(purpose string, token string) (AccountTokenRecord, error) {
+
+	config = config.withDefaults()
+
+	record, ok, err := config.Store.Consume(hashAccountToken(purpose, token))
+	if err != nil {
+		return record, err
+	}
+	if !ok || record.Purpose != purpose || time.Now().Unix() >= record.ExpiresAt {
+		return AccountTokenRecord{}, ErrInvalidAccountToken
+	}
+
+	// tokens outliving their generation, which expires along with them, are still valid
+	generation, err := config.Store.Generation(purpose, record.Subject)
+	if err != nil {
+		return AccountTokenRecord{}, err
+	}
+	if record.Generation < generation {
+		return AccountTokenRecord{}, ErrInvalidAccountToken
+	}
+	return record, nil
+}
+
+// InvalidateAccountTokens rejects every token of purpose handed out to subject so far
+func (config AccountTokenConfig) InvalidateAccountTokens(purpose string, subject string) error {
+
+	config = config.withDefaults()
+
+	ttl := config.VerificationTTL
+	if purpose == PurposePasswordReset {
+		ttl = config.ResetTTL
+	}
+	return config.Store.Invalidate(purpose, subject, ttl)
+}
+
+// ****************************
+// Request handlers
+// ****************************
+
+// PasswordForgotHandler returns a request handler mailing a password reset token to the account with the email
+// given on the payload. It responds "202 - Accepted" whether the account exists or not, so it cannot be used to
+// find out which emails are registered. The token is sent in the background so the response does not take longer
+// for registered emails either.
+// Requests beyond the limits per email or per client IP of the account token config get "429 - Too Many Requests"
+// problem response with a Retry-After header.
+func PasswordForgotHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.AccountTokens == nil {
+		config.AccountTokens = &AccountTokenConfig{}
+	}
+	if config.Credentials == nil {
+		config.Credentials = DefaultAuthenticationConfig.Credentials
+	}
+	tokens := config.AccountTokens.withDefaults()
+	fallback := NewMemoryRateLimiter(SlidingWindowLog)
+
+	// allow counts a request on key, falling back to the local limiter while the configured one fails
+	allow := func(key string, limit int) (RateLimitResult, error) {
+		result, err := tokens.Limiter.Allow(key, limit, tokens.RequestWindow)
+		if err != nil {
+			log.Warnf("Falling back to the local rate limiter: %s", err.Error())
+			return fallback.Allow(key, limit, tokens.RequestWindow)
+		}
+		return result, nil
+	}
+
+	return func(c echo.Context) error {
+
+		r := new(passwordForgotRequest)
+		if err := c.Bind(r); err != nil {
+			return err
+		}
+		r.Email = strings.TrimSpace(r.Email)
+		if validateEmail(r.Email) != nil {
+			return WriteProblem(c, NewProblem(http.StatusBadRequest, CodeInvalidRequest, ErrInvalidEmail.Error()))
+		}
+
+		for _, limit := range []struct {
+			key string
+			max int
+		}{
+			{"password_forgot:ip:" + c.RealIP(), tokens.MaxRequestsPerIP},
+			{"password_forgot:email:" + strings.ToLower(r.Email), tokens.MaxRequestsPerEmail},
+		} {
+			result, err := allow(limit.key, limit.max)
+			if err != nil {
+				return err
+			}
+			if !result.Allowed {
+				c.Response().Header().Set("Retry-After", strconv.FormatInt(ceilSeconds(result.RetryAfter), 10))
+				return WriteProblem(c, NewProblem(http.StatusTooManyRequests, CodeTooManyRequests,
+					"too many password reset requests, retry later"))
+			}
+		}
+
+		credentials, err := config.Credentials.Lookup(r.Email)
+		if err == nil && credentials.Email == r.Email {
+			go func() {
+				if err := tokens.SendAccountToken(PurposePasswordReset, credentials.Subject, credentials.Email); err != nil {
+					log.Warnf("Failed to send password reset token to %s: %s", credentials.Email, err.Error())
+				}
+			}()
+		} else if err != nil && err != ErrUnknownAccount {
+			log.Warnf("Failed to look up the account of %s for a password reset: %s", r.Email, err.Error())
+		}
+		return c.JSON(http.StatusAccepted, nil)
+	}
+}
+
+// PasswordResetHandler returns a request handler setting the password given on the `pwd` field of the payload to
+// the account the reset token on the `token` field was handed out to. Every session of the account is revoked, as
+// well as the other reset tokens handed out to it and, when config has an API key config, its API keys.
+// The credential store of config must implement CredentialUpdater.
+// Responds "400 - Bad Request" for passwords not meeting the policy and "401 - Unauthorized" for invalid tokens.
+// When the sessions or API keys cannot be revoked the password is still reset, but it responds "503 - Service
+// Unavailable" problem response so the client knows the account is not secured yet.
+func PasswordResetHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.AccountTokens == nil {
+		config.AccountTokens = &AccountTokenConfig{}
+	}
+	if config.Credentials == nil {
+		config.Credentials = DefaultAuthenticationConfig.Credentials
+	}
+	if config.PasswordPolicy == nil {
+		config.PasswordPolicy = &DefaultPasswordPolicy
+	}
+	tokens := config.AccountTokens.withDefaults()
+
+	updater, ok := config.Credentials.(CredentialUpdater)
+	if !ok {
+		panic("password reset handler requires a credential store implementing CredentialUpdater")
+	}
+
+	return func(c echo.Context) error {
+
+		r := new(passwordResetRequest)
+		if err := c.Bind(r); err != nil {
+			return err
+		}
+		// checked before consuming the token so a rejected password does not use it up
+		if err := config.PasswordPolicy.Validate(r.Pwd); err != nil {
+			return WriteProblem(c, NewProblem(http.StatusBadRequest, CodeInvalidRequest, err.Error()))
+		}
+
+		record, err := tokens.ConsumeAccountToken(PurposePasswordReset, r.Token)
+		if err == ErrInvalidAccountToken {
+			emitAuthEvent(config.Audit, c, EventPasswordReset, "", OutcomeFailure, err.Error())
+			return WriteProblem(c, NewProblem(http.StatusUnauthorized, CodeInvalidAccountToken, err.Error()))
+		} else if err != nil {
+			return err
+		}
+
+		if err := updater.UpdateSecret(record.Subject, r.Pwd); err != nil {
+			log.Warnf("Failed to reset the password of %s: %s", record.Subject, err.Error())
+			return err
+		}
+		if err := tokens.InvalidateAccountTokens(PurposePasswordReset, record.Subject); err != nil {
+			log.Warnf("Failed to invalidate the reset tokens of %s after a password reset: %s", record.Subject, err.Error())
+		}
+		err = revokeAllSessions(config, record.Subject)
+		if err == nil && config.APIKeys != nil {
+			err = config.APIKeys.RevokeAPIKeys(record.Subject)
+		}
+		if err != nil {
+			log.Warnf("Failed to revoke the sessions of %s after a password reset: %s", record.Subject, err.Error())
+			emitAuthEvent(config.Audit, c, EventPasswordReset, record.Subject, OutcomeFailure, "revocation failed")
+			return WriteProblem(c, NewProblem(http.StatusServiceUnavailable, CodeRevocationUnavailable,
+				"password reset but its sessions could not be revoked, log out everywhere to retry"))
+		}
+		emitAuthEvent(config.Audit, c, EventPasswordReset, record.Subject, OutcomeSuccess, "")
+		return c.JSON(http.StatusOK, nil)
+	}
+}
+
+// EmailVerificationRequestHandler returns a request handler mailing an email verification token to the email of
+// the authenticated subject. The credential store of config must implement SubjectLookup.
+// It must be mounted behind the jwt middleware.
+func EmailVerificationRequestHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.AccountTokens == nil {
+		config.AccountTokens = &AccountTokenConfig{}
+	}
+	if config.Credentials == nil {
+		config.Credentials = DefaultAuthenticationConfig.Credentials
+	}
+	tokens := config.AccountTokens.withDefaults()
+
+	accounts, ok := config.Credentials.(SubjectLookup)
+	if !ok {
+		panic("email verification request handler requires a credential store implementing SubjectLookup")
+	}
+
+	return func(c echo.Context) error {
+
+		claims, ok := ClaimsFromContext(c)
+		if !ok || claims.Subject == "" {
+			return WriteProblem(c, missingTokenProblem())
+		}
+
+		credentials, err := accounts.LookupSubject(claims.Subject)
+		if err == ErrUnknownAccount || (err == nil && credentials.Email == "") {
+			return WriteProblem(c, NewProblem(http.StatusNotFound, CodeNotFound, "account has no email to verify"))
+		} else if err != nil {
+			return err
+		}
+		if credentials.EmailVerified {
+			return WriteProblem(c, NewProblem(http.StatusConflict, CodeConflict, "email is already verified"))
+		}
+
+		if err := tokens.SendAccountToken(PurposeEmailVerification, credentials.Subject, credentials.Email); err != nil {
+			log.Warnf("Failed to send email verification token to %s: %s", credentials.Email, err.Error())
+			return err
+		}
+		return c.JSON(http.StatusAccepted, nil)
+	}
+}
+
+// EmailVerifyHandler returns a request handler flagging as verified the email the verification token given on the
+// `token` field of the payload was sent to. The credential store of config must implement EmailVerifier.
+// Responds "401 - Unauthorized" for invalid tokens.
+func EmailVerifyHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.AccountTokens == nil {
+		config.AccountTokens = &AccountTokenConfig{}
+	}
+	if config.Credentials == nil {
+		config.Credentials = DefaultAuthenticationConfig.Credentials
+	}
+	tokens := config.AccountTokens.withDefaults()
+
+	verifier, ok := config.Credentials.(EmailVerifier)
+	if !ok {
+		panic("email verify handler requires a credential store implementing EmailVerifier")
+	}
+
+	return func(c echo.Context) error {
+
+		r := new(emailVerifyRequest)
+		if err := c.Bind(r); err != nil {
+			return err
+		}
+
+		record, err := tokens.ConsumeAccountToken(PurposeEmailVerification, r.Token)
+		if err == ErrInvalidAccountToken {
+			emitAuthEvent(config.Audit, c, EventEmailVerify, "", OutcomeFailure, err.Error())
+			return WriteProblem(c, NewProblem(http.StatusUnauthorized, CodeInvalidAccountToken, err.Error()))
+		} else if err != nil {
+			return err
+		}
+
+		err = verifier.MarkEmailVerified(record.Subject, record.Email)
+		if err == ErrUnknownAccount {
+			// the account changed its email after the token was sent
+			emitAuthEvent(config.Audit, c, EventEmailVerify, record.Subject, OutcomeFailure, "email changed")
+			return WriteProblem(c, NewProblem(http.StatusUnauthorized, CodeInvalidAccountToken, ErrInvalidAccountToken.Error()))
+		} else if err != nil {
+			return err
+		}
+		emitAuthEvent(config.Audit, c, EventEmailVerify, record.Subject, OutcomeSuccess, "")
+		return c.JSON(http.StatusOK, nil)
+	}
+}
+
+// ****************************
+// Redis account token store
+// ****************************
+
+// DefaultAccountTokenKeyPrefix is the prefix of the keys written by a RedisAccountTokenStore
+const DefaultAccountTokenKeyPrefix = "account:"
+
+// RedisAccountTokenStore keeps account tokens on the global redis instance, expiring along with them.
+type RedisAccountTokenStore struct {
+	// Prefix of every key written by the store.
+	// Optional. Default value DefaultAccountTokenKeyPrefix.
+	Prefix string
+}
+
+// NewRedisAccountTokenStore returns an account token store backed by the global redis instance
+func NewRedisAccountTokenStore() *RedisAccountTokenStore {
+	return &RedisAccountTokenStore{Prefix: DefaultAccountTokenKeyPrefix}
+}
+
+func (s *RedisAccountTokenStore) key(hash string) string {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = DefaultAccountTokenKeyPrefix
+	}
+	return prefix + hash
+}
+
+func (s *RedisAccountTokenStore) Save(hash string, record AccountTokenRecord) error {
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.GetRedisInstance().Execute("SET", s.key(hash), value, "EX", secondsUntil(record.ExpiresAt))
+	return err
+}
+
+func (s *RedisAccountTokenStore) Consume(hash string) (AccountTokenRecord, bool, error) {
+
+	var record AccountTokenRecord
+
+	response, err := database.GetRedisInstance().Execute("EVAL", takeScript, 1, s.key(hash))
+	if err != nil {
+		return record, false, err
+	}
+	if response.IsType(redis.Nil) {
+		return record, false, nil
+	}
+
+	value, err := response.Bytes()
+	if err != nil {
+		return record, false, err
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return record, false, err
+	}
+	return record, true, nil
+}
+
+func (s *RedisAccountTokenStore) Generation(purpose string, subject string) (int64, error) {
+
+	response, err := database.GetRedisInstance().Execute("GET", s.key(accountTokenGeneration(purpose, subject)))
+	if err != nil {
+		return 0, err
+	}
+	if response.IsType(redis.Nil) {
+		return 0, nil
+	}
+	return response.Int64()
+}
+
+func (s *RedisAccountTokenStore) Invalidate(purpose string, subject string, ttl time.Duration) error {
+
+	r := database.GetRedisInstance()
+	key := s.key(accountTokenGeneration(purpose, subject))
+	if _, err := r.Execute("INCR", key); err != nil {
+		return err
+	}
+	_, err := r.Execute("PEXPIRE", key, int64(ttl/time.Millisecond))
+	return err
+}
+
+// ****************************
+// MongoDB account token store
+// ****************************
+
+// MongoAccountTokenStore keeps account tokens on a mongo collection through the global database.Mongo instance.
+// Expired tokens are not removed by the store, a TTL index on `expire_at` is recommended.
+type MongoAccountTokenStore struct {
+	// Database holding the collection. When empty the database of the dialed session is used.
+	Database string
+	// Collection holding one document per token.
+	Collection string
+}
+
+type mongoAccountToken struct {
+	Hash               string `bson:"_id"`
+	AccountTokenRecord `bson:",inline"`
+	ExpireAt           time.Time `bson:"expire_at"`
+}
+
+// mongoAccountTokenGeneration is kept on the collection of the tokens, expiring the same way
+type mongoAccountTokenGeneration struct {
+	ID         string    `bson:"_id"`
+	Generation int64     `bson:"generation"`
+	ExpireAt   time.Time `bson:"expire_at"`
+}
+
+// NewMongoAccountTokenStore returns an account token store backed by the given mongo database and collection
+func NewMongoAccountTokenStore(db string, collection string) *MongoAccountTokenStore {
+	return &MongoAccountTokenStore{Database: db, Collection: collection}
+}
+
+func (s *MongoAccountTokenStore) Save(hash string, record AccountTokenRecord) error {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	return mg.DB(s.Database).C(s.Collection).Insert(mongoAccountToken{
+		Hash:               hash,
+		AccountTokenRecord: record,
+		ExpireAt:           time.Unix(record.ExpiresAt, 0),
+	})
+}
+
+func (s *MongoAccountTokenStore) Consume(hash string) (AccountTokenRecord, bool, error) {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	// findAndModify removing the document, so concurrent consumers cannot both get it
+	var token mongoAccountToken
+	_, err := mg.DB(s.Database).C(s.Collection).FindId(hash).Apply(mgo.Change{Remove: true}, &token)
+	if err == mgo.ErrNotFound {
+		return AccountTokenRecord{}, false, nil
+	} else if err != nil {
+		return AccountTokenRecord{}, false, err
+	}
+	return token.AccountTokenRecord, true, nil
+}
+
+func (s *MongoAccountTokenStore) Generation(purpose string, subject string) (int64, error) {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	var generation mongoAccountTokenGeneration
+	err := mg.DB(s.Database).C(s.Collection).FindId(accountTokenGeneration(purpose, subject)).One(&generation)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return generation.Generation, err
+}
+
+func (s *MongoAccountTokenStore) Invalidate(purpose string, subject string, ttl time.Duration) error {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	_, err := mg.DB(s.Database).C(s.Collection).UpsertId(accountTokenGeneration(purpose, subject), bson.M{
+		"$inc": bson.M{"generation": 1},
+		"$set": bson.M{"expire_at": time.Now().Add(ttl)},
+	})
+	return err
+}
+
+// ****************************
+// In memory account token store
+// ****************************
+
+// MemoryAccountTokenStore keeps account tokens in memory, so the links already sent stop working on restart.
+type MemoryAccountTokenStore struct {
+	mutex       sync.Mutex
+	records     map[string]AccountTokenRecord
+	generations map[string]int64
+}
+
+// NewMemoryAccountTokenStore returns an empty in memory account token store
+func NewMemoryAccountTokenStore() *MemoryAccountTokenStore {
+	return &MemoryAccountTokenStore{records: map[string]AccountTokenRecord{}, generations: map[string]int64{}}
+}
+
+func (s *MemoryAccountTokenStore) Save(hash string, record AccountTokenRecord) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now().Unix()
+	for stored, entry := range s.records {
+		if now >= entry.ExpiresAt {
+			delete(s.records, stored)
+		}
+	}
+	s.records[hash] = record
+	return nil
+}
+
+func (s *MemoryAccountTokenStore) Consume(hash string) (AccountTokenRecord, bool, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record, ok := s.records[hash]
+	delete(s.records, hash)
+	return record, ok, nil
+}
+
+func (s *MemoryAccountTokenStore) Generation(purpose string, subject string) (int64, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.generations[accountTokenGeneration(purpose, subject)], nil
+}
+
+// Invalidate bumps the generation of purpose for subject, which is kept for as long as the store lives
+func (s *MemoryAccountTokenStore) Invalidate(purpose string, subject string, ttl time.Duration) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.generations[accountTokenGeneration(purpose, subject)]++
+	return nil
+}
@@ -0,0 +1,248 @@
+package security
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// mailedToken returns the token carried by the last message sent to email
+func mailedToken(t *testing.T, mailer *MemoryMailer, email string) string {
+
+	messages := mailer.Messages(email)
+	if len(messages) == 0 {
+		t.Fatalf("expected a message to be sent to %s", email)
+	}
+	for _, field := range strings.Fields(messages[len(messages)-1].Body) {
+		if link, err := url.Parse(field); err == nil && link.Query().Get("token") != "" {
+			return link.Query().Get("token")
+		}
+	}
+	return strings.Split(messages[len(messages)-1].Body, "\n")[2]
+}
+
+// awaitMessages waits for count messages to be sent to email, as some are sent in the background
+func awaitMessages(t *testing.T, mailer *MemoryMailer, email string, count int) {
+
+	for deadline := time.Now().Add(time.Second); len(mailer.Messages(email)) < count; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d messages to be sent to %s and got %d", count, email, len(mailer.Messages(email)))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAccountTokens(t *testing.T) {
+
+	config := AccountTokenConfig{Store: NewMemoryAccountTokenStore(), Mailer: NewMemoryMailer(), ResetTTL: time.Hour}
+	config.SendAccountToken(PurposePasswordReset, "patata-id", "patata@terno.io")
+	token := mailedToken(t, config.Mailer.(*MemoryMailer), "patata@terno.io")
+
+	var test_cases = []struct {
+		purpose string
+		token   string
+		err     error
+	}{
+		{PurposeEmailVerification, token, ErrInvalidAccountToken},
+		{PurposePasswordReset, token + "x", ErrInvalidAccountToken},
+		{PurposePasswordReset, token, nil},
+		{PurposePasswordReset, token, ErrInvalidAccountToken},
+	}
+
+	for i, test_case := range test_cases {
+		record, err := config.ConsumeAccountToken(test_case.purpose, test_case.token)
+		if err != test_case.err {
+			t.Errorf("case %d: expected error %v and got %v", i, test_case.err, err)
+		}
+		if err == nil && (record.Subject != "patata-id" || record.Email != "patata@terno.io") {
+			t.Errorf("case %d: unexpected record %+v", i, record)
+		}
+	}
+
+	//invalidating the tokens of a subject leaves the ones handed out afterwards valid
+	config.SendAccountToken(PurposePasswordReset, "patata-id", "patata@terno.io")
+	invalidated := mailedToken(t, config.Mailer.(*MemoryMailer), "patata@terno.io")
+	config.SendAccountToken(PurposeEmailVerification, "patata-id", "patata@terno.io")
+	verification := mailedToken(t, config.Mailer.(*MemoryMailer), "patata@terno.io")
+	config.InvalidateAccountTokens(PurposePasswordReset, "patata-id")
+	config.SendAccountToken(PurposePasswordReset, "patata-id", "patata@terno.io")
+	if _, err := config.ConsumeAccountToken(PurposePasswordReset, invalidated); err != ErrInvalidAccountToken {
+		t.Errorf("expected invalidated token to get error %v and got %v", ErrInvalidAccountToken, err)
+	}
+	if _, err := config.ConsumeAccountToken(PurposeEmailVerification, verification); err != nil {
+		t.Errorf("expected tokens of other purposes to stay valid and got %v", err)
+	}
+	if _, err := config.ConsumeAccountToken(PurposePasswordReset, mailedToken(t, config.Mailer.(*MemoryMailer), "patata@terno.io")); err != nil {
+		t.Errorf("expected token handed out after the invalidation to be valid and got %v", err)
+	}
+
+	config.ResetTTL = time.Nanosecond
+	config.SendAccountToken(PurposePasswordReset, "patata-id", "patata@terno.io")
+	if _, err := config.ConsumeAccountToken(PurposePasswordReset, mailedToken(t, config.Mailer.(*MemoryMailer), "patata@terno.io")); err != ErrInvalidAccountToken {
+		t.Errorf("expected expired token to get error %v and got %v", ErrInvalidAccountToken, err)
+	}
+}
+
+func TestAccountRecoveryFlows(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher}
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+	mailer := NewMemoryMailer()
+	revocations := NewMemoryRevocationStore()
+
+	config := AuthenticationConfig{
+		Credentials: store,
+		Issuer:      issuer,
+		Revocations: revocations,
+		AccountTokens: &AccountTokenConfig{
+			Store:    NewMemoryAccountTokenStore(),
+			Mailer:   mailer,
+			ResetURL: "https://app.terno.io/reset?lang=es",
+			Limiter:  NewMemoryRateLimiter(SlidingWindowLog),
+		},
+	}
+
+	e := echo.New()
+	e.Use(JWTWithConfig(JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256, Revocations: revocations}))
+	LoadAuthenticationRoutesWithConfig(e, config)
+
+	request := func(path string, token string, payload interface{}) int {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(echo.POST, path, bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		return res.Code
+	}
+
+	//registering mails an email verification token
+	if code := request("/register", "", RegisterRequest{Email: "patata@terno.io", Username: "patata", Pwd: "pwned123"}); code != http.StatusCreated {
+		t.Fatalf("expected status %d and got %d", http.StatusCreated, code)
+	}
+	verification := mailedToken(t, mailer, "patata@terno.io")
+	credentials, _ := store.Lookup("patata")
+
+	if code := request("/password/reset", "", passwordResetRequest{Token: verification, Pwd: "hijacked1"}); code != http.StatusUnauthorized {
+		t.Errorf("expected verification token to get status %d on reset and got %d", http.StatusUnauthorized, code)
+	}
+	for _, status := range []int{http.StatusOK, http.StatusUnauthorized} {
+		if code := request("/email/verify", "", emailVerifyRequest{Token: verification}); code != status {
+			t.Errorf("expected status %d verifying the email and got %d", status, code)
+		}
+	}
+	if verified, _ := store.Lookup("patata"); !verified.EmailVerified {
+		t.Errorf("expected email to be verified")
+	}
+	token, _ := issuer.Issue(credentials.Subject, nil)
+	if code := request("/email/verify/request", token, nil); code != http.StatusConflict {
+		t.Errorf("expected verified email to get status %d and got %d", http.StatusConflict, code)
+	}
+
+	//unknown accounts get the same response and no message
+	if code := request("/password/forgot", "", passwordForgotRequest{Email: "pollo@terno.io"}); code != http.StatusAccepted {
+		t.Errorf("expected status %d and got %d", http.StatusAccepted, code)
+	}
+	if len(mailer.Messages("pollo@terno.io")) != 0 {
+		t.Errorf("expected no message for unknown accounts")
+	}
+
+	sent := len(mailer.Messages("patata@terno.io"))
+	if code := request("/password/forgot", "", passwordForgotRequest{Email: "patata@terno.io"}); code != http.StatusAccepted {
+		t.Errorf("expected status %d and got %d", http.StatusAccepted, code)
+	}
+	awaitMessages(t, mailer, "patata@terno.io", sent+1)
+	other := mailedToken(t, mailer, "patata@terno.io")
+	request("/password/forgot", "", passwordForgotRequest{Email: "patata@terno.io"})
+	awaitMessages(t, mailer, "patata@terno.io", sent+2)
+	messages := mailer.Messages("patata@terno.io")
+	if body := messages[len(messages)-1].Body; !strings.Contains(body, "https://app.terno.io/reset?lang=es&token=") {
+		t.Errorf("expected reset link on the message and got %s", body)
+	}
+	reset := mailedToken(t, mailer, "patata@terno.io")
+
+	var test_cases = []struct {
+		pwd    string
+		status int
+	}{
+		{"short", http.StatusBadRequest}, //the token is not used up by invalid passwords
+		{"recovered1", http.StatusOK},
+		{"recovered2", http.StatusUnauthorized},
+	}
+
+	for _, test_case := range test_cases {
+		if code := request("/password/reset", "", passwordResetRequest{Token: reset, Pwd: test_case.pwd}); code != test_case.status {
+			t.Errorf("expected password '%s' to get status %d and got %d", test_case.pwd, test_case.status, code)
+		}
+	}
+
+	if code := request("/password/reset", "", passwordResetRequest{Token: other, Pwd: "recovered3"}); code != http.StatusUnauthorized {
+		t.Errorf("expected the other reset tokens to be invalidated and got status %d", code)
+	}
+
+	if allowed, _, _ := AuthenticateUser(store, "patata", "recovered1"); !allowed {
+		t.Errorf("expected the new password to be accepted")
+	}
+	if before, _ := revocations.SubjectRevokedBefore(credentials.Subject); before.IsZero() {
+		t.Errorf("expected every session to be revoked on password reset")
+	}
+
+	//each email gets a limited number of reset requests, registered or not
+	for _, email := range []string{"patata@terno.io", "pollo@terno.io"} {
+		for request("/password/forgot", "", passwordForgotRequest{Email: email}) == http.StatusAccepted {
+			if sent := len(mailer.Messages(email)); sent > 10 {
+				t.Fatalf("expected the reset requests of %s to be limited and got %d messages", email, sent)
+			}
+		}
+	}
+	if code := request("/password/forgot", "", passwordForgotRequest{Email: "PATATA@terno.io"}); code != http.StatusTooManyRequests {
+		t.Errorf("expected the limit to apply regardless of case and got status %d", code)
+	}
+}
+
+func TestPasswordResetRevocation(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher}
+	credentials, _ := store.Register(Credentials{Email: "patata@terno.io", Username: "patata"}, "pwned123")
+	tokens := &AccountTokenConfig{Store: NewMemoryAccountTokenStore(), Mailer: NewMemoryMailer()}
+	apiKeys := &APIKeyConfig{Store: NewMemoryAPIKeyStore()}
+
+	var test_cases = []struct {
+		name        string
+		revocations RevocationStore
+		status      int
+		keyValid    bool
+	}{
+		{"revocation unavailable", failingRevocationStore{}, http.StatusServiceUnavailable, true},
+		{"revoked", NewMemoryRevocationStore(), http.StatusOK, false},
+	}
+
+	for _, test_case := range test_cases {
+		raw, _, _ := apiKeys.GenerateAPIKey(credentials.Subject, "ci", nil, 0)
+		tokens.SendAccountToken(PurposePasswordReset, credentials.Subject, credentials.Email)
+		body, _ := json.Marshal(passwordResetRequest{Token: mailedToken(t, tokens.Mailer.(*MemoryMailer), credentials.Email), Pwd: "recovered1"})
+
+		req := httptest.NewRequest(echo.POST, "/password/reset", bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		res := httptest.NewRecorder()
+		handler := PasswordResetHandler(AuthenticationConfig{Credentials: store, Revocations: test_case.revocations,
+			AccountTokens: tokens, APIKeys: apiKeys})
+		if err := handler(echo.New().NewContext(req, res)); err != nil || res.Code != test_case.status {
+			t.Errorf("%s: expected status %d and got %d (%v)", test_case.name, test_case.status, res.Code, err)
+		}
+		if _, err := apiKeys.AuthenticateAPIKey(raw); (err == nil) != test_case.keyValid {
+			t.Errorf("%s: expected the api key to be valid %t and got %v", test_case.name, test_case.keyValid, err)
+		}
+	}
+}
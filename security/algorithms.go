@@ -0,0 +1,119 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// ErrEd25519Verification is returned when an EdDSA signature does not match
+var ErrEd25519Verification = errors.New("ed25519: verification error")
+
+// SigningMethodEd25519 implements the EdDSA signing method of RFC 8037 over the Ed25519 curve, which the jwt library
+// does not ship. Expects ed25519.PrivateKey for signing and ed25519.PublicKey for verification.
+type SigningMethodEd25519 struct{}
+
+// SigningMethodEdDSA is the instance registered on the jwt library under AlgorithmEdDSA
+var SigningMethodEdDSA = &SigningMethodEd25519{}
+
+func init() {
+	// do not shadow the implementation of the jwt library if it ever ships one
+	if jwt.GetSigningMethod(AlgorithmEdDSA) == nil {
+		jwt.RegisterSigningMethod(AlgorithmEdDSA, func() jwt.SigningMethod {
+			return SigningMethodEdDSA
+		})
+	}
+}
+
+func (m *SigningMethodEd25519) Alg() string {
+	return AlgorithmEdDSA
+}
+
+func (m *SigningMethodEd25519) Verify(signingString string, signature string, key interface{}) error {
+
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok || len(publicKey) != ed25519.PublicKeySize {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return ErrEd25519Verification
+	}
+	return nil
+}
+
+func (m *SigningMethodEd25519) Sign(signingString string, key interface{}) (string, error) {
+
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok || len(privateKey) != ed25519.PrivateKeySize {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+// curveBits returns the size of the curve each ECDSA algorithm is defined over
+var curveBits = map[string]int{
+	AlgorithmES256: 256,
+	AlgorithmES384: 384,
+	AlgorithmES512: 521,
+}
+
+// checkKeyType returns an error if key cannot be used with the signing method alg. Signing keys are the private
+// half of the key pair, verification keys the public one. HMAC algorithms use the same []byte secret for both.
+func checkKeyType(alg string, key interface{}, signing bool) error {
+
+	if jwt.GetSigningMethod(alg) == nil {
+		return fmt.Errorf("unsupported jwt signing method=%s", alg)
+	}
+
+	var ok bool
+	switch {
+	case strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS"):
+		if signing {
+			_, ok = key.(*rsa.PrivateKey)
+		} else {
+			_, ok = key.(*rsa.PublicKey)
+		}
+
+	case strings.HasPrefix(alg, "ES"):
+		var curve *ecdsa.PublicKey
+		if signing {
+			if private, isEC := key.(*ecdsa.PrivateKey); isEC {
+				curve = &private.PublicKey
+			}
+		} else {
+			curve, _ = key.(*ecdsa.PublicKey)
+		}
+		ok = curve != nil && curve.Curve.Params().BitSize == curveBits[alg]
+
+	case alg == AlgorithmEdDSA:
+		if signing {
+			_, ok = key.(ed25519.PrivateKey)
+		} else {
+			_, ok = key.(ed25519.PublicKey)
+		}
+
+	case strings.HasPrefix(alg, "HS"):
+		secret, isSecret := key.([]byte)
+		ok = isSecret && len(secret) > 0
+
+	default:
+		return fmt.Errorf("unsupported jwt signing method=%s", alg)
+	}
+
+	if !ok {
+		return fmt.Errorf("key of type %T cannot be used with jwt signing method=%s", key, alg)
+	}
+	return nil
+}
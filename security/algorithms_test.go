@@ -0,0 +1,111 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	testECP256Key, _                     = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testECP384Key, _                     = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	testECP521Key, _                     = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	testEd25519Public, testEd25519Key, _ = ed25519.GenerateKey(rand.Reader)
+	testHMACSecret                       = []byte("pwned-pwned-pwned-pwned-pwned-pwned")
+)
+
+// testKeyPairs holds a signing and verification key for every supported algorithm
+var testKeyPairs = []struct {
+	alg             string
+	private, public interface{}
+}{
+	{AlgorithmRS256, testRSAKey, &testRSAKey.PublicKey},
+	{AlgorithmRS384, testRSAKey, &testRSAKey.PublicKey},
+	{AlgorithmRS512, testRSAKey, &testRSAKey.PublicKey},
+	{AlgorithmPS256, testRSAKey, &testRSAKey.PublicKey},
+	{AlgorithmPS384, testRSAKey, &testRSAKey.PublicKey},
+	{AlgorithmPS512, testRSAKey, &testRSAKey.PublicKey},
+	{AlgorithmES256, testECP256Key, &testECP256Key.PublicKey},
+	{AlgorithmES384, testECP384Key, &testECP384Key.PublicKey},
+	{AlgorithmES512, testECP521Key, &testECP521Key.PublicKey},
+	{AlgorithmEdDSA, testEd25519Key, testEd25519Public},
+	{AlgorithmHS256, testHMACSecret, testHMACSecret},
+	{AlgorithmHS384, testHMACSecret, testHMACSecret},
+	{AlgorithmHS512, testHMACSecret, testHMACSecret},
+}
+
+func TestSigningAlgorithms(t *testing.T) {
+
+	for _, pair := range testKeyPairs {
+
+		issuer, err := NewTokenIssuer(TokenIssuerConfig{SigningKey: pair.private, SigningMethod: pair.alg})
+		if err != nil {
+			t.Errorf("%s: expected err to be nil and got %s instead", pair.alg, err)
+			continue
+		}
+
+		tokenstring, err := issuer.Issue("patata", nil)
+		if err != nil {
+			t.Errorf("%s: expected err to be nil and got %s instead", pair.alg, err)
+			continue
+		}
+
+		config := JWTConfig{SigningKey: pair.public, SigningMethod: pair.alg}
+		if token, err := jwt.Parse(tokenstring, config.keyFunc); err != nil || !token.Valid {
+			t.Errorf("%s: expected token to be valid and got %v", pair.alg, err)
+		}
+
+		//any other algorithm must be rejected even if the key would verify it
+		for _, other := range testKeyPairs {
+			if other.alg == pair.alg {
+				continue
+			}
+			config := JWTConfig{SigningKey: other.public, SigningMethod: other.alg}
+			if _, err := jwt.Parse(tokenstring, config.keyFunc); err == nil {
+				t.Errorf("expected %s token to be rejected by a %s config", pair.alg, other.alg)
+			}
+		}
+	}
+}
+
+func TestCheckKeyType(t *testing.T) {
+
+	var test_cases = []struct {
+		alg     string
+		key     interface{}
+		signing bool
+		valid   bool
+	}{
+		{AlgorithmRS512, &testRSAKey.PublicKey, false, true},
+		{AlgorithmRS512, testRSAKey, false, false},
+		{AlgorithmRS512, testRSAKey, true, true},
+		{AlgorithmES256, &testECP384Key.PublicKey, false, false},
+		{AlgorithmES384, testECP384Key, true, true},
+		{AlgorithmES512, &testECP256Key.PublicKey, false, false},
+		{AlgorithmEdDSA, testEd25519Key, false, false},
+		{AlgorithmEdDSA, testEd25519Public, false, true},
+		{AlgorithmHS256, []byte{}, false, false},
+		{AlgorithmHS256, "pwned", false, false},
+		{AlgorithmHS256, &testRSAKey.PublicKey, false, false},
+		{"none", jwt.UnsafeAllowNoneSignatureType, false, false},
+		{"XX999", testHMACSecret, false, false},
+	}
+
+	for _, test_case := range test_cases {
+		if err := checkKeyType(test_case.alg, test_case.key, test_case.signing); (err == nil) != test_case.valid {
+			t.Errorf("expected %s key %T validity to be %t and got error '%v'", test_case.alg, test_case.key,
+				test_case.valid, err)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected jwt middleware to panic with a key not matching the signing method")
+		}
+	}()
+	JWTWithConfig(JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmRS512})
+}
@@ -0,0 +1,592 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guidola/go-utils/database"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// API key defaults
+const (
+	DefaultAPIKeyPrefix        = "sk"
+	DefaultAPIKeyHeader        = "X-API-Key"
+	DefaultAPIKeysCollection   = "api_keys"
+	DefaultAPIKeyTouchInterval = time.Minute
+)
+
+var (
+	// ErrInvalidAPIKey is returned for API keys that are malformed, unknown, revoked, expired or do not match
+	ErrInvalidAPIKey = errors.New("invalid api key")
+	// ErrUnknownAPIKey is returned by an APIKeyStore when no key has the given id
+	ErrUnknownAPIKey = errors.New("unknown api key")
+)
+
+type (
+	// APIKey is the stored half of an API key. Keys look like `<prefix>_<id>_<secret>`, of which only the id and a
+	// salted hash of the secret are stored, so the key cannot be recovered from the store.
+	APIKey struct {
+		ID      string `json:"id" bson:"_id"`
+		Subject string `json:"-" bson:"subject"`
+		// Name given by the owner of the key, e.g. "ci".
+		Name string `json:"name" bson:"name"`
+		// Scopes granted to the requests authenticated with the key.
+		Scopes     []string  `json:"scopes" bson:"scopes"`
+		Salt       string    `json:"-" bson:"salt"`
+		Hash       string    `json:"-" bson:"hash"`
+		CreatedAt  time.Time `json:"created_at" bson:"created_at"`
+		ExpiresAt  time.Time `json:"expires_at" bson:"expires_at,omitempty"`
+		LastUsedAt time.Time `json:"last_used_at" bson:"last_used_at,omitempty"`
+		RevokedAt  time.Time `json:"revoked_at" bson:"revoked_at,omitempty"`
+	}
+
+	// APIKeyStore abstracts the backend holding the API keys.
+	APIKeyStore interface {
+		// Save stores key, replacing the one with the same id.
+		Save(key APIKey) error
+
+		// Get returns the key with the given id, ErrUnknownAPIKey if there is none.
+		Get(id string) (APIKey, error)
+
+		// List returns every key of subject, revoked and expired ones included.
+		List(subject string) ([]APIKey, error)
+
+		// Revoke marks the key with the given id as revoked at.
+		Revoke(id string, at time.Time) error
+
+		// Touch records the key with the given id was last used at.
+		Touch(id string, at time.Time) error
+	}
+
+	// APIKeyConfig defines the config for the API key authentication.
+	APIKeyConfig struct {
+		// Store holding the API keys.
+		// Optional. Default value a MongoAPIKeyStore over DefaultAPIKeysCollection.
+		Store APIKeyStore
+
+		// Prefix of the generated keys, telling them apart from tokens and from the keys of other services. It
+		// cannot contain '_'.
+		// Optional. Default value DefaultAPIKeyPrefix.
+		Prefix string
+
+		// Header the API key is looked up on. Keys are also accepted as bearer tokens on the Authorization header.
+		// Optional. Default value DefaultAPIKeyHeader.
+		Header string
+
+		// JWT config of the tokens accepted along with API keys. Requests without an API key go through the jwt
+		// middleware built from it.
+		// Optional. Default value nil, only API keys are accepted.
+		JWT *JWTConfig
+
+		// Context key the subject of the key is stored under, as the jwt middleware does.
+		// Optional. Default value DefaultJWTConfig.ContextKey, or the one of JWT if set.
+		ContextKey string
+
+		// PublicRoutes that do not require authentication.
+		// Optional. Default value DefaultPublicRoutes, or the one of JWT if set.
+		PublicRoutes *PublicRoutes
+
+		// Minimum time between two writes of the last use of a key.
+		// Optional. Default value DefaultAPIKeyTouchInterval.
+		TouchInterval time.Duration
+
+		// Audit receives an EventAPIKeyRejected event for every invalid key.
+		// Optional. Default value the Audit of JWT if set, otherwise no events are emitted.
+		Audit AuditSink
+	}
+
+	apiKeyRequest struct {
+		Name   string   `json:"name" form:"name"`
+		Scopes []string `json:"scopes" form:"scopes"`
+		// Lifetime of the key in seconds, 0 for keys that do not expire.
+		TTL int64 `json:"ttl" form:"ttl"`
+	}
+
+	apiKeyResponse struct {
+		Key string `json:"key"`
+		APIKey
+	}
+)
+
+// withDefaults returns config with its unset fields set to the defaults
+func (config APIKeyConfig) withDefaults() APIKeyConfig {
+	if config.Store == nil {
+		config.Store = NewMongoAPIKeyStore("", DefaultAPIKeysCollection)
+	}
+	if config.Prefix == "" {
+		config.Prefix = DefaultAPIKeyPrefix
+	}
+	if strings.Contains(config.Prefix, "_") {
+		panic("api key prefix cannot contain '_'")
+	}
+	if config.Header == "" {
+		config.Header = DefaultAPIKeyHeader
+	}
+	if config.ContextKey == "" {
+		config.ContextKey = DefaultJWTConfig.ContextKey
+		if config.JWT != nil && config.JWT.ContextKey != "" {
+			config.ContextKey = config.JWT.ContextKey
+		}
+	}
+	if config.PublicRoutes == nil {
+		config.PublicRoutes = DefaultPublicRoutes
+		if config.JWT != nil && config.JWT.PublicRoutes != nil {
+			config.PublicRoutes = config.JWT.PublicRoutes
+		}
+	}
+	if config.TouchInterval == 0 {
+		config.TouchInterval = DefaultAPIKeyTouchInterval
+	}
+	if config.Audit == nil && config.JWT != nil {
+		config.Audit = config.JWT.Audit
+	}
+	return config
+}
+
+// GenerateAPIKey stores a new API key of subject named name, granting scopes for ttl, 0 for keys that do not
+// expire. Returns the key, which cannot be recovered afterwards, along with its stored half.
+func (config APIKeyConfig) GenerateAPIKey(subject string, name string, scopes []string, ttl time.Duration) (string, APIKey, error) {
+
+	config = config.withDefaults()
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", APIKey{}, err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+	salt, err := randomString(16)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	now := time.Now()
+	key := APIKey{
+		ID:        hex.EncodeToString(b),
+		Subject:   subject,
+		Name:      name,
+		Scopes:    scopes,
+		Salt:      salt,
+		Hash:      hashAPIKeySecret(salt, secret),
+		CreatedAt: now,
+	}
+	if ttl > 0 {
+		key.ExpiresAt = now.Add(ttl)
+	}
+
+	if err := config.Store.Save(key); err != nil {
+		return "", APIKey{}, err
+	}
+	return config.Prefix + "_" + key.ID + "_" + secret, key, nil
+}
+
+// AuthenticateAPIKey returns the stored half of raw as long as it is a valid key that has not been revoked or
+// expired, recording its use. ErrInvalidAPIKey is returned otherwise.
+func (config APIKeyConfig) AuthenticateAPIKey(raw string) (APIKey, error) {
+
+	config = config.withDefaults()
+
+	parts := strings.SplitN(raw, "_", 3)
+	if len(parts) != 3 || parts[0] != config.Prefix {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	key, err := config.Store.Get(parts[1])
+	if err == ErrUnknownAPIKey {
+		return APIKey{}, ErrInvalidAPIKey
+	} else if err != nil {
+		return APIKey{}, err
+	}
+
+	now := time.Now()
+	if !secretsMatch(key.Hash, hashAPIKeySecret(key.Salt, parts[2])) || !key.RevokedAt.IsZero() ||
+		(!key.ExpiresAt.IsZero() && now.After(key.ExpiresAt)) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	if now.Sub(key.LastUsedAt) > config.TouchInterval {
+		if err := config.Store.Touch(key.ID, now); err != nil {
+			log.Warnf("Failed to record the use of api key %s: %s", key.ID, err.Error())
+		}
+		key.LastUsedAt = now
+	}
+	return key, nil
+}
+
+// RevokeAPIKeys revokes every API key of subject not revoked yet, e.g. after the password of subject is reset
+func (config APIKeyConfig) RevokeAPIKeys(subject string) error {
+
+	config = config.withDefaults()
+
+	keys, err := config.Store.List(subject)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		if key.RevokedAt.IsZero() {
+			if err := config.Store.Revoke(key.ID, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// hashAPIKeySecret returns the salted hash an API key secret is stored as. Secrets are random so a single HMAC
+// round is enough, unlike passwords.
+func hashAPIKeySecret(salt string, secret string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// lookup returns the API key sent on the request of c, if any
+func (config APIKeyConfig) lookup(c echo.Context) string {
+
+	if key := c.Request().Header.Get(config.Header); key != "" {
+		return key
+	}
+
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	scheme := DefaultAuthScheme + " "
+	if len(auth) > len(scheme) && strings.EqualFold(auth[:len(scheme)], scheme) &&
+		strings.HasPrefix(auth[len(scheme):], config.Prefix+"_") {
+		return auth[len(scheme):]
+	}
+	return ""
+}
+
+// APIKeyAuth returns a middleware authenticating requests with the API key sent on the configured header or as a
+// bearer token. The subject of the key is stored on the context like the jwt middleware does, along with Claims
+// carrying its id and scopes, so Require and ClaimsFromContext work the same for both. Requests without an API key
+// go through the jwt middleware of config.JWT if set.
+// For missing or invalid keys it sends "401 - Unauthorized" problem response, through the ErrorHandler of config.JWT
+// if set.
+func APIKeyAuth(config APIKeyConfig) echo.MiddlewareFunc {
+	// Defaults
+	config = config.withDefaults()
+
+	var jwtMiddleware echo.MiddlewareFunc
+	respond := ProblemHandler(WriteProblem)
+	if config.JWT != nil {
+		jwtMiddleware = jwtWithConfig(*config.JWT)
+		if config.JWT.ErrorHandler != nil {
+			respond = config.JWT.ErrorHandler
+		}
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+
+		var jwtNext echo.HandlerFunc
+		if jwtMiddleware != nil {
+			jwtNext = jwtMiddleware(next)
+		}
+
+		return func(c echo.Context) error {
+
+			if config.PublicRoutes.Matches(c.Request().Method, routedPath(c.Request())) {
+				return next(c)
+			}
+
+			raw := config.lookup(c)
+			if raw == "" && jwtNext != nil {
+				return jwtNext(c)
+			} else if raw == "" {
+				problem := NewProblem(http.StatusUnauthorized, CodeMissingAPIKey, "the request carries no api key")
+				problem.Challenge = bearerChallenge("", "")
+				return respond(c, problem)
+			}
+
+			key, err := config.AuthenticateAPIKey(raw)
+			if err == ErrInvalidAPIKey {
+				emitAuthEvent(config.Audit, c, EventAPIKeyRejected, "", OutcomeFailure, CodeInvalidAPIKey)
+				return respond(c, invalidTokenProblem(CodeInvalidAPIKey, err.Error()))
+			} else if err != nil {
+				log.Warnf("Failed to check api key: %s", err.Error())
+				emitAuthEvent(config.Audit, c, EventAPIKeyRejected, "", OutcomeFailure, CodeAPIKeysUnavailable)
+				return respond(c, NewProblem(http.StatusServiceUnavailable, CodeAPIKeysUnavailable, "api keys unavailable"))
+			}
+
+			c.Set(config.ContextKey, key.Subject)
+			c.Set(claimsContextKey, &Claims{
+				Subject:   key.Subject,
+				ID:        key.ID,
+				IssuedAt:  key.CreatedAt,
+				ExpiresAt: key.ExpiresAt,
+				Scopes:    key.Scopes,
+				APIKeyID:  key.ID,
+				Custom:    map[string]interface{}{},
+			})
+			return next(c)
+		}
+	}
+}
+
+// ****************************
+// Key management handlers
+// ****************************
+
+// APIKeyCreateHandler returns a request handler creating an API key for the authenticated subject. The key is
+// only shown on the response. Keys can only be granted scopes the subject holds, otherwise it sends
+// "403 - Forbidden" problem response, as do requests authenticated with an API key, so a leaked key cannot mint
+// replacements outliving it.
+// It must be mounted behind the jwt middleware.
+func APIKeyCreateHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.APIKeys == nil {
+		config.APIKeys = &APIKeyConfig{}
+	}
+	apiKeys := config.APIKeys.withDefaults()
+
+	return func(c echo.Context) error {
+
+		claims, ok := ClaimsFromContext(c)
+		if !ok || claims.Subject == "" {
+			return WriteProblem(c, missingTokenProblem())
+		}
+		if claims.APIKeyID != "" {
+			emitAuthEvent(config.Audit, c, EventAPIKeyCreate, claims.Subject, OutcomeFailure, "api keys cannot create api keys")
+			return WriteProblem(c, NewProblem(http.StatusForbidden, CodeAccessDenied, "api keys cannot create api keys"))
+		}
+
+		r := new(apiKeyRequest)
+		if err := c.Bind(r); err != nil {
+			return err
+		}
+		if r.TTL < 0 {
+			return WriteProblem(c, NewProblem(http.StatusBadRequest, CodeInvalidRequest, "ttl cannot be negative"))
+		}
+		for _, scope := range r.Scopes {
+			if !claims.HasScope(scope) {
+				emitAuthEvent(config.Audit, c, EventAPIKeyCreate, claims.Subject, OutcomeFailure, "cannot grant scope "+scope)
+				return WriteProblem(c, NewProblem(http.StatusForbidden, CodeInsufficientScope, "cannot grant scope "+scope))
+			}
+		}
+
+		raw, key, err := apiKeys.GenerateAPIKey(claims.Subject, r.Name, r.Scopes, time.Duration(r.TTL)*time.Second)
+		if err != nil {
+			return err
+		}
+		emitAuthEvent(config.Audit, c, EventAPIKeyCreate, claims.Subject, OutcomeSuccess, key.ID)
+		return c.JSON(http.StatusCreated, apiKeyResponse{Key: raw, APIKey: key})
+	}
+}
+
+// APIKeyListHandler returns a request handler listing the API keys of the authenticated subject, without their
+// secrets.
+// It must be mounted behind the jwt middleware.
+func APIKeyListHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.APIKeys == nil {
+		config.APIKeys = &APIKeyConfig{}
+	}
+	apiKeys := config.APIKeys.withDefaults()
+
+	return func(c echo.Context) error {
+
+		claims, ok := ClaimsFromContext(c)
+		if !ok || claims.Subject == "" {
+			return WriteProblem(c, missingTokenProblem())
+		}
+
+		keys, err := apiKeys.Store.List(claims.Subject)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, keys)
+	}
+}
+
+// APIKeyRevokeHandler returns a request handler revoking the API key of the authenticated subject named on the
+// `id` path parameter.
+// It must be mounted behind the jwt middleware.
+func APIKeyRevokeHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.APIKeys == nil {
+		config.APIKeys = &APIKeyConfig{}
+	}
+	apiKeys := config.APIKeys.withDefaults()
+
+	return func(c echo.Context) error {
+
+		claims, ok := ClaimsFromContext(c)
+		if !ok || claims.Subject == "" {
+			return WriteProblem(c, missingTokenProblem())
+		}
+
+		key, err := apiKeys.Store.Get(c.Param("id"))
+		if err == ErrUnknownAPIKey || (err == nil && key.Subject != claims.Subject) {
+			return WriteProblem(c, NewProblem(http.StatusNotFound, CodeNotFound, ErrUnknownAPIKey.Error()))
+		} else if err != nil {
+			return err
+		}
+
+		if err := apiKeys.Store.Revoke(key.ID, time.Now()); err != nil {
+			return err
+		}
+		emitAuthEvent(config.Audit, c, EventAPIKeyRevoke, claims.Subject, OutcomeSuccess, key.ID)
+		return c.JSON(http.StatusOK, nil)
+	}
+}
+
+// ****************************
+// MongoDB API key store
+// ****************************
+
+// MongoAPIKeyStore keeps API keys on a mongo collection through the global database.Mongo instance. An index on
+// `subject` is recommended.
+type MongoAPIKeyStore struct {
+	// Database holding the collection. When empty the database of the dialed session is used.
+	Database string
+	// Collection holding one document per key.
+	Collection string
+}
+
+// NewMongoAPIKeyStore returns an API key store backed by the given mongo database and collection
+func NewMongoAPIKeyStore(db string, collection string) *MongoAPIKeyStore {
+	return &MongoAPIKeyStore{Database: db, Collection: collection}
+}
+
+func (s *MongoAPIKeyStore) Save(key APIKey) error {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	_, err := mg.DB(s.Database).C(s.Collection).UpsertId(key.ID, key)
+	return err
+}
+
+func (s *MongoAPIKeyStore) Get(id string) (APIKey, error) {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	var key APIKey
+	err := mg.DB(s.Database).C(s.Collection).FindId(id).One(&key)
+	if err == mgo.ErrNotFound {
+		return APIKey{}, ErrUnknownAPIKey
+	}
+	return key, err
+}
+
+func (s *MongoAPIKeyStore) List(subject string) ([]APIKey, error) {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	keys := []APIKey{}
+	err := mg.DB(s.Database).C(s.Collection).Find(bson.M{"subject": subject}).Sort("created_at").All(&keys)
+	return keys, err
+}
+
+func (s *MongoAPIKeyStore) Revoke(id string, at time.Time) error {
+	return s.set(id, bson.M{"revoked_at": at})
+}
+
+func (s *MongoAPIKeyStore) Touch(id string, at time.Time) error {
+	return s.set(id, bson.M{"last_used_at": at})
+}
+
+// set updates fields of the key with the given id
+func (s *MongoAPIKeyStore) set(id string, fields bson.M) error {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	err := mg.DB(s.Database).C(s.Collection).UpdateId(id, bson.M{"$set": fields})
+	if err == mgo.ErrNotFound {
+		return ErrUnknownAPIKey
+	}
+	return err
+}
+
+// ****************************
+// In memory API key store
+// ****************************
+
+// MemoryAPIKeyStore keeps API keys in memory behind a read write lock, as keys are read on every request and
+// seldom written.
+type MemoryAPIKeyStore struct {
+	mutex sync.RWMutex
+	keys  map[string]APIKey
+}
+
+// NewMemoryAPIKeyStore returns an empty in memory API key store
+func NewMemoryAPIKeyStore() *MemoryAPIKeyStore {
+	return &MemoryAPIKeyStore{keys: map[string]APIKey{}}
+}
+
+func (s *MemoryAPIKeyStore) Save(key APIKey) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *MemoryAPIKeyStore) Get(id string) (APIKey, error) {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, ErrUnknownAPIKey
+	}
+	return key, nil
+}
+
+func (s *MemoryAPIKeyStore) List(subject string) ([]APIKey, error) {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keys := []APIKey{}
+	for _, key := range s.keys {
+		if key.Subject == subject {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *MemoryAPIKeyStore) Revoke(id string, at time.Time) error {
+	return s.update(id, func(key *APIKey) { key.RevokedAt = at })
+}
+
+func (s *MemoryAPIKeyStore) Touch(id string, at time.Time) error {
+	return s.update(id, func(key *APIKey) { key.LastUsedAt = at })
+}
+
+// update applies change to the key with the given id
+func (s *MemoryAPIKeyStore) update(id string, change func(key *APIKey)) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return ErrUnknownAPIKey
+	}
+	change(&key)
+	s.keys[id] = key
+	return nil
+}
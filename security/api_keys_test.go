@@ -0,0 +1,179 @@
+package security
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func TestAuthenticateAPIKey(t *testing.T) {
+
+	store := NewMemoryAPIKeyStore()
+	config := APIKeyConfig{Store: store, Prefix: "gu"}
+
+	valid, key, err := config.GenerateAPIKey("patata-id", "ci", []string{"read"}, 0)
+	if err != nil || !strings.HasPrefix(valid, "gu_"+key.ID+"_") {
+		t.Fatalf("expected a prefixed key and got '%s' (%v)", valid, err)
+	}
+	if stored, _ := store.Get(key.ID); strings.Contains(valid, stored.Hash) || stored.Salt == "" {
+		t.Errorf("expected only a salted hash of the secret to be stored")
+	}
+
+	expired, _, _ := config.GenerateAPIKey("patata-id", "old", nil, time.Nanosecond)
+	revoked, revokedKey, _ := config.GenerateAPIKey("patata-id", "leaked", nil, time.Hour)
+	store.Revoke(revokedKey.ID, time.Now())
+
+	var test_cases = []struct {
+		key   string
+		valid bool
+	}{
+		{valid, true},
+		{valid + "x", false},
+		{"sk" + strings.TrimPrefix(valid, "gu"), false},
+		{"gu_" + key.ID, false},
+		{"gu_unknown_secret", false},
+		{expired, false},
+		{revoked, false},
+		{"", false},
+	}
+
+	for _, test_case := range test_cases {
+		authenticated, err := config.AuthenticateAPIKey(test_case.key)
+		if test_case.valid && (err != nil || authenticated.Subject != "patata-id") {
+			t.Errorf("expected key '%s' to authenticate patata-id and got %v", test_case.key, err)
+		}
+		if !test_case.valid && err != ErrInvalidAPIKey {
+			t.Errorf("expected key '%s' to get error %v and got %v", test_case.key, ErrInvalidAPIKey, err)
+		}
+	}
+
+	if stored, _ := store.Get(key.ID); stored.LastUsedAt.IsZero() {
+		t.Errorf("expected last use of the key to be recorded")
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+
+	store := NewMemoryAPIKeyStore()
+	config := APIKeyConfig{
+		Store: store,
+		JWT: &JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256,
+			Revocations: NewMemoryRevocationStore()},
+	}
+	key, _, _ := config.GenerateAPIKey("patata-id", "ci", []string{"read"}, time.Hour)
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+	token, _ := issuer.Issue("ternera-id", nil)
+	forged, _ := issuer.Issue("ternera-id", map[string]interface{}{"api_key": "ci"})
+
+	e := echo.New()
+	e.Use(APIKeyAuth(config))
+	e.GET("/whoami", func(c echo.Context) error {
+		return c.String(http.StatusOK, c.Get(DefaultJWTConfig.ContextKey).(string))
+	})
+	e.GET("/read", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, RequireScopes("read"))
+	e.GET("/write", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	}, RequireScopes("write"))
+	e.POST("/login", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	e.POST("/api-keys", APIKeyCreateHandler(AuthenticationConfig{APIKeys: &config}))
+
+	var test_cases = []struct {
+		method  string
+		path    string
+		header  string
+		value   string
+		status  int
+		subject string
+	}{
+		{echo.GET, "/whoami", DefaultAPIKeyHeader, key, http.StatusOK, "patata-id"},
+		{echo.GET, "/whoami", echo.HeaderAuthorization, "Bearer " + key, http.StatusOK, "patata-id"},
+		{echo.GET, "/whoami", echo.HeaderAuthorization, "Bearer " + token, http.StatusOK, "ternera-id"},
+		{echo.GET, "/whoami", DefaultAPIKeyHeader, key + "x", http.StatusUnauthorized, ""},
+		{echo.GET, "/whoami", "", "", http.StatusUnauthorized, ""},
+		{echo.GET, "/read", DefaultAPIKeyHeader, key, http.StatusOK, ""},
+		{echo.GET, "/write", DefaultAPIKeyHeader, key, http.StatusForbidden, ""},
+		{echo.POST, "/login", "", "", http.StatusOK, ""},
+		{echo.POST, "/api-keys", DefaultAPIKeyHeader, key, http.StatusForbidden, ""},                      //keys cannot mint keys
+		{echo.POST, "/api-keys", echo.HeaderAuthorization, "Bearer " + forged, http.StatusBadRequest, ""}, //tokens claiming a key pass the guard
+	}
+
+	for _, test_case := range test_cases {
+		req := httptest.NewRequest(test_case.method, test_case.path, nil)
+		if test_case.header != "" {
+			req.Header.Set(test_case.header, test_case.value)
+		}
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		if res.Code != test_case.status {
+			t.Errorf("%s %s with %s: expected status %d and got %d", test_case.method, test_case.path,
+				test_case.header, test_case.status, res.Code)
+		}
+		if test_case.subject != "" && res.Body.String() != test_case.subject {
+			t.Errorf("expected subject %s and got %s", test_case.subject, res.Body.String())
+		}
+	}
+}
+
+func TestAPIKeyHandlers(t *testing.T) {
+
+	store := NewMemoryAPIKeyStore()
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+	config := AuthenticationConfig{Credentials: NewMemoryCredentialStore(), Issuer: issuer,
+		APIKeys: &APIKeyConfig{Store: store}}
+
+	e := echo.New()
+	e.Use(JWTWithConfig(JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256,
+		Revocations: NewMemoryRevocationStore()}))
+	LoadAuthenticationRoutesWithConfig(e, config)
+
+	patata, _ := issuer.Issue("patata-id", map[string]interface{}{"scope": "read write"})
+	ternera, _ := issuer.Issue("ternera-id", nil)
+	request := func(method string, path string, token string, payload interface{}, response interface{}) int {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		if response != nil {
+			json.Unmarshal(res.Body.Bytes(), response)
+		}
+		return res.Code
+	}
+
+	var created apiKeyResponse
+	if code := request(echo.POST, "/api-keys", patata, apiKeyRequest{Name: "ci", Scopes: []string{"read"}, TTL: 3600}, &created); code != http.StatusCreated || created.Key == "" {
+		t.Fatalf("expected status %d and a key and got %d", http.StatusCreated, code)
+	}
+	if code := request(echo.POST, "/api-keys", ternera, apiKeyRequest{Name: "ci", Scopes: []string{"read"}}, nil); code != http.StatusForbidden {
+		t.Errorf("expected granting scopes the subject lacks to get status %d and got %d", http.StatusForbidden, code)
+	}
+
+	var keys []APIKey
+	if code := request(echo.GET, "/api-keys", patata, nil, &keys); code != http.StatusOK || len(keys) != 1 || keys[0].ID != created.ID {
+		t.Errorf("expected the created key to be listed and got %d, %+v", code, keys)
+	}
+	if code := request(echo.GET, "/api-keys", ternera, nil, &keys); code != http.StatusOK || len(keys) != 0 {
+		t.Errorf("expected other subjects not to see the key and got %d, %+v", code, keys)
+	}
+
+	if code := request(echo.DELETE, "/api-keys/"+created.ID, ternera, nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected revoking the key of another subject to get status %d and got %d", http.StatusNotFound, code)
+	}
+	if code := request(echo.DELETE, "/api-keys/"+created.ID, patata, nil, nil); code != http.StatusOK {
+		t.Errorf("expected status %d and got %d", http.StatusOK, code)
+	}
+	if _, err := config.APIKeys.AuthenticateAPIKey(created.Key); err != ErrInvalidAPIKey {
+		t.Errorf("expected revoked key to get error %v and got %v", ErrInvalidAPIKey, err)
+	}
+}
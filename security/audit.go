@@ -0,0 +1,171 @@
+package security
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/guidola/go-utils/database"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+// Authentication event types
+const (
+	EventLogin             = "login"
+	EventLoginMFA          = "login_mfa"
+	EventLoginOAuth        = "login_oauth"
+	EventLogout            = "logout"
+	EventLogoutAll         = "logout_all"
+	EventRegister          = "register"
+	EventTokenRefresh      = "token_refresh"
+	EventTokenRejected     = "token_rejected"
+	EventRefreshTokenReuse = "refresh_token_reuse"
+	EventPasswordReset     = "password_reset"
+	EventEmailVerify       = "email_verify"
+	EventTOTPEnroll        = "totp_enroll"
+	EventTOTPDisable       = "totp_disable"
+	EventRecoveryCodeUsed  = "recovery_code_used"
+	EventAPIKeyCreate      = "api_key_create"
+	EventAPIKeyRevoke      = "api_key_revoke"
+	EventAPIKeyRejected    = "api_key_rejected"
+)
+
+// Authentication event outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// DefaultAuditCollection is the collection the mongo audit sink writes events to
+const DefaultAuditCollection = "auth_events"
+
+type (
+	// AuthEvent is the audit record of an authentication action.
+	AuthEvent struct {
+		Time time.Time `json:"time" bson:"time"`
+		// Type of action, one of the Event* constants.
+		Type string `json:"type" bson:"type"`
+		// Actor is the subject performing the action or, when unknown, the identifier it claimed.
+		Actor     string `json:"actor,omitempty" bson:"actor,omitempty"`
+		IP        string `json:"ip" bson:"ip"`
+		UserAgent string `json:"user_agent,omitempty" bson:"user_agent,omitempty"`
+		Method    string `json:"method" bson:"method"`
+		Path      string `json:"path" bson:"path"`
+		// Outcome of the action, either OutcomeSuccess or OutcomeFailure.
+		Outcome string `json:"outcome" bson:"outcome"`
+		// Reason of a failure, or any detail of a success.
+		Reason string `json:"reason,omitempty" bson:"reason,omitempty"`
+	}
+
+	// AuditSink receives the authentication events, e.g. to keep them for incident investigations. Emit is called
+	// on the request path, so its latency adds to the one of the request.
+	AuditSink interface {
+		Emit(event AuthEvent) error
+	}
+)
+
+// emitAuthEvent sends an event about the request of c to sink, if any. Delivery failures are logged, never returned.
+func emitAuthEvent(sink AuditSink, c echo.Context, eventType string, actor string, outcome string, reason string) {
+
+	if sink == nil {
+		return
+	}
+
+	req := c.Request()
+	event := AuthEvent{
+		Time:      time.Now().UTC(),
+		Type:      eventType,
+		Actor:     actor,
+		IP:        c.RealIP(),
+		UserAgent: req.UserAgent(),
+		Method:    req.Method,
+		Path:      req.URL.Path,
+		Outcome:   outcome,
+		Reason:    reason,
+	}
+	if err := sink.Emit(event); err != nil {
+		log.Warnf("Failed to emit %s audit event of %s: %s", eventType, actor, err.Error())
+	}
+}
+
+// ****************************
+// MongoDB audit sink
+// ****************************
+
+// MongoAuditSink writes events to a mongo collection through the global database.Mongo instance. A capped
+// collection or a TTL index on `time` keeps it from growing forever.
+type MongoAuditSink struct {
+	// Database holding the collection. When empty the database of the dialed session is used.
+	Database string
+	// Collection events are inserted to.
+	Collection string
+}
+
+// NewMongoAuditSink returns an audit sink writing to the given mongo database and collection
+func NewMongoAuditSink(db string, collection string) *MongoAuditSink {
+	return &MongoAuditSink{Database: db, Collection: collection}
+}
+
+func (s *MongoAuditSink) Emit(event AuthEvent) error {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	return mg.DB(s.Database).C(s.Collection).Insert(event)
+}
+
+// ****************************
+// JSON lines audit sink
+// ****************************
+
+// JSONLinesAuditSink writes each event as a line of JSON, the format log shippers and jq expect. Events are not
+// buffered, each one is written to the underlying writer before Emit returns so none is lost on a crash.
+type JSONLinesAuditSink struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewJSONLinesAuditSink returns an audit sink writing to w
+func NewJSONLinesAuditSink(w io.Writer) *JSONLinesAuditSink {
+	return &JSONLinesAuditSink{w: w}
+}
+
+// OpenJSONLinesAuditSink returns an audit sink appending to the file at path, which is created if needed
+func OpenJSONLinesAuditSink(path string) (*JSONLinesAuditSink, error) {
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLinesAuditSink(file), nil
+}
+
+func (s *JSONLinesAuditSink) Emit(event AuthEvent) error {
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// a single write per event, so lines of concurrent writers to the same file do not interleave
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the underlying writer if it is an io.Closer
+func (s *JSONLinesAuditSink) Close() error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if closer, ok := s.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
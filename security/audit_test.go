@@ -0,0 +1,192 @@
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+// auditedEvents decodes the events written by a JSONLinesAuditSink
+func auditedEvents(t *testing.T, lines []byte) []AuthEvent {
+
+	var events []AuthEvent
+	scanner := bufio.NewScanner(bytes.NewReader(lines))
+	for scanner.Scan() {
+		var event AuthEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("unexpected error decoding audit line %q: %s", scanner.Text(), err.Error())
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestJSONLinesAuditSink(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// reopening the file appends to it
+	for _, actor := range []string{"patata", "boniato"} {
+		sink, err := OpenJSONLinesAuditSink(path)
+		if err != nil {
+			t.Fatalf("unexpected error opening the audit log: %s", err.Error())
+		}
+		if err := sink.Emit(AuthEvent{Type: EventLogin, Actor: actor, Outcome: OutcomeSuccess}); err != nil {
+			t.Errorf("unexpected error emitting event: %s", err.Error())
+		}
+		if err := sink.Close(); err != nil {
+			t.Errorf("unexpected error closing the audit log: %s", err.Error())
+		}
+	}
+
+	lines, _ := os.ReadFile(path)
+	events := auditedEvents(t, lines)
+	if len(events) != 2 || events[0].Actor != "patata" || events[1].Actor != "boniato" {
+		t.Errorf("unexpected events %+v", events)
+	}
+}
+
+func TestAuthEventsAudited(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher}
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+	revocations := NewMemoryRevocationStore()
+	lines := new(bytes.Buffer)
+	sink := NewJSONLinesAuditSink(lines)
+
+	e := echo.New()
+	e.Use(JWTWithConfig(JWTConfig{
+		SigningKey:    testHMACSecret,
+		SigningMethod: AlgorithmHS256,
+		Revocations:   revocations,
+		Audit:         sink,
+	}))
+	LoadAuthenticationRoutesWithConfig(e, AuthenticationConfig{
+		Credentials: store,
+		Issuer:      issuer,
+		Revocations: revocations,
+		Audit:       sink,
+	})
+
+	request := func(method string, path string, token string, payload interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("User-Agent", "patata-agent/1.0")
+		req.Header.Set(echo.HeaderXRealIP, "10.0.0.7")
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		return res
+	}
+
+	request(echo.POST, "/register", "", RegisterRequest{Email: "patata@terno.io", Username: "patata", Pwd: "pwned123"})
+	credentials, _ := store.Lookup("patata")
+	request(echo.POST, "/login", "", LoginRequest{Uuid: "patata", Pwd: "wrong-pwd"})
+	var token string
+	json.Unmarshal(request(echo.POST, "/login", "", LoginRequest{Uuid: "patata", Pwd: "pwned123"}).Body.Bytes(), &token)
+	request(echo.POST, "/logout/all", token, nil)
+	request(echo.POST, "/logout/all", "not-a-token", nil)
+
+	var test_cases = []struct {
+		eventType string
+		actor     string
+		outcome   string
+		reason    string
+	}{
+		{EventRegister, credentials.Subject, OutcomeSuccess, ""},
+		{EventLogin, "patata", OutcomeFailure, "invalid credentials"},
+		{EventLogin, credentials.Subject, OutcomeSuccess, ""},
+		{EventLogoutAll, credentials.Subject, OutcomeSuccess, ""},
+		{EventTokenRejected, "", OutcomeFailure, CodeMalformedToken},
+	}
+
+	events := auditedEvents(t, lines.Bytes())
+	if len(events) != len(test_cases) {
+		t.Fatalf("expected %d events and got %d: %+v", len(test_cases), len(events), events)
+	}
+	for i, test_case := range test_cases {
+		event := events[i]
+		if event.Type != test_case.eventType || event.Actor != test_case.actor || event.Outcome != test_case.outcome ||
+			event.Reason != test_case.reason {
+			t.Errorf("case %d: expected %+v and got %+v", i, test_case, event)
+		}
+		if event.IP != "10.0.0.7" || event.UserAgent != "patata-agent/1.0" || event.Time.IsZero() {
+			t.Errorf("case %d: missing request details on %+v", i, event)
+		}
+	}
+}
+
+func TestAccountEventsAudited(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher}
+	store.Register(Credentials{Email: "patata@terno.io", Username: "patata"}, "pwned123")
+	credentials, _ := store.Lookup("patata")
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+	revocations := NewMemoryRevocationStore()
+	lines := new(bytes.Buffer)
+	sink := NewJSONLinesAuditSink(lines)
+
+	e := echo.New()
+	e.Use(JWTWithConfig(JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256, Revocations: revocations}))
+	LoadAuthenticationRoutesWithConfig(e, AuthenticationConfig{
+		Credentials:   store,
+		Issuer:        issuer,
+		Revocations:   revocations,
+		RefreshTokens: NewMemoryRefreshTokenStore(),
+		APIKeys:       &APIKeyConfig{Store: NewMemoryAPIKeyStore()},
+		Audit:         sink,
+	})
+
+	request := func(method string, path string, token string, payload interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		return res
+	}
+
+	var tokens tokenResponse
+	json.Unmarshal(request(echo.POST, "/login", "", LoginRequest{Uuid: "patata", Pwd: "pwned123"}).Body.Bytes(), &tokens)
+	request(echo.POST, "/token/refresh", "", refreshRequest{RefreshToken: tokens.RefreshToken})
+	request(echo.POST, "/token/refresh", "", refreshRequest{RefreshToken: tokens.RefreshToken})
+	var created apiKeyResponse
+	json.Unmarshal(request(echo.POST, "/api-keys", tokens.AccessToken, apiKeyRequest{Name: "ci"}).Body.Bytes(), &created)
+	request(echo.DELETE, "/api-keys/"+created.ID, tokens.AccessToken, nil)
+
+	var test_cases = []struct {
+		eventType string
+		outcome   string
+	}{
+		{EventLogin, OutcomeSuccess},
+		{EventTokenRefresh, OutcomeSuccess},
+		{EventRefreshTokenReuse, OutcomeFailure},
+		{EventAPIKeyCreate, OutcomeSuccess},
+		{EventAPIKeyRevoke, OutcomeSuccess},
+	}
+
+	events := auditedEvents(t, lines.Bytes())
+	if len(events) != len(test_cases) {
+		t.Fatalf("expected %d events and got %d: %+v", len(test_cases), len(events), events)
+	}
+	for i, test_case := range test_cases {
+		event := events[i]
+		if event.Type != test_case.eventType || event.Actor != credentials.Subject || event.Outcome != test_case.outcome {
+			t.Errorf("case %d: expected %+v of %s and got %+v", i, test_case, credentials.Subject, event)
+		}
+	}
+}
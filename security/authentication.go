@@ -4,101 +4,365 @@ import (
 	"github.com/labstack/echo"
 	"net/http"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/guidola/go-utils/database"
 	"time"
-	"fmt"
-	"gitlab.com/terno/TernoAPI/model"
 	"path/filepath"
-	"gopkg.in/mgo.v2/bson"
-	"os"
 	"github.com/labstack/gommon/log"
 )
 
 
-var openApiUrls = map[string]struct{}{"/login": {}, "/register": {}} //for now assuming everything in there is login related and therefore does not require jwt
-
-//returns true if the given route is marked as public and therefore accessible without authentication
+//returns true if the given route is marked as public for every method on DefaultPublicRoutes and therefore accessible
+//without authentication
 func NonAuthenticationRequired(route string) bool {
-	_, ok := openApiUrls[route]
-	return ok
+	return DefaultPublicRoutes.Matches("", route)
 }
 
 
+type (
+	// AuthenticationConfig defines the config for the authentication request handlers.
+	AuthenticationConfig struct {
+		// Credential store the login attempts are checked against.
+		// Optional. Default value a MongoCredentialStore over DefaultUsersCollection.
+		Credentials CredentialStore
+
+		// Requirements passwords must meet on registration.
+		// Optional. Default value DefaultPasswordPolicy.
+		PasswordPolicy *PasswordPolicy
+
+		// IssueTokenOnRegister makes the register handler respond with a token for the new account, so it does not
+		// have to log in afterwards.
+		// Optional. Default value false.
+		IssueTokenOnRegister bool
+
+		// Store for refresh tokens. When set, login responds with an access and refresh token pair instead of the
+		// bare access token and the `/token/refresh` route gets mounted.
+		// RefreshHandler mounted on its own falls back to a RedisRefreshTokenStore.
+		// Optional. Default value nil, no refresh tokens are issued.
+		RefreshTokens RefreshTokenStore
+
+		// Lifetime of each refresh token.
+		// Optional. Default value DefaultRefreshTokenTTL.
+		RefreshTokenTTL time.Duration
+
+		// Issuer of the access tokens handed out on login. If it signs with a KeySet its public keys get published
+		// on JWKSPath.
+		// Optional. Default value the DefaultTokenIssuer.
+		Issuer *TokenIssuer
+
+		// SessionCookie enables the session mode for browser clients: login sets the token on an HttpOnly cookie
+		// and responds with the CSRF token instead of the token itself, and logout clears the cookie. No refresh
+		// tokens are issued in session mode. See SessionCookieConfig on how to protect the routes.
+		// Optional. Default value nil, tokens are returned on the response body.
+		SessionCookie *SessionCookieConfig
+
+		// LoginThrottle enables the brute force protection of the login handler.
+		// Optional. Default value nil, login attempts are not throttled.
+		LoginThrottle *LoginThrottleConfig
+
+		// Store the tokens revoked on logout are kept on.
+		// Optional. Default value DefaultRevocationStore.
+		Revocations RevocationStore
+
+		// MFA enables two-factor authentication: accounts with a confirmed TOTP enrollment get an mfa pending token
+		// on login, to be exchanged at `/login/mfa` along with a TOTP or recovery code. See MFAConfig.
+		// Optional. Default value nil, the password is enough to log in.
+		MFA *MFAConfig
+
+		// OAuth enables the social login through external OpenID Connect providers. It requires a credential store
+		// implementing IdentityLinker. See OAuthConfig.
+		// Optional. Default value nil.
+		OAuth *OAuthConfig
+
+		// APIKeys enables the API key management routes, letting authenticated users create, list and revoke their
+		// API keys. Protect the routes with APIKeyAuth to accept the keys. See APIKeyConfig.
+		// Optional. Default value nil.
+		APIKeys *APIKeyConfig
+
+		// AccountTokens enables the password reset and email verification flows, and the verification email sent on
+		// registration. See AccountTokenConfig.
+		// Optional. Default value nil.
+		AccountTokens *AccountTokenConfig
+
+		// Audit receives an event for every login, logout, registration, token refresh and password reset, and for
+		// every change to the second factor, API keys or email verification, either successful or failed. See
+		// AuthEvent.
+		// Optional. Default value nil, no events are emitted.
+		Audit AuditSink
+	}
+)
+
+var (
+	// DefaultAuthenticationConfig is the default config for the authentication request handlers.
+	DefaultAuthenticationConfig = AuthenticationConfig{
+		Credentials: NewMongoCredentialStore("", DefaultUsersCollection),
+	}
+)
+
+
 func LoadAuthenticationRoutes(e *echo.Echo){
+	LoadAuthenticationRoutesWithConfig(e, DefaultAuthenticationConfig)
+}
+
+// LoadAuthenticationRoutesWithConfig mounts the authentication routes using handlers built from config.
+func LoadAuthenticationRoutesWithConfig(e *echo.Echo, config AuthenticationConfig){
+
+	e.POST("/login", LoginHandler(config))
+	e.POST("/logout", LogoutHandler(config))
+	if config.SessionCookie == nil {
+		//kept for the clients logging out with GET, bearer tokens are not sent along by cross-site links
+		e.GET("/logout", LogoutHandler(config))
+	}
+	e.POST("/logout/all", LogoutEverywhereHandler(config))
 
-	e.POST("/login", HandleLoginRequest)
-	e.GET("/logout", HandleLogoutRequest)
+	credentials := config.Credentials
+	if credentials == nil {
+		credentials = DefaultAuthenticationConfig.Credentials
+	}
+	if _, ok := credentials.(CredentialRegistrar); ok {
+		e.POST("/register", RegisterHandler(config))
+	}
+	if config.RefreshTokens != nil {
+		e.POST("/token/refresh", RefreshHandler(config))
+	}
+	if config.Issuer != nil && config.Issuer.KeySet() != nil {
+		e.GET(JWKSPath, config.Issuer.KeySet().JWKSHandler)
+	}
+	if config.MFA != nil {
+		e.POST("/login/mfa", MFALoginHandler(config))
+		e.POST("/mfa/totp", TOTPEnrollHandler(config))
+		e.POST("/mfa/totp/confirm", TOTPConfirmHandler(config))
+		e.DELETE("/mfa/totp", TOTPDisableHandler(config))
+	}
+	if config.OAuth != nil {
+		e.GET("/login/oauth/:provider", OAuthStartHandler(config))
+		e.GET("/login/oauth/:provider/callback", OAuthCallbackHandler(config))
+		e.GET("/login/oauth/:provider/link", OAuthLinkHandler(config))
+	}
+	if config.APIKeys != nil {
+		e.POST("/api-keys", APIKeyCreateHandler(config))
+		e.GET("/api-keys", APIKeyListHandler(config))
+		e.DELETE("/api-keys/:id", APIKeyRevokeHandler(config))
+	}
+	if config.AccountTokens != nil {
+		e.POST("/password/forgot", PasswordForgotHandler(config))
+		e.POST("/password/reset", PasswordResetHandler(config))
+		e.POST("/email/verify", EmailVerifyHandler(config))
+		e.POST("/email/verify/request", EmailVerificationRequestHandler(config))
+	}
 
 }
 
 // request handler that returns a json formatted string with the response to the authentication attempt
 func HandleLoginRequest(c echo.Context) error{
+	return LoginHandler(DefaultAuthenticationConfig)(c)
+}
 
-	u := new(model.LoginRequest)
-	if err := c.Bind(u); err != nil {
-		return err
+// LoginHandler returns a login request handler that authenticates users against the credential store of config.
+// Wrong credentials get "403 - Forbidden" problem response and a credential store outage "503 - Service
+// Unavailable" one.
+// See: `HandleLoginRequest()`.
+func LoginHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.Credentials == nil {
+		config.Credentials = DefaultAuthenticationConfig.Credentials
 	}
-
-	if allowed, mongo_id, err := MONGO_authenticateUser(u); err == nil && allowed {
-		tokenstring := JwtGetRSAToken(mongo_id)
-		return c.JSON(http.StatusOK, tokenstring)
-	} else {
-		return c.JSON(http.StatusForbidden, nil)
+	if config.RefreshTokenTTL == 0 {
+		config.RefreshTokenTTL = DefaultRefreshTokenTTL
 	}
 
+	return func(c echo.Context) error {
+
+		u := new(LoginRequest)
+		if err := c.Bind(u); err != nil {
+			return err
+		}
+
+		if config.LoginThrottle != nil {
+			if err := config.LoginThrottle.throttleLogin(c, u.Uuid); err != nil {
+				emitAuthEvent(config.Audit, c, EventLogin, u.Uuid, OutcomeFailure, "too many attempts")
+				return respondWithProblem(c, err)
+			}
+		}
+
+		allowed, subject, err := AuthenticateUser(config.Credentials, u.Uuid, u.Pwd)
+		if err != nil {
+			log.Warnf("Failed to check credentials of %s against the credential store: %s", u.Uuid, err.Error())
+			emitAuthEvent(config.Audit, c, EventLogin, u.Uuid, OutcomeFailure, "credential store unavailable")
+		} else if !allowed {
+			emitAuthEvent(config.Audit, c, EventLogin, u.Uuid, OutcomeFailure, "invalid credentials")
+		}
+		if config.LoginThrottle != nil && err == nil {
+			config.LoginThrottle.recordAttempt(u.Uuid, c.RealIP(), allowed)
+		}
+		if err != nil {
+			return WriteProblem(c, NewProblem(http.StatusServiceUnavailable, CodeCredentialsUnavailable,
+				"credentials cannot be checked, retry later"))
+		} else if !allowed {
+			return WriteProblem(c, NewProblem(http.StatusForbidden, CodeInvalidCredentials, "invalid credentials"))
+		}
+
+		issuer, err := issuerOrDefault(config.Issuer)
+		if err != nil {
+			return err
+		}
+
+		return completeLogin(c, config, issuer, subject, EventLogin)
+	}
 }
 
+// completeLogin responds to subject having proven its identity, either with the tokens handed out on login or, if
+// it has two-factor authentication enabled, with an mfa pending token. The login is audited as an event of the
+// given type.
+func completeLogin(c echo.Context, config AuthenticationConfig, issuer *TokenIssuer, subject string, event string) error {
+
+	if config.MFA != nil {
+		mfa := config.MFA.withDefaults()
+		required, err := mfa.required(subject)
+		if err != nil {
+			log.Warnf("Failed to check the two-factor enrollment of %s: %s", subject, err.Error())
+			return err
+		}
+		if required {
+			if err := mfa.mfaChallenge(c, issuer, subject); err != nil {
+				return err
+			}
+			emitAuthEvent(config.Audit, c, event, subject, OutcomeSuccess, "mfa required")
+			return nil
+		}
+	}
 
-func MONGO_authenticateUser(credentials *model.LoginRequest) (bool, string, error){
+	if err := respondWithTokens(c, config, issuer, subject); err != nil {
+		return err
+	}
+	emitAuthEvent(config.Audit, c, event, subject, OutcomeSuccess, "")
+	return nil
+}
 
-	mg := database.GetMongoInstance().GetCopy()
+// respondWithTokens responds with the tokens handed out to subject on login, as set by config
+func respondWithTokens(c echo.Context, config AuthenticationConfig, issuer *TokenIssuer, subject string) error {
 
-	collection := mg.DB(model.TernoDB).C(model.UsersCollection)
-	query := collection.Find(bson.M{
-		"$or": []interface{}{
-			bson.M{"email" : credentials.Uuid, "pwd": credentials.Pwd},
-			bson.M{"username": credentials.Uuid, "pwd": credentials.Pwd},
-	}})
+	if config.SessionCookie != nil {
+		tokenstring, err := issuer.Issue(subject, nil)
+		if err != nil {
+			return err
+		}
+		csrf, err := config.SessionCookie.SetSession(c, tokenstring, issuer.TTL())
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, sessionResponse{CSRFToken: csrf, ExpiresIn: int64(issuer.TTL() / time.Second)})
+	}
 
-	result, err := query.Count()
+	if config.RefreshTokens == nil {
+		tokenstring, err := issuer.Issue(subject, nil)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, tokenstring)
+	}
 
+	refreshToken, err := IssueRefreshToken(config.RefreshTokens, subject, config.RefreshTokenTTL)
 	if err != nil {
-		return false, "", err
+		log.Warnf("Failed to issue refresh token for %s: %s", subject, err.Error())
+		return err
 	}
 
-	var mongo_id_struct struct{ Id  string  `json:"_id" bson:"_id"`}
-	err = query.One(&mongo_id_struct)
-
-	return result == 1, mongo_id_struct.Id, nil
+	response, err := newTokenResponse(issuer, subject, refreshToken)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
 }
 
 
 // request handler that logouts user from the system, invalidates the associated JWT therefore logging him out
 // logout request is parameterless since we are going to use the JWT to perform that action
 func HandleLogoutRequest(c echo.Context) error{
+	return LogoutHandler(DefaultAuthenticationConfig)(c)
+}
 
-	token_string, err := JwtFromHeader(echo.HeaderAuthorization)(c)
-	config := DefaultJWTConfig
-
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, nil)
+// LogoutHandler returns a logout request handler that invalidates the token of the request, which must be signed by
+// the issuer of config. In session mode the token is taken from the session cookie first and the session cookies are
+// cleared once the token is revoked. Mount it on POST in session mode, so the CSRF middleware protects it and
+// cross-site links cannot log users out, as browsers send the session cookie along with them.
+// When config has a refresh token store, the refresh token given on the `refresh_token` field of the payload or on
+// the RefreshTokenCookie has its whole family revoked too, so it cannot mint new access tokens.
+// Missing or invalid tokens get "401 - Unauthorized" problem response and tokens that cannot be revoked get
+// "503 - Service Unavailable" one, leaving the session cookies in place.
+// See: `HandleLogoutRequest()`.
+func LogoutHandler(config AuthenticationConfig) echo.HandlerFunc {
+
+	lookup := DefaultJWTConfig
+	if config.SessionCookie != nil {
+		lookup.TokenLookup = "cookie:" + config.SessionCookie.withDefaults().Name + "," + lookup.TokenLookup
 	}
+	extractor := lookup.extractor()
+	if config.RefreshTokenTTL == 0 {
+		config.RefreshTokenTTL = DefaultRefreshTokenTTL
+	}
+
+	return func(c echo.Context) error {
+
+		token_string, err := extractor(c)
+		if err != nil {
+			return WriteProblem(c, missingTokenProblem())
+		}
 
-	token, err := jwt.Parse(token_string, func(t *jwt.Token) (interface{}, error) {
-		// Check the signing method
-		if t.Method.Alg() != config.SigningMethod {
-			return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
+		issuer, err := issuerOrDefault(config.Issuer)
+		if err != nil {
+			return err
+		}
+		token, err := issuer.verifier().parseToken(token_string)
+		if err != nil {
+			problem := tokenProblem(err)
+			emitAuthEvent(config.Audit, c, EventLogout, "", OutcomeFailure, problem.Code)
+			return WriteProblem(c, problem)
 		}
-		return config.SigningKey, nil
 
-	})
+		claims, _ := token.Claims.(jwt.MapClaims)
+		subject, _ := claims["sub"].(string)
+		err = RevokeToken(revocationStoreOrDefault(config.Revocations), *token)
+		if err == nil && config.RefreshTokens != nil {
+			err = revokeRefreshToken(config.RefreshTokens, subject, refreshTokenFromRequest(c), config.RefreshTokenTTL)
+		}
+		if err != nil {
+			log.Warnf("Failed to revoke token: %s", err.Error())
+			emitAuthEvent(config.Audit, c, EventLogout, subject, OutcomeFailure, "revocation failed")
+			return WriteProblem(c, NewProblem(http.StatusServiceUnavailable, CodeRevocationUnavailable,
+				"token could not be revoked, retry later"))
+		}
+		emitAuthEvent(config.Audit, c, EventLogout, subject, OutcomeSuccess, "")
 
-	if err != nil {
-		return c.JSON(http.StatusUnauthorized, nil)
+		if config.SessionCookie != nil {
+			config.SessionCookie.ClearSession(c)
+		}
+		return c.JSON(http.StatusOK, nil)
 	}
+}
+
+
+// LogoutEverywhereHandler returns a request handler that logs the authenticated subject out of every session,
+// revoking all its access tokens and, if the refresh token store of config supports it, its refresh tokens.
+// It must be mounted behind the jwt middleware.
+func LogoutEverywhereHandler(config AuthenticationConfig) echo.HandlerFunc {
+	return func(c echo.Context) error {
 
-	InvalidateJWT(*token)
-	return c.JSON(http.StatusOK, nil)
+		claims, ok := ClaimsFromContext(c)
+		if !ok || claims.Subject == "" {
+			return WriteProblem(c, missingTokenProblem())
+		}
+
+		if err := revokeAllSessions(config, claims.Subject); err != nil {
+			log.Warnf("Failed to revoke the sessions of %s: %s", claims.Subject, err.Error())
+			emitAuthEvent(config.Audit, c, EventLogoutAll, claims.Subject, OutcomeFailure, "revocation failed")
+			return err
+		}
+		emitAuthEvent(config.Audit, c, EventLogoutAll, claims.Subject, OutcomeSuccess, "")
+
+		if config.SessionCookie != nil {
+			config.SessionCookie.ClearSession(c)
+		}
+		return c.JSON(http.StatusOK, nil)
+	}
 }
 
 
@@ -108,66 +372,92 @@ func HandleLogoutRequest(c echo.Context) error{
 
 var rsaPrivateKeyLocation, _ = filepath.Abs("private_key.pem")
 
-//claim values
+//default claim values
 const(
 	ExpirationTime = 7200 //2h //set to 30 seconds for debuging purposes, raise that to a realistic value once all is stable
-	TokenIssuer = "api.terno.io"
+	DefaultIssuer = "api.terno.io"
 )
 
-//returns a signed valid JWT ready to send back to the end user
+//returns a signed valid JWT ready to send back to the end user, signed by the DefaultTokenIssuer.
+//Returns an empty string if the token could not be signed, use TokenIssuer.Issue to get the error instead.
 func JwtGetRSAToken(mongo_id string) (string) {
 
-	/* create the token and configure it to work with the following header
-	 *  {
-	 *      "typ":"JWT"
-	 *      "alg":"RS512"
-	 *  }
-	 */
-	token := jwt.New(jwt.GetSigningMethod("RS512"))
-
-	//define the token claims
-	token.Claims.(jwt.MapClaims)["sub"] = mongo_id
-	token.Claims.(jwt.MapClaims)["exp"] = time.Now().Unix() + ExpirationTime
-	token.Claims.(jwt.MapClaims)["iss"] = TokenIssuer
+	issuer, err := DefaultTokenIssuer()
+	if err != nil {
+		log.Warnf("Failed to load the default token issuer: %s", err.Error())
+		return ""
+	}
 
-	tokenstring, _ := token.SignedString(GetRSAPrivateKey(os.Getenv(JwtCertsLocation) + "private_key.pem"))
+	tokenstring, err := issuer.Issue(mongo_id, nil)
+	if err != nil {
+		log.Warnf("Failed to sign token for %s: %s", mongo_id, err.Error())
+	}
 
 	return tokenstring
 }
 
 
 // ****************************
-// Redis interaction functions
+// Token revocation functions
 // ****************************
 
-func InvalidateJWT(token jwt.Token){
-
-	// add token to redis with an expiration time of the expiration time of the token to invalidate this token and not
-	// allow access to the system when this token is provided
+// SessionRevocationTTL is how long a RevokeAllSessions watermark is kept. It has to outlive every token issued
+// before it, access and refresh ones.
+var SessionRevocationTTL = DefaultRefreshTokenTTL
 
-	redis := database.GetRedisInstance()
-	_, err := redis.Execute("SET", token.Raw, 0, "EX", int64(token.Claims.(jwt.MapClaims)["exp"].(float64)) - time.Now().Unix())
+// InvalidateJWT revokes token on the DefaultRevocationStore until it expires, so it does not allow access to the
+// system anymore
+func InvalidateJWT(token jwt.Token){
 
-	if err != nil {
-		log.Warnf("Failed to store instance on redis")
+	if err := RevokeToken(DefaultRevocationStore, token); err != nil {
+		log.Warnf("Failed to revoke token: %s", err.Error())
 	}
 
 }
 
+// RevokeAllSessions invalidates every access token issued to subject until now on the DefaultRevocationStore,
+// logging it out everywhere, e.g. after a password change. Tokens issued afterwards are valid.
+func RevokeAllSessions(subject string) error {
+	return RevokeSubject(DefaultRevocationStore, subject)
+}
 
-func IsJWTValid(token jwt.Token) bool {
+// revokeAllSessions revokes every access token of subject along with its refresh tokens, when the refresh token
+// store of config supports it
+func revokeAllSessions(config AuthenticationConfig, subject string) error {
 
-	redis := database.GetRedisInstance()
-	response, err := redis.Execute("EXISTS", token.Raw)
+	if err := RevokeSubject(revocationStoreOrDefault(config.Revocations), subject); err != nil {
+		return err
+	}
 
-	if err != nil {
-		log.Warnf("Failed check existance of token on redis")
+	if revoker, ok := config.RefreshTokens.(RefreshSubjectRevoker); ok {
+		ttl := config.RefreshTokenTTL
+		if ttl == 0 {
+			ttl = DefaultRefreshTokenTTL
+		}
+		now := time.Now()
+		return revoker.RevokeSubject(subject, now, now.Add(ttl))
 	}
+	return nil
+}
+
 
-	if val, _ := response.Int(); val == 1 {
+// IsJWTValid reports whether token has not been revoked, applying the RevocationPolicy of the DefaultJWTConfig when
+// its revocation status cannot be checked.
+func IsJWTValid(token jwt.Token) bool {
+	if isMFAPending(token) {
 		return false
-	} else{
-		return true
 	}
+	valid, _ := DefaultJWTConfig.checkRevocation(token)
+	return valid
+}
 
+// CheckJWT reports whether token has not been revoked on the DefaultRevocationStore, either on its own or by
+// revoking all the sessions of its subject. Returns an error if the revocation status cannot be checked.
+// Mfa pending tokens are never valid.
+func CheckJWT(token jwt.Token) (bool, error) {
+	if isMFAPending(token) {
+		return false, nil
+	}
+	revoked, err := IsTokenRevoked(DefaultRevocationStore, token)
+	return !revoked && err == nil, err
 }
@@ -8,6 +8,8 @@ import (
 	"net/http"
 	"os"
 	"net/http/httptest"
+	"github.com/guidola/go-utils/database"
+	"time"
 )
 
 
@@ -23,7 +25,7 @@ func TestNonAuthenticationRequired(t *testing.T) {
 
 	for _, test_case := range test_cases {
 		if ret := NonAuthenticationRequired(test_case.url); ret != test_case.open {
-			t.Errorf("URL is %s when it should be %s", ret, test_case.open);
+			t.Errorf("URL is %t when it should be %t", ret, test_case.open);
 		}
 	}
 
@@ -33,13 +35,13 @@ func TestNonAuthenticationRequired(t *testing.T) {
 func TestLoginLogoutLifecycle(t *testing.T) {
 
 	//initi redis
-	var redisURI = os.Getenv(database.RedisURI)
+	var redisURI = os.Getenv("REDIS_URI")
 	database.GetRedisInstance().Create("tcp", redisURI, 5)
 	defer database.GetRedisInstance().Destroy()
 
-	var mongoHosts = []string{os.Getenv(database.MongoURI)}
-	database.GetMongoInstance().Create(mongoHosts)
-	defer database.GetMongoInstance().Destroy()
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher, AllowPlaintext: true}
+	store.Add(Credentials{Subject: "test-subject", Username: "test", Secret: "pwd"})
 
 	// make login request
 	e := echo.New()
@@ -48,13 +50,13 @@ func TestLoginLogoutLifecycle(t *testing.T) {
 		return c.String(http.StatusOK, "foo bar")
 	}
 	e.GET("/testerino-divino", test_handler)
-	LoadAuthenticationRoutes(e)
+	LoadAuthenticationRoutesWithConfig(e, AuthenticationConfig{Credentials: store})
 
 	payload := bytes.NewBufferString("{\"uuid\":\"patata\",\"pwd\":\"pwned\"}")
 	req, _ := http.NewRequest(echo.POST, "/login", payload)
-	req.Header().Set(echo.HeaderContentType, "application/json")
+	req.Header.Set(echo.HeaderContentType, "application/json")
 	res := httptest.NewRecorder()
-	e.ServeHTTP(req, res)
+	e.ServeHTTP(res, req)
 
 	if res.Code != http.StatusForbidden {
 		t.Errorf("Expect to get StatusForbidden when login with bad credentials but got %d", res.Code)
@@ -63,9 +65,9 @@ func TestLoginLogoutLifecycle(t *testing.T) {
 	//login with a valid user
 	payload = bytes.NewBufferString("{\"uuid\":\"test\",\"pwd\":\"pwd\"}")
 	req, _ = http.NewRequest(echo.POST, "/login", payload)
-	req.Header().Set(echo.HeaderContentType, "application/json")
+	req.Header.Set(echo.HeaderContentType, "application/json")
 	res = httptest.NewRecorder()
-	e.ServeHTTP(req, res)
+	e.ServeHTTP(res, req)
 
 	//check we got a 200 response code with a 512bits length token
 	var token_string string
@@ -80,10 +82,10 @@ func TestLoginLogoutLifecycle(t *testing.T) {
 	// and register some route
 
 	req, _ = http.NewRequest(echo.GET, "/testerino-divino", bytes.NewBufferString(""))
-	req.Header().Set(echo.HeaderAuthorization, "jwt$" + token_string)
+	req.Header.Set(echo.HeaderAuthorization, "jwt$" + token_string)
 
 	res = httptest.NewRecorder()
-	e.ServeHTTP(req, res)
+	e.ServeHTTP(res, req)
 
 	//we expect to get a 200 Status OK
 	if res.Code != http.StatusOK {
@@ -92,10 +94,10 @@ func TestLoginLogoutLifecycle(t *testing.T) {
 	}
 
 	//if we could perform a request we can proceed to check if logout functionality works as well
-	req, _ = http.NewRequest(echo.GET, "/logout", nil)
-	req.Header().Set(echo.HeaderAuthorization, "jwt$" + token_string)
+	req, _ = http.NewRequest(echo.POST, "/logout", nil)
+	req.Header.Set(echo.HeaderAuthorization, "jwt$" + token_string)
 	res = httptest.NewRecorder()
-	e.ServeHTTP(req, res)
+	e.ServeHTTP(res, req)
 
 	if res.Code != http.StatusOK {
 		t.Errorf("Expected to get response code %d for /logout and got %d", http.StatusOK, res.Code)
@@ -104,14 +106,168 @@ func TestLoginLogoutLifecycle(t *testing.T) {
 
 	//at this point we should not be able to perform protected petitions anymore
 	req, _ = http.NewRequest(echo.GET, "/testerino-divino", nil)
-	req.Header().Set(echo.HeaderAuthorization, "jwt$" + token_string)
+	req.Header.Set(echo.HeaderAuthorization, "jwt$" + token_string)
 	res = httptest.NewRecorder()
-	e.ServeHTTP(req, res)
+	e.ServeHTTP(res, req)
 
 	//we expect to get a 401 Status Unauthorized
-	if res != http.StatusUnauthorized {
+	if res.Code != http.StatusUnauthorized {
 		t.Errorf("Expected to get response code %d for /testerino-divino and got %d", http.StatusUnauthorized, res.Code)
 		t.FailNow()
 	}
 
-}
\ No newline at end of file
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+
+	//initi redis
+	var redisURI = os.Getenv("REDIS_URI")
+	database.GetRedisInstance().Create("tcp", redisURI, 5)
+	defer database.GetRedisInstance().Destroy()
+
+	config := JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256}
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+
+	first, _ := issuer.Issue("revoked-subject", nil)
+	other, _ := issuer.Issue("other-subject", nil)
+	firstToken, _ := config.parseToken(first)
+	otherToken, _ := config.parseToken(other)
+
+	//revoking a token by its id leaves the other tokens of the subject untouched
+	second, _ := issuer.Issue("revoked-subject", nil)
+	secondToken, _ := config.parseToken(second)
+	InvalidateJWT(*secondToken)
+	if IsJWTValid(*secondToken) || !IsJWTValid(*firstToken) {
+		t.Errorf("expected only the invalidated token to be revoked")
+	}
+
+	//tokens issued before the revocation are revoked
+	if err := NewRedisRevocationStore().RevokeSubject("revoked-subject", time.Now(), time.Now().Add(time.Minute)); err != nil {
+		t.Fatalf("expected err to be nil and got %s instead", err)
+	}
+	if IsJWTValid(*firstToken) {
+		t.Errorf("expected tokens issued before the revocation to be invalid")
+	}
+	if !IsJWTValid(*otherToken) {
+		t.Errorf("expected tokens of other subjects to stay valid")
+	}
+
+	if err := RevokeAllSessions("revoked-subject"); err != nil {
+		t.Fatalf("expected err to be nil and got %s instead", err)
+	}
+	//tokens issued right after the revocation are valid, even on the same second
+	third, _ := issuer.Issue("revoked-subject", nil)
+	thirdToken, _ := config.parseToken(third)
+	if !IsJWTValid(*thirdToken) {
+		t.Errorf("expected tokens issued after the revocation to be valid")
+	}
+}
+
+func TestLogoutRevokesToken(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher}
+	store.Register(Credentials{Email: "patata@terno.io", Username: "patata"}, "pwned123")
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+	revocations := NewMemoryRevocationStore()
+
+	e := echo.New()
+	e.Use(JWTWithConfig(JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256, Revocations: revocations}))
+	LoadAuthenticationRoutesWithConfig(e, AuthenticationConfig{Credentials: store, Issuer: issuer, Revocations: revocations})
+	e.GET("/orders", func(c echo.Context) error {
+		return c.String(http.StatusOK, "orders")
+	})
+
+	request := func(method string, path string, token string, payload interface{}) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		return res
+	}
+
+	var token string
+	json.Unmarshal(request(echo.POST, "/login", "", LoginRequest{Uuid: "patata", Pwd: "pwned123"}).Body.Bytes(), &token)
+
+	var test_cases = []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{echo.GET, "/orders", http.StatusOK},
+		{echo.GET, "/logout", http.StatusOK},
+		{echo.GET, "/orders", http.StatusUnauthorized},
+		{echo.POST, "/logout", http.StatusUnauthorized},
+	}
+
+	for i, test_case := range test_cases {
+		if res := request(test_case.method, test_case.path, token, nil); res.Code != test_case.code {
+			t.Errorf("case %d: expected %s %s to get status %d and got %d", i, test_case.method, test_case.path, test_case.code, res.Code)
+		}
+	}
+}
+
+func TestLogoutRevokesRefreshToken(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher}
+	store.Register(Credentials{Email: "patata@terno.io", Username: "patata"}, "pwned123")
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+	revocations := NewMemoryRevocationStore()
+
+	e := echo.New()
+	e.Use(JWTWithConfig(JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256, Revocations: revocations}))
+	LoadAuthenticationRoutesWithConfig(e, AuthenticationConfig{Credentials: store, Issuer: issuer,
+		Revocations: revocations, RefreshTokens: NewMemoryRefreshTokenStore()})
+
+	request := func(path string, token string, payload interface{}, cookie *http.Cookie) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(echo.POST, path, bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		return res
+	}
+	login := func() tokenResponse {
+		var tokens tokenResponse
+		json.Unmarshal(request("/login", "", LoginRequest{Uuid: "patata", Pwd: "pwned123"}, nil).Body.Bytes(), &tokens)
+		return tokens
+	}
+
+	var test_cases = []struct {
+		name   string
+		logout func(tokens tokenResponse) *httptest.ResponseRecorder
+	}{
+		{"payload", func(tokens tokenResponse) *httptest.ResponseRecorder {
+			return request("/logout", tokens.AccessToken, refreshRequest{RefreshToken: tokens.RefreshToken}, nil)
+		}},
+		{"cookie", func(tokens tokenResponse) *httptest.ResponseRecorder {
+			return request("/logout", tokens.AccessToken, nil, &http.Cookie{Name: RefreshTokenCookie, Value: tokens.RefreshToken})
+		}},
+	}
+
+	for _, test_case := range test_cases {
+		tokens := login()
+		//a rotated refresh token of the same family is revoked along with the one given on logout
+		var rotated tokenResponse
+		json.Unmarshal(request("/token/refresh", "", refreshRequest{RefreshToken: tokens.RefreshToken}, nil).Body.Bytes(), &rotated)
+		tokens.RefreshToken = rotated.RefreshToken
+
+		if res := test_case.logout(tokens); res.Code != http.StatusOK {
+			t.Errorf("%s: expected logout to get status %d and got %d", test_case.name, http.StatusOK, res.Code)
+		}
+		if res := request("/token/refresh", "", refreshRequest{RefreshToken: tokens.RefreshToken}, nil); res.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected refresh after logout to get status %d and got %d", test_case.name, http.StatusUnauthorized, res.Code)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package security
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	requireRole  = "role"
+	requireScope = "scope"
+	requireAll   = "AND"
+	requireAny   = "OR"
+)
+
+type (
+	// Requirement is an authorization rule evaluated against the claims of the authenticated token. Requirements
+	// on single roles or scopes can be combined with AllOf and AnyOf into arbitrary AND/OR expressions, e.g.
+	//
+	//	AnyOf(Role("admin"), AllOf(Role("support"), Scope("orders:write")))
+	Requirement struct {
+		kind     string
+		value    string
+		children []Requirement
+	}
+
+	// router is implemented by both *echo.Echo and *echo.Group
+	router interface {
+		Group(prefix string, m ...echo.MiddlewareFunc) *echo.Group
+	}
+)
+
+// Role requires the subject to have been granted role
+func Role(role string) Requirement {
+	return Requirement{kind: requireRole, value: role}
+}
+
+// Scope requires the token to have been granted scope
+func Scope(scope string) Requirement {
+	return Requirement{kind: requireScope, value: scope}
+}
+
+// AllOf requires every one of requirements to be satisfied
+func AllOf(requirements ...Requirement) Requirement {
+	return Requirement{kind: requireAll, children: requirements}
+}
+
+// AnyOf requires at least one of requirements to be satisfied
+func AnyOf(requirements ...Requirement) Requirement {
+	return Requirement{kind: requireAny, children: requirements}
+}
+
+// SatisfiedBy reports whether claims satisfy the requirement
+func (r Requirement) SatisfiedBy(claims *Claims) bool {
+
+	switch r.kind {
+	case requireRole:
+		return claims.HasRole(r.value)
+	case requireScope:
+		return claims.HasScope(r.value)
+	case requireAll:
+		for _, child := range r.children {
+			if !child.SatisfiedBy(claims) {
+				return false
+			}
+		}
+		return true
+	case requireAny:
+		for _, child := range r.children {
+			if child.SatisfiedBy(claims) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return false
+}
+
+// String returns the requirement as an expression such as "role:admin OR (role:support AND scope:orders:write)"
+func (r Requirement) String() string {
+
+	switch r.kind {
+	case requireRole, requireScope:
+		return r.kind + ":" + r.value
+	}
+
+	operands := make([]string, len(r.children))
+	for i, child := range r.children {
+		operands[i] = child.String()
+		if len(child.children) > 1 {
+			operands[i] = "(" + operands[i] + ")"
+		}
+	}
+	return strings.Join(operands, " "+r.kind+" ")
+}
+
+// Require returns a middleware that only lets through requests whose token, authenticated by the jwt middleware,
+// satisfies requirement.
+// For requests without authenticated claims it sends "401 - Unauthorized" problem response.
+// For tokens not satisfying the requirement it sends "403 - Forbidden" problem response, carrying the requirement on
+// its `required` member.
+func Require(requirement Requirement) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+
+			claims, ok := ClaimsFromContext(c)
+			if !ok {
+				return WriteProblem(c, missingTokenProblem())
+			}
+
+			if !requirement.SatisfiedBy(claims) {
+				detail := "the token does not grant access to this resource"
+				problem := NewProblem(http.StatusForbidden, CodeInsufficientScope, detail)
+				problem.Required = requirement.String()
+				problem.Challenge = bearerChallenge(bearerInsufficientScope, detail)
+				return WriteProblem(c, problem)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// RequireRoles requires the subject to have been granted every one of roles
+func RequireRoles(roles ...string) echo.MiddlewareFunc {
+	return Require(AllOf(requirementsOf(Role, roles)...))
+}
+
+// RequireAnyRole requires the subject to have been granted at least one of roles
+func RequireAnyRole(roles ...string) echo.MiddlewareFunc {
+	return Require(AnyOf(requirementsOf(Role, roles)...))
+}
+
+// RequireScopes requires the token to have been granted every one of scopes
+func RequireScopes(scopes ...string) echo.MiddlewareFunc {
+	return Require(AllOf(requirementsOf(Scope, scopes)...))
+}
+
+// RequireAnyScope requires the token to have been granted at least one of scopes
+func RequireAnyScope(scopes ...string) echo.MiddlewareFunc {
+	return Require(AnyOf(requirementsOf(Scope, scopes)...))
+}
+
+// AuthorizedGroup creates a route group under prefix on parent, either an *echo.Echo or an *echo.Group, whose routes
+// all require requirement. The given middleware run before the requirement is checked.
+func AuthorizedGroup(parent router, prefix string, requirement Requirement, m ...echo.MiddlewareFunc) *echo.Group {
+	middleware := append([]echo.MiddlewareFunc{}, m...)
+	return parent.Group(prefix, append(middleware, Require(requirement))...)
+}
+
+func requirementsOf(requirement func(string) Requirement, values []string) []Requirement {
+	requirements := make([]Requirement, len(values))
+	for i, value := range values {
+		requirements[i] = requirement(value)
+	}
+	return requirements
+}
@@ -0,0 +1,121 @@
+package security
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestRequirement(t *testing.T) {
+
+	claims := &Claims{Roles: []string{"support"}, Scopes: []string{"orders:read", "orders:write"}}
+
+	var test_cases = []struct {
+		requirement Requirement
+		expression  string
+		satisfied   bool
+	}{
+		{Role("support"), "role:support", true},
+		{Role("admin"), "role:admin", false},
+		{AllOf(Scope("orders:read"), Scope("orders:write")), "scope:orders:read AND scope:orders:write", true},
+		{AllOf(Role("support"), Scope("users:read")), "role:support AND scope:users:read", false},
+		{AnyOf(Role("admin"), Scope("orders:write")), "role:admin OR scope:orders:write", true},
+		{AnyOf(Role("admin"), AllOf(Role("support"), Scope("orders:write"))),
+			"role:admin OR (role:support AND scope:orders:write)", true},
+		{AllOf(Role("support"), AnyOf(Role("admin"), Scope("users:write"))),
+			"role:support AND (role:admin OR scope:users:write)", false},
+	}
+
+	for _, test_case := range test_cases {
+		if expression := test_case.requirement.String(); expression != test_case.expression {
+			t.Errorf("expected expression '%s' and got '%s'", test_case.expression, expression)
+		}
+		if satisfied := test_case.requirement.SatisfiedBy(claims); satisfied != test_case.satisfied {
+			t.Errorf("expected '%s' to be %t and got %t", test_case.expression, test_case.satisfied, satisfied)
+		}
+	}
+}
+
+func TestRequireMiddleware(t *testing.T) {
+
+	handler := func(c echo.Context) error {
+		return c.String(http.StatusOK, "test")
+	}
+
+	var test_cases = []struct {
+		middleware echo.MiddlewareFunc
+		claims     *Claims
+		code       int
+	}{
+		{RequireRoles("admin"), &Claims{Roles: []string{"admin", "support"}}, http.StatusOK},
+		{RequireRoles("admin", "support"), &Claims{Roles: []string{"admin"}}, http.StatusForbidden},
+		{RequireAnyRole("admin", "support"), &Claims{Roles: []string{"support"}}, http.StatusOK},
+		{RequireScopes("orders:read"), &Claims{Scopes: []string{"orders:read"}}, http.StatusOK},
+		{RequireAnyScope("orders:read", "orders:write"), &Claims{}, http.StatusForbidden},
+		{RequireRoles("admin"), nil, http.StatusUnauthorized},
+	}
+
+	e := echo.New()
+	for _, test_case := range test_cases {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		res := httptest.NewRecorder()
+		c := e.NewContext(req, res)
+		if test_case.claims != nil {
+			c.Set(claimsContextKey, test_case.claims)
+		}
+
+		err := test_case.middleware(handler)(c)
+		code := res.Code
+		if he, ok := err.(*echo.HTTPError); ok {
+			code = he.Code
+		}
+		if code != test_case.code {
+			t.Errorf("expected status %d for claims %+v and got %d", test_case.code, test_case.claims, code)
+		}
+	}
+
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	res := httptest.NewRecorder()
+	c := e.NewContext(req, res)
+	c.Set(claimsContextKey, &Claims{Roles: []string{"support"}})
+	RequireRoles("admin")(handler)(c)
+
+	var body Problem
+	json.Unmarshal(res.Body.Bytes(), &body)
+	if body.Code != CodeInsufficientScope || body.Status != http.StatusForbidden || body.Required != "role:admin" {
+		t.Errorf("unexpected forbidden response body %s", res.Body.String())
+	}
+	if challenge := res.Header().Get(echo.HeaderWWWAuthenticate); !strings.HasPrefix(challenge, `Bearer error="insufficient_scope"`) {
+		t.Errorf("unexpected WWW-Authenticate challenge %q", challenge)
+	}
+}
+
+func TestAuthorizedGroup(t *testing.T) {
+
+	e := echo.New()
+	authenticate := func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(claimsContextKey, &Claims{Roles: []string{c.Request().Header.Get("X-Role")}})
+			return next(c)
+		}
+	}
+
+	admin := AuthorizedGroup(e, "/admin", Role("admin"), authenticate)
+	admin.GET("/users", func(c echo.Context) error {
+		return c.String(http.StatusOK, "users")
+	})
+
+	for role, code := range map[string]int{"admin": http.StatusOK, "support": http.StatusForbidden} {
+		req := httptest.NewRequest(echo.GET, "/admin/users", nil)
+		req.Header.Set("X-Role", role)
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		if res.Code != code {
+			t.Errorf("expected status %d for role %s and got %d", code, role, res.Code)
+		}
+	}
+}
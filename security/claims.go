@@ -0,0 +1,307 @@
+package security
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/guidola/go-utils/helper"
+	"github.com/labstack/echo"
+)
+
+// Context keys the middleware stores the token claims under
+const (
+	claimsContextKey       = "security.claims"
+	customClaimsContextKey = "security.custom_claims"
+)
+
+// Claims is the typed view of the claims of an authenticated token.
+type Claims struct {
+	// Registered claims
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ID        string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+
+	// Roles granted to the subject, taken from the `roles` claim.
+	Roles []string
+	// Scopes granted to the token, taken from the space delimited `scope` claim of RFC 8693 or the `scp` array.
+	Scopes []string
+	// Tenant the subject belongs to, taken from the `tenant` claim.
+	Tenant string
+	// SessionID taken from the `sid` claim.
+	SessionID string
+	// APIKeyID is the id of the API key the request was authenticated with by APIKeyAuth. It is never taken from a
+	// token, so it is empty for every request authenticated with one.
+	APIKeyID string
+
+	// Custom holds every other claim of the token.
+	Custom map[string]interface{}
+}
+
+// issuedAtNanosClaim is the private claim holding the nanoseconds of the second in `iat` a token was issued at, set by
+// TokenIssuer so a token issued right after its subject got revoked can be told apart from one issued right before
+const issuedAtNanosClaim = "iat_ns"
+
+// knownClaims are the claims mapped to a field of Claims
+var knownClaims = map[string]struct{}{
+	"sub": {}, "iss": {}, "aud": {}, "jti": {}, "iat": {}, issuedAtNanosClaim: {}, "exp": {}, "nbf": {},
+	"roles": {}, "scope": {}, "scp": {}, "tenant": {}, "sid": {},
+}
+
+// NewClaims builds the typed view of claims
+func NewClaims(claims jwt.MapClaims) (*Claims, error) {
+
+	c := &Claims{Custom: map[string]interface{}{}}
+	c.Subject, _ = claims["sub"].(string)
+	c.Issuer, _ = claims["iss"].(string)
+	c.ID, _ = claims["jti"].(string)
+	c.Tenant, _ = claims["tenant"].(string)
+	c.SessionID, _ = claims["sid"].(string)
+
+	var err error
+	if c.Audience, err = stringsClaim(claims, "aud"); err != nil {
+		return nil, err
+	}
+	if c.Roles, err = stringsClaim(claims, "roles"); err != nil {
+		return nil, err
+	}
+
+	if scope, ok := claims["scope"].(string); ok {
+		c.Scopes = strings.Fields(scope)
+	} else if c.Scopes, err = stringsClaim(claims, "scp"); err != nil {
+		return nil, err
+	}
+
+	if c.IssuedAt, _, err = issuedAt(claims); err != nil {
+		return nil, err
+	}
+	if exp, ok, err := numericClaim(claims, "exp"); err != nil {
+		return nil, err
+	} else if ok {
+		c.ExpiresAt = time.Unix(exp, 0)
+	}
+
+	for name, value := range claims {
+		if _, known := knownClaims[name]; !known {
+			c.Custom[name] = value
+		}
+	}
+
+	return c, nil
+}
+
+// Map returns the non registered claims, ready to be passed to TokenIssuer.Issue
+func (c *Claims) Map() map[string]interface{} {
+
+	claims := map[string]interface{}{}
+	for name, value := range c.Custom {
+		claims[name] = value
+	}
+	if len(c.Roles) > 0 {
+		claims["roles"] = c.Roles
+	}
+	if len(c.Scopes) > 0 {
+		claims["scope"] = strings.Join(c.Scopes, " ")
+	}
+	if c.Tenant != "" {
+		claims["tenant"] = c.Tenant
+	}
+	if c.SessionID != "" {
+		claims["sid"] = c.SessionID
+	}
+	return claims
+}
+
+// HasRole reports whether role was granted to the subject
+func (c *Claims) HasRole(role string) bool {
+	return helper.ContainsString(c.Roles, []string{role})
+}
+
+// HasScope reports whether scope was granted to the token
+func (c *Claims) HasScope(scope string) bool {
+	return helper.ContainsString(c.Scopes, []string{scope})
+}
+
+// ClaimsFromContext returns the claims of the token authenticated by the jwt middleware
+func ClaimsFromContext(c echo.Context) (*Claims, bool) {
+	claims, ok := c.Get(claimsContextKey).(*Claims)
+	return claims, ok
+}
+
+// CustomClaimsFromContext returns the value built by JWTConfig.NewClaims for the token authenticated by the jwt
+// middleware, nil if NewClaims is not set
+func CustomClaimsFromContext(c echo.Context) interface{} {
+	return c.Get(customClaimsContextKey)
+}
+
+// decodeCustomClaims decodes claims into the value returned by newClaims through their JSON representation
+func decodeCustomClaims(claims jwt.MapClaims, newClaims func() interface{}) (interface{}, error) {
+
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	custom := newClaims()
+	if err := json.Unmarshal(raw, custom); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformedClaim, err.Error())
+	}
+	return custom, nil
+}
+
+// Reasons a token is rejected by the registered claims validation
+var (
+	ErrTokenExpired        = errors.New("token is expired")
+	ErrTokenNotYetValid    = errors.New("token is not valid yet")
+	ErrTokenIssuedInFuture = errors.New("token is issued in the future")
+	ErrTokenTooOld         = errors.New("token exceeds the maximum age")
+	ErrInvalidIssuer       = errors.New("token issuer is not accepted")
+	ErrInvalidAudience     = errors.New("token audience is not accepted")
+	ErrMissingClaim        = errors.New("token is missing a required claim")
+	ErrMalformedClaim      = errors.New("token has a malformed claim")
+	ErrMFAPendingToken     = errors.New("token is only good to complete the two-factor login")
+)
+
+// ValidateClaims checks the registered claims of a token against config:
+// - every claim in RequiredClaims is present
+// - `exp` and `nbf`, when present, are honoured allowing for Leeway of clock skew
+// - `iat`, when present, is not in the future and, if MaxAge is set, not older than MaxAge
+// - `iss` is one of Issuers, if set
+// - `aud` contains one of Audiences, if set
+// - `aud` does not contain MFAPendingAudience, unless Audiences does
+// The first failure is returned, wrapping one of the ErrToken*, ErrInvalid*, ErrMissingClaim, ErrMalformedClaim or
+// ErrMFAPendingToken errors so the reason can be told with errors.Is.
+func (config JWTConfig) ValidateClaims(claims jwt.MapClaims) error {
+
+	now := time.Now()
+
+	for _, name := range config.RequiredClaims {
+		if _, ok := claims[name]; !ok {
+			return fmt.Errorf("%w: %s", ErrMissingClaim, name)
+		}
+	}
+
+	if exp, ok, err := numericClaim(claims, "exp"); err != nil {
+		return err
+	} else if ok && now.After(time.Unix(exp, 0).Add(config.Leeway)) {
+		return ErrTokenExpired
+	}
+
+	if nbf, ok, err := numericClaim(claims, "nbf"); err != nil {
+		return err
+	} else if ok && now.Add(config.Leeway).Before(time.Unix(nbf, 0)) {
+		return ErrTokenNotYetValid
+	}
+
+	iat, ok, err := numericClaim(claims, "iat")
+	if err != nil {
+		return err
+	}
+	if ok && now.Add(config.Leeway).Before(time.Unix(iat, 0)) {
+		return ErrTokenIssuedInFuture
+	}
+	if config.MaxAge > 0 {
+		if !ok {
+			return fmt.Errorf("%w: iat", ErrMissingClaim)
+		}
+		if now.Sub(time.Unix(iat, 0)) > config.MaxAge+config.Leeway {
+			return ErrTokenTooOld
+		}
+	}
+
+	if len(config.Issuers) > 0 {
+		iss, _ := claims["iss"].(string)
+		if !helper.ContainsString(config.Issuers, []string{iss}) {
+			return ErrInvalidIssuer
+		}
+	}
+
+	audiences, err := stringsClaim(claims, "aud")
+	if err != nil {
+		return err
+	}
+	if helper.ContainsString(audiences, []string{MFAPendingAudience}) &&
+		!helper.ContainsString(config.Audiences, []string{MFAPendingAudience}) {
+		return ErrMFAPendingToken
+	}
+	if len(config.Audiences) > 0 {
+		accepted := false
+		for _, audience := range audiences {
+			if helper.ContainsString(config.Audiences, []string{audience}) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return ErrInvalidAudience
+		}
+	}
+
+	return nil
+}
+
+// numericClaim returns the value of a NumericDate claim and whether it is present
+func numericClaim(claims jwt.MapClaims, name string) (int64, bool, error) {
+
+	switch value := claims[name].(type) {
+	case nil:
+		return 0, false, nil
+	case float64:
+		return int64(value), true, nil
+	case json.Number:
+		if v, err := value.Int64(); err == nil {
+			return v, true, nil
+		}
+		if v, err := value.Float64(); err == nil {
+			return int64(v), true, nil
+		}
+	}
+
+	return 0, false, fmt.Errorf("%w: %s", ErrMalformedClaim, name)
+}
+
+// issuedAt returns the time claims were issued at, from `iat` and, when present, issuedAtNanosClaim
+func issuedAt(claims jwt.MapClaims) (time.Time, bool, error) {
+
+	iat, ok, err := numericClaim(claims, "iat")
+	if err != nil || !ok {
+		return time.Time{}, false, err
+	}
+
+	nanos, _, err := numericClaim(claims, issuedAtNanosClaim)
+	if err != nil || nanos < 0 || nanos >= int64(time.Second) {
+		return time.Time{}, false, fmt.Errorf("%w: %s", ErrMalformedClaim, issuedAtNanosClaim)
+	}
+	return time.Unix(iat, nanos), true, nil
+}
+
+// stringsClaim returns the value of a claim that can either be a single string or an array of strings
+func stringsClaim(claims jwt.MapClaims, name string) ([]string, error) {
+
+	switch value := claims[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []string:
+		return value, nil
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", ErrMalformedClaim, name)
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrMalformedClaim, name)
+}
@@ -0,0 +1,185 @@
+package security
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestValidateClaims(t *testing.T) {
+
+	now := time.Now().Unix()
+	config := JWTConfig{
+		Issuers:        []string{"api.terno.io", "auth.terno.io"},
+		Audiences:      []string{"api.terno.io"},
+		RequiredClaims: []string{"sub"},
+		MaxAge:         time.Hour,
+		Leeway:         30 * time.Second,
+	}
+
+	valid := func(overrides jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"sub": "patata",
+			"iss": "api.terno.io",
+			"aud": "api.terno.io",
+			"iat": float64(now - 60),
+			"nbf": float64(now - 60),
+			"exp": float64(now + 60),
+		}
+		for name, value := range overrides {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+
+	var test_cases = []struct {
+		name   string
+		claims jwt.MapClaims
+		err    error
+	}{
+		{"valid", valid(nil), nil},
+		{"expired within leeway", valid(jwt.MapClaims{"exp": float64(now - 10)}), nil},
+		{"expired", valid(jwt.MapClaims{"exp": float64(now - 60)}), ErrTokenExpired},
+		{"not before within leeway", valid(jwt.MapClaims{"nbf": float64(now + 10)}), nil},
+		{"not yet valid", valid(jwt.MapClaims{"nbf": float64(now + 60)}), ErrTokenNotYetValid},
+		{"issued in the future", valid(jwt.MapClaims{"iat": float64(now + 60)}), ErrTokenIssuedInFuture},
+		{"too old", valid(jwt.MapClaims{"iat": float64(now - 7200)}), ErrTokenTooOld},
+		{"missing iat with max age", valid(jwt.MapClaims{"iat": nil}), ErrMissingClaim},
+		{"missing required claim", valid(jwt.MapClaims{"sub": nil}), ErrMissingClaim},
+		{"second issuer", valid(jwt.MapClaims{"iss": "auth.terno.io"}), nil},
+		{"untrusted issuer", valid(jwt.MapClaims{"iss": "evil.io"}), ErrInvalidIssuer},
+		{"missing issuer", valid(jwt.MapClaims{"iss": nil}), ErrInvalidIssuer},
+		{"audience array", valid(jwt.MapClaims{"aud": []interface{}{"other", "api.terno.io"}}), nil},
+		{"wrong audience", valid(jwt.MapClaims{"aud": []interface{}{"other"}}), ErrInvalidAudience},
+		{"missing audience", valid(jwt.MapClaims{"aud": nil}), ErrInvalidAudience},
+		{"malformed audience", valid(jwt.MapClaims{"aud": 42.0}), ErrMalformedClaim},
+		{"malformed exp", valid(jwt.MapClaims{"exp": "tomorrow"}), ErrMalformedClaim},
+	}
+
+	for _, test_case := range test_cases {
+		err := config.ValidateClaims(test_case.claims)
+		if (test_case.err == nil && err != nil) || !errors.Is(err, test_case.err) {
+			t.Errorf("%s: expected err to be '%v' and got '%v' instead", test_case.name, test_case.err, err)
+		}
+	}
+}
+
+func TestParseTokenValidatesClaims(t *testing.T) {
+
+	config := JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256, Issuers: []string{DefaultIssuer}}
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+
+	tokenstring, _ := issuer.Issue("patata", nil)
+	if _, err := config.parseToken(tokenstring); err != nil {
+		t.Errorf("expected err to be nil and got %s instead", err)
+	}
+
+	expired := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "patata", "iss": DefaultIssuer, "exp": time.Now().Add(-time.Minute).Unix()})
+	expiredstring, _ := expired.SignedString(testHMACSecret)
+
+	if _, err := config.parseToken(expiredstring); err != ErrTokenExpired {
+		t.Errorf("expected err to be '%s' and got '%v' instead", ErrTokenExpired, err)
+	}
+
+	config.Leeway = 2 * time.Minute
+	if _, err := config.parseToken(expiredstring); err != nil {
+		t.Errorf("expected token expired within the leeway to be accepted and got %v", err)
+	}
+}
+
+func TestNewClaims(t *testing.T) {
+
+	mapClaims := jwt.MapClaims{
+		"sub":    "patata",
+		"iss":    DefaultIssuer,
+		"aud":    []interface{}{"api.terno.io", "admin.terno.io"},
+		"jti":    "token-id",
+		"iat":    float64(1466274093),
+		"roles":  []interface{}{"admin", "user"},
+		"scope":  "read:orders write:orders",
+		"tenant": "terno",
+		"sid":    "session",
+		"locale": "ca-ES",
+	}
+
+	claims, err := NewClaims(mapClaims)
+	if err != nil {
+		t.Fatalf("expected err to be nil and got %s instead", err)
+	}
+
+	if claims.Subject != "patata" || claims.Issuer != DefaultIssuer || claims.ID != "token-id" ||
+		claims.Tenant != "terno" || claims.SessionID != "session" || claims.IssuedAt.Unix() != 1466274093 {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+	if len(claims.Audience) != 2 || !claims.HasRole("admin") || claims.HasRole("root") ||
+		!claims.HasScope("write:orders") || claims.HasScope("read:users") {
+		t.Errorf("unexpected audience, roles or scopes in %+v", claims)
+	}
+	if len(claims.Custom) != 1 || claims.Custom["locale"] != "ca-ES" {
+		t.Errorf("expected custom claims to only hold locale and got %v", claims.Custom)
+	}
+	if !claims.ExpiresAt.IsZero() {
+		t.Errorf("expected missing exp to be the zero time and got %s", claims.ExpiresAt)
+	}
+
+	//scopes can also be given as an array
+	claims, _ = NewClaims(jwt.MapClaims{"scp": []interface{}{"read:orders"}})
+	if !claims.HasScope("read:orders") {
+		t.Errorf("expected scp array to be parsed and got %v", claims.Scopes)
+	}
+
+	if _, err := NewClaims(jwt.MapClaims{"roles": "admin user"}); err != nil {
+		t.Errorf("expected a single role string to be accepted and got %s", err)
+	}
+	if _, err := NewClaims(jwt.MapClaims{"roles": 42.0}); !errors.Is(err, ErrMalformedClaim) {
+		t.Errorf("expected err to be '%s' and got '%v' instead", ErrMalformedClaim, err)
+	}
+
+	//the typed claims can be issued back
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+	tokenstring, _ := issuer.Issue("patata", (&Claims{Roles: []string{"admin"}, Scopes: []string{"a", "b"}}).Map())
+	token, _ := jwt.Parse(tokenstring, func(t *jwt.Token) (interface{}, error) { return testHMACSecret, nil })
+	if claims, _ := NewClaims(token.Claims.(jwt.MapClaims)); !claims.HasRole("admin") || len(claims.Scopes) != 2 {
+		t.Errorf("expected issued claims to round trip and got %+v", claims)
+	}
+}
+
+func TestDecodeCustomClaims(t *testing.T) {
+
+	type customClaims struct {
+		Subject string `json:"sub"`
+		Locale  string `json:"locale"`
+		Plan    struct {
+			Name  string `json:"name"`
+			Seats int    `json:"seats"`
+		} `json:"plan"`
+	}
+
+	mapClaims := jwt.MapClaims{
+		"sub":    "patata",
+		"locale": "ca-ES",
+		"plan":   map[string]interface{}{"name": "pro", "seats": 5.0},
+	}
+
+	custom, err := decodeCustomClaims(mapClaims, func() interface{} { return new(customClaims) })
+	if err != nil {
+		t.Fatalf("expected err to be nil and got %s instead", err)
+	}
+
+	decoded := custom.(*customClaims)
+	if decoded.Subject != "patata" || decoded.Locale != "ca-ES" || decoded.Plan.Name != "pro" || decoded.Plan.Seats != 5 {
+		t.Errorf("unexpected custom claims %+v", decoded)
+	}
+
+	mapClaims["plan"] = "pro"
+	if _, err := decodeCustomClaims(mapClaims, func() interface{} { return new(customClaims) }); err == nil {
+		t.Errorf("expected claims not matching the custom struct to be rejected")
+	}
+}
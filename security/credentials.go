@@ -0,0 +1,482 @@
+package security
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/guidola/go-utils/database"
+	"github.com/labstack/gommon/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DefaultUsersCollection is the collection the default mongo credential store reads accounts from
+const DefaultUsersCollection = "users"
+
+// ErrUnknownAccount is returned by a CredentialStore when no account matches the given identifier
+var ErrUnknownAccount = errors.New("no account matches the given identifier")
+
+type (
+	// LoginRequest is the payload accepted by the login handler. Uuid can either be the email or the username of the
+	// account trying to authenticate.
+	LoginRequest struct {
+		Uuid string `json:"uuid" form:"uuid"`
+		Pwd  string `json:"pwd" form:"pwd"`
+	}
+
+	// Credentials holds the stored authentication data of an account.
+	Credentials struct {
+		// Subject is the account identifier placed on the `sub` claim of the issued tokens.
+		Subject  string `json:"_id" bson:"_id"`
+		Email    string `json:"email" bson:"email"`
+		Username string `json:"username" bson:"username"`
+		// EmailVerified is set once the account proves it owns Email.
+		EmailVerified bool `json:"email_verified" bson:"email_verified"`
+		// Secret as it is stored on the backend.
+		Secret string `json:"-" bson:"pwd"`
+	}
+
+	// CredentialStore abstracts the backend holding the accounts that are allowed to log in.
+	CredentialStore interface {
+		// Lookup returns the credentials of the account whose email matches identifier if it contains '@', or
+		// whose username does otherwise. See identifierField. ErrUnknownAccount is returned if there is no such
+		// account.
+		Lookup(identifier string) (Credentials, error)
+
+		// VerifySecret reports whether secret matches the secret stored for credentials.
+		VerifySecret(credentials Credentials, secret string) (bool, error)
+	}
+
+	// CredentialUpdater is implemented by credential stores able to replace the secret of an account. Stores
+	// implementing it get legacy or weak password hashes upgraded on successful logins.
+	CredentialUpdater interface {
+		// UpdateSecret hashes secret and stores it as the new secret of the account identified by subject.
+		UpdateSecret(subject string, secret string) error
+
+		// NeedsRehash reports whether the stored secret of credentials has to be upgraded.
+		NeedsRehash(credentials Credentials) bool
+	}
+
+	// SubjectLookup is implemented by credential stores able to look accounts up by subject.
+	SubjectLookup interface {
+		// LookupSubject returns the credentials of the account identified by subject. ErrUnknownAccount is
+		// returned if there is no such account.
+		LookupSubject(subject string) (Credentials, error)
+	}
+)
+
+// AuthenticateUser checks the given identifier and secret against store. Returns whether the authentication
+// succeeded and the subject of the authenticated account. An unknown account is not considered an error.
+//
+// If store is a CredentialUpdater and the stored secret uses a legacy or weak hash it is transparently upgraded. A
+// failed upgrade does not make the authentication fail.
+func AuthenticateUser(store CredentialStore, identifier string, secret string) (bool, string, error) {
+
+	credentials, err := store.Lookup(identifier)
+	if err == ErrUnknownAccount {
+		// verify against a dummy hash anyway so unknown accounts do not answer faster than wrong secrets
+		hasher := DefaultPasswordHasher
+		if s, ok := store.(secretHasher); ok {
+			hasher = s.hasher()
+		}
+		hasher.Verify(hasher.dummyHash(), secret)
+		return false, "", nil
+	} else if err != nil {
+		return false, "", err
+	}
+
+	ok, err := store.VerifySecret(credentials, secret)
+	if err != nil || !ok {
+		return false, "", err
+	}
+
+	if updater, ok := store.(CredentialUpdater); ok && updater.NeedsRehash(credentials) {
+		if err := updater.UpdateSecret(credentials.Subject, secret); err != nil {
+			log.Warnf("Failed to upgrade the password hash of %s: %s", credentials.Subject, err.Error())
+		}
+	}
+
+	return true, credentials.Subject, nil
+}
+
+// secretsMatch compares both secrets in constant time
+func secretsMatch(stored string, given string) bool {
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(given)) == 1
+}
+
+// identifierField returns the account field identifier is looked up on. Emails always contain '@' and usernames
+// cannot, so an account cannot be reached through the username of another one matching its email.
+func identifierField(identifier string) string {
+	if strings.Contains(identifier, "@") {
+		return "email"
+	}
+	return "username"
+}
+
+// secretHasher is implemented by the credential stores of this package, returning the hasher their secrets are
+// verified with
+type secretHasher interface {
+	hasher() *PasswordHasher
+}
+
+// hasherOrDefault returns h or the DefaultPasswordHasher if h is nil
+func hasherOrDefault(h *PasswordHasher) *PasswordHasher {
+	if h == nil {
+		return DefaultPasswordHasher
+	}
+	return h
+}
+
+// ****************************
+// MongoDB credential store
+// ****************************
+
+// MongoCredentialStore looks accounts up on a mongo collection through the global database.Mongo instance.
+// Documents are expected to hold the `_id`, `email`, `username` and `pwd` fields, being `pwd` a hash produced by the
+// store hasher or a legacy plain text password, only accepted when the store hasher allows plain text secrets.
+type MongoCredentialStore struct {
+	// Database holding the collection. When empty the database of the dialed session is used.
+	Database string
+	// Collection holding one document per account.
+	Collection string
+	// Hasher used to verify and hash secrets.
+	// Optional. Default value DefaultPasswordHasher.
+	Hasher *PasswordHasher
+}
+
+// NewMongoCredentialStore returns a credential store backed by the given mongo database and collection
+func NewMongoCredentialStore(db string, collection string) *MongoCredentialStore {
+	return &MongoCredentialStore{Database: db, Collection: collection}
+}
+
+func (s *MongoCredentialStore) Lookup(identifier string) (Credentials, error) {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	var credentials Credentials
+	err := mg.DB(s.Database).C(s.Collection).Find(bson.M{identifierField(identifier): identifier}).One(&credentials)
+
+	if err == mgo.ErrNotFound {
+		return Credentials{}, ErrUnknownAccount
+	}
+
+	return credentials, err
+}
+
+func (s *MongoCredentialStore) LookupSubject(subject string) (Credentials, error) {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	var credentials Credentials
+	err := mg.DB(s.Database).C(s.Collection).FindId(subject).One(&credentials)
+
+	if err == mgo.ErrNotFound {
+		return Credentials{}, ErrUnknownAccount
+	}
+
+	return credentials, err
+}
+
+func (s *MongoCredentialStore) hasher() *PasswordHasher {
+	return hasherOrDefault(s.Hasher)
+}
+
+func (s *MongoCredentialStore) VerifySecret(credentials Credentials, secret string) (bool, error) {
+	return hasherOrDefault(s.Hasher).Verify(credentials.Secret, secret)
+}
+
+func (s *MongoCredentialStore) UpdateSecret(subject string, secret string) error {
+
+	encoded, err := hasherOrDefault(s.Hasher).Hash(secret)
+	if err != nil {
+		return err
+	}
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	err = mg.DB(s.Database).C(s.Collection).UpdateId(subject, bson.M{"$set": bson.M{"pwd": encoded}})
+	if err == mgo.ErrNotFound {
+		return ErrUnknownAccount
+	}
+	return err
+}
+
+func (s *MongoCredentialStore) NeedsRehash(credentials Credentials) bool {
+	return hasherOrDefault(s.Hasher).NeedsRehash(credentials.Secret)
+}
+
+// Register inserts a new account document using a new ObjectId hex as subject. Neither the email nor the username can
+// be taken as the email or username of another account. A unique index on both `email` and `username` is
+// recommended, otherwise concurrent registrations of the same account might slip through.
+func (s *MongoCredentialStore) Register(credentials Credentials, secret string) (Credentials, error) {
+
+	encoded, err := hasherOrDefault(s.Hasher).Hash(secret)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	collection := mg.DB(s.Database).C(s.Collection)
+	identifiers := []string{credentials.Email, credentials.Username}
+	taken, err := collection.Find(bson.M{
+		"$or": []interface{}{
+			bson.M{"email": bson.M{"$in": identifiers}},
+			bson.M{"username": bson.M{"$in": identifiers}},
+		}}).Count()
+	if err != nil {
+		return Credentials{}, err
+	}
+	if taken > 0 {
+		return Credentials{}, ErrAccountExists
+	}
+
+	credentials.Subject = bson.NewObjectId().Hex()
+	credentials.Secret = encoded
+
+	err = collection.Insert(credentials)
+	if mgo.IsDup(err) {
+		return Credentials{}, ErrAccountExists
+	} else if err != nil {
+		return Credentials{}, err
+	}
+
+	return credentials, nil
+}
+
+// LookupIdentity finds the account whose `identities` array holds subject at provider
+func (s *MongoCredentialStore) LookupIdentity(provider string, subject string) (Credentials, error) {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	var credentials Credentials
+	err := mg.DB(s.Database).C(s.Collection).Find(bson.M{
+		"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}},
+	}).One(&credentials)
+
+	if err == mgo.ErrNotFound {
+		return Credentials{}, ErrUnknownAccount
+	}
+
+	return credentials, err
+}
+
+// LinkIdentity adds subject at provider to the `identities` array of the account document
+func (s *MongoCredentialStore) LinkIdentity(account string, provider string, subject string) error {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	err := mg.DB(s.Database).C(s.Collection).UpdateId(account, bson.M{
+		"$addToSet": bson.M{"identities": bson.D{{Name: "provider", Value: provider}, {Name: "subject", Value: subject}}},
+	})
+	if err == mgo.ErrNotFound {
+		return ErrUnknownAccount
+	}
+	return err
+}
+
+// MarkEmailVerified sets `email_verified` on the account document as long as its email is still email
+func (s *MongoCredentialStore) MarkEmailVerified(subject string, email string) error {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	err := mg.DB(s.Database).C(s.Collection).Update(bson.M{"_id": subject, "email": email},
+		bson.M{"$set": bson.M{"email_verified": true}})
+	if err == mgo.ErrNotFound {
+		return ErrUnknownAccount
+	}
+	return err
+}
+
+// ****************************
+// In memory credential store
+// ****************************
+
+// MemoryCredentialStore keeps accounts in memory, indexed by both their email and username.
+type MemoryCredentialStore struct {
+	// Hasher used to verify and hash secrets.
+	// Optional. Default value DefaultPasswordHasher.
+	Hasher *PasswordHasher
+
+	mutex      sync.RWMutex
+	accounts   map[string]*Credentials //indexed by both email and username, see accountKey
+	identities map[string]string       //account subjects indexed by provider and external subject
+}
+
+// NewMemoryCredentialStore returns an empty in memory credential store
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{accounts: map[string]*Credentials{}}
+}
+
+// Add stores the given account, replacing any account registered under the same email or username. The secret is
+// stored as given so it has to be already hashed unless the store hasher allows plain text secrets.
+func (s *MemoryCredentialStore) Add(credentials Credentials) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.index(credentials)
+}
+
+// index stores credentials under both its email and username. Callers must hold the write lock.
+func (s *MemoryCredentialStore) index(credentials Credentials) {
+	stored := credentials
+	if stored.Email != "" {
+		s.accounts[accountKey("email", stored.Email)] = &stored
+	}
+	if stored.Username != "" {
+		s.accounts[accountKey("username", stored.Username)] = &stored
+	}
+}
+
+// accountKey returns the key accounts are indexed under by value of field, so the username of an account cannot
+// shadow the email of another one
+func accountKey(field string, value string) string {
+	return field + ":" + value
+}
+
+func (s *MemoryCredentialStore) Lookup(identifier string) (Credentials, error) {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	credentials, ok := s.accounts[accountKey(identifierField(identifier), identifier)]
+	if !ok || identifier == "" {
+		return Credentials{}, ErrUnknownAccount
+	}
+
+	return *credentials, nil
+}
+
+func (s *MemoryCredentialStore) LookupSubject(subject string) (Credentials, error) {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, credentials := range s.accounts {
+		if credentials.Subject == subject {
+			return *credentials, nil
+		}
+	}
+
+	return Credentials{}, ErrUnknownAccount
+}
+
+func (s *MemoryCredentialStore) hasher() *PasswordHasher {
+	return hasherOrDefault(s.Hasher)
+}
+
+func (s *MemoryCredentialStore) VerifySecret(credentials Credentials, secret string) (bool, error) {
+	return hasherOrDefault(s.Hasher).Verify(credentials.Secret, secret)
+}
+
+func (s *MemoryCredentialStore) UpdateSecret(subject string, secret string) error {
+
+	encoded, err := hasherOrDefault(s.Hasher).Hash(secret)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, credentials := range s.accounts {
+		if credentials.Subject == subject {
+			credentials.Secret = encoded //email and username entries share the same pointer
+			return nil
+		}
+	}
+
+	return ErrUnknownAccount
+}
+
+func (s *MemoryCredentialStore) NeedsRehash(credentials Credentials) bool {
+	return hasherOrDefault(s.Hasher).NeedsRehash(credentials.Secret)
+}
+
+// Register stores a new account using a random subject
+func (s *MemoryCredentialStore) Register(credentials Credentials, secret string) (Credentials, error) {
+
+	encoded, err := hasherOrDefault(s.Hasher).Hash(secret)
+	if err != nil {
+		return Credentials{}, err
+	}
+	subject, err := randomString(16)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, identifier := range []string{credentials.Email, credentials.Username} {
+		_, email := s.accounts[accountKey("email", identifier)]
+		_, username := s.accounts[accountKey("username", identifier)]
+		if (email || username) && identifier != "" {
+			return Credentials{}, ErrAccountExists
+		}
+	}
+
+	credentials.Subject = subject
+	credentials.Secret = encoded
+	s.index(credentials)
+
+	return credentials, nil
+}
+
+func (s *MemoryCredentialStore) LookupIdentity(provider string, subject string) (Credentials, error) {
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	account, ok := s.identities[provider+"\x00"+subject]
+	if ok {
+		for _, credentials := range s.accounts {
+			if credentials.Subject == account {
+				return *credentials, nil
+			}
+		}
+	}
+
+	return Credentials{}, ErrUnknownAccount
+}
+
+func (s *MemoryCredentialStore) LinkIdentity(account string, provider string, subject string) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, credentials := range s.accounts {
+		if credentials.Subject == account {
+			if s.identities == nil {
+				s.identities = map[string]string{}
+			}
+			s.identities[provider+"\x00"+subject] = account
+			return nil
+		}
+	}
+
+	return ErrUnknownAccount
+}
+
+func (s *MemoryCredentialStore) MarkEmailVerified(subject string, email string) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	credentials, ok := s.accounts[accountKey("email", email)]
+	if !ok || email == "" || credentials.Subject != subject {
+		return ErrUnknownAccount
+	}
+	credentials.EmailVerified = true //email and username entries share the same pointer
+	return nil
+}
@@ -0,0 +1,101 @@
+package security
+
+import (
+	"testing"
+)
+
+func TestAuthenticateUser(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher, AllowPlaintext: true}
+	store.Add(Credentials{Subject: "patata-id", Email: "patata@terno.io", Username: "patata", Secret: "pwned"})
+
+	var test_cases = []struct {
+		identifier, secret string
+		allowed            bool
+		subject            string
+	}{
+		{"patata", "pwned", true, "patata-id"},
+		{"patata@terno.io", "pwned", true, "patata-id"},
+		{"patata", "pwned!", false, ""},
+		{"patata", "", false, ""},
+		{"tomate", "pwned", false, ""},
+		{"", "", false, ""},
+	}
+
+	for _, test_case := range test_cases {
+		allowed, subject, err := AuthenticateUser(store, test_case.identifier, test_case.secret)
+		if err != nil {
+			t.Errorf("expected err to be nil for %s and got %s instead", test_case.identifier, err)
+		}
+		if allowed != test_case.allowed || subject != test_case.subject {
+			t.Errorf("expected authentication of %s:%s to be (%t, '%s') and got (%t, '%s')", test_case.identifier,
+				test_case.secret, test_case.allowed, test_case.subject, allowed, subject)
+		}
+	}
+}
+
+func TestMemoryCredentialStoreLookup(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher, AllowPlaintext: true}
+	store.Add(Credentials{Subject: "patata-id", Username: "patata", Secret: "pwned"})
+
+	if _, err := store.Lookup("patata"); err != nil {
+		t.Errorf("expected err to be nil and got %s instead", err)
+	}
+	if _, err := store.Lookup("tomate"); err != ErrUnknownAccount {
+		t.Errorf("expected err to be '%s' and got '%v' instead", ErrUnknownAccount, err)
+	}
+
+	//emails are only looked up by email, even if another account has them as username
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher}
+	store.Add(Credentials{Subject: "tomate-id", Email: "tomate@terno.io", Username: "tomate"})
+	store.Add(Credentials{Subject: "impostor-id", Username: "tomate@terno.io"})
+	if credentials, err := store.Lookup("tomate@terno.io"); err != nil || credentials.Subject != "tomate-id" {
+		t.Errorf("expected the account with the email to be found and got %+v (%v)", credentials, err)
+	}
+	if _, err := store.Register(Credentials{Email: "tomate@terno.io"}, "pwned123"); err != ErrAccountExists {
+		t.Errorf("expected an email taken as username to get '%s' and got '%v'", ErrAccountExists, err)
+	}
+	if _, err := store.Register(Credentials{Email: "pollo@terno.io", Username: "tomate@terno.io"}, "pwned123"); err != ErrAccountExists {
+		t.Errorf("expected a username taken as email to get '%s' and got '%v'", ErrAccountExists, err)
+	}
+}
+
+// countingAlgorithm counts the passwords verified by the wrapped algorithm
+type countingAlgorithm struct {
+	PasswordAlgorithm
+	verified *int
+}
+
+func (a countingAlgorithm) Verify(encoded string, password string) (bool, error) {
+	*a.verified++
+	return a.PasswordAlgorithm.Verify(encoded, password)
+}
+
+func TestAuthenticateUnknownAccount(t *testing.T) {
+
+	var verified int
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: countingAlgorithm{testArgon2idHasher, &verified}}
+	store.Register(Credentials{Email: "patata@terno.io", Username: "patata"}, "pwned123")
+
+	var test_cases = []struct {
+		identifier string
+		verified   int
+	}{
+		{"patata", 1},
+		{"tomate", 2},
+		{"tomate@terno.io", 3},
+	}
+
+	//unknown accounts get a secret verified as well, so they cannot be told apart by the response time
+	for _, test_case := range test_cases {
+		AuthenticateUser(store, test_case.identifier, "wrong")
+		if verified != test_case.verified {
+			t.Errorf("expected %d verifications after authenticating %s and got %d", test_case.verified,
+				test_case.identifier, verified)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package security
+
+import (
+	"crypto"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+type (
+	// TokenIssuerConfig defines the config for a TokenIssuer.
+	TokenIssuerConfig struct {
+		// Key used to sign the issued tokens. Its type has to match the signing method, being the private half of the
+		// key types accepted by JWTConfig.SigningKey, or the same []byte secret for HMAC methods.
+		// Required unless KeySet is set.
+		SigningKey interface{}
+
+		// KeySet whose active key signs the issued tokens, setting its id on the `kid` header. When set SigningKey
+		// and SigningMethod are ignored.
+		// Optional.
+		KeySet *KeySet
+
+		// Signing method used to sign the issued tokens.
+		// Optional. Default value AlgorithmRS512.
+		SigningMethod string
+
+		// Value of the `iss` claim.
+		// Optional. Default value DefaultIssuer.
+		Issuer string
+
+		// Values of the `aud` claim. A single audience is encoded as a string, several ones as an array.
+		// Optional. Default value empty, no `aud` claim is set.
+		Audience []string
+
+		// Lifetime of the issued tokens.
+		// Optional. Default value ExpirationTime seconds.
+		TTL time.Duration
+
+		// Claims returns extra claims to set on every token issued for subject. Registered claims set by the issuer
+		// (jti, sub, iss, aud, iat, iat_ns, exp) cannot be overridden.
+		// Optional.
+		Claims func(subject string) map[string]interface{}
+	}
+
+	// TokenIssuer signs access tokens with a key parsed once at construction time.
+	TokenIssuer struct {
+		config TokenIssuerConfig
+		method jwt.SigningMethod
+	}
+)
+
+// NewTokenIssuer returns a TokenIssuer built from config
+func NewTokenIssuer(config TokenIssuerConfig) (*TokenIssuer, error) {
+	// Defaults
+	if config.SigningKey == nil && config.KeySet == nil {
+		return nil, errors.New("token issuer requires a signing key")
+	}
+	if config.SigningMethod == "" {
+		config.SigningMethod = AlgorithmRS512
+	}
+	if config.Issuer == "" {
+		config.Issuer = DefaultIssuer
+	}
+	if config.TTL == 0 {
+		config.TTL = ExpirationTime * time.Second
+	}
+
+	if config.KeySet != nil {
+		return &TokenIssuer{config: config}, nil
+	}
+	if err := checkKeyType(config.SigningMethod, config.SigningKey, true); err != nil {
+		return nil, err
+	}
+
+	return &TokenIssuer{config: config, method: jwt.GetSigningMethod(config.SigningMethod)}, nil
+}
+
+// KeySet returns the key set the issuer signs with, nil if it signs with a single key
+func (i *TokenIssuer) KeySet() *KeySet {
+	return i.config.KeySet
+}
+
+// TTL returns the lifetime of the tokens signed by the issuer
+func (i *TokenIssuer) TTL() time.Duration {
+	return i.config.TTL
+}
+
+// Issue returns a signed token for subject carrying the given claims, on top of the ones returned by the Claims
+// callback of the issuer config. Registered claims set by the issuer take precedence over both.
+func (i *TokenIssuer) Issue(subject string, claims map[string]interface{}) (string, error) {
+	return i.issue(subject, claims, i.config.Audience, i.config.TTL)
+}
+
+// issue signs a token for subject carrying claims that is addressed to audience and valid for ttl. Unlike the one of
+// the issuer config, audience can address tokens to somewhere else on purpose, e.g. to the second login step.
+func (i *TokenIssuer) issue(subject string, claims map[string]interface{}, audience []string, ttl time.Duration) (string, error) {
+
+	tokenClaims := jwt.MapClaims{}
+	if i.config.Claims != nil {
+		for name, value := range i.config.Claims(subject) {
+			tokenClaims[name] = value
+		}
+	}
+	for name, value := range claims {
+		tokenClaims[name] = value
+	}
+
+	id, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	tokenClaims["jti"] = id
+	tokenClaims["sub"] = subject
+	tokenClaims["iss"] = i.config.Issuer
+	tokenClaims["iat"] = now.Unix()
+	tokenClaims[issuedAtNanosClaim] = now.Nanosecond()
+	tokenClaims["exp"] = now.Add(ttl).Unix()
+
+	delete(tokenClaims, "aud")
+	if len(audience) == 1 {
+		tokenClaims["aud"] = audience[0]
+	} else if len(audience) > 1 {
+		tokenClaims["aud"] = audience
+	}
+
+	if i.config.KeySet == nil {
+		return jwt.NewWithClaims(i.method, tokenClaims).SignedString(i.config.SigningKey)
+	}
+
+	kid, alg, key, err := i.config.KeySet.Active()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(alg), tokenClaims)
+	token.Header["kid"] = kid
+	return token.SignedString(key)
+}
+
+// verifier returns a JWTConfig validating the tokens signed by the issuer
+func (i *TokenIssuer) verifier() JWTConfig {
+
+	if i.config.KeySet != nil {
+		return JWTConfig{KeyResolver: i.config.KeySet}
+	}
+
+	key := i.config.SigningKey
+	if signer, ok := key.(crypto.Signer); ok {
+		key = signer.Public()
+	}
+	return JWTConfig{SigningKey: key, SigningMethod: i.config.SigningMethod}
+}
+
+var (
+	defaultIssuer      *TokenIssuer
+	defaultIssuerMutex sync.Mutex
+)
+
+// DefaultTokenIssuer returns the issuer used when none is configured. It signs with RS512 using the
+// `private_key.pem` file found at the location given by the JWT_CERTS_LOCATION environment variable. The key is
+// read until it loads successfully, and never again afterwards.
+func DefaultTokenIssuer() (*TokenIssuer, error) {
+
+	defaultIssuerMutex.Lock()
+	defer defaultIssuerMutex.Unlock()
+
+	if defaultIssuer != nil {
+		return defaultIssuer, nil
+	}
+
+	key, err := LoadRSAPrivateKey(os.Getenv(JwtCertsLocation) + "private_key.pem")
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := NewTokenIssuer(TokenIssuerConfig{SigningKey: key})
+	if err != nil {
+		return nil, err
+	}
+	defaultIssuer = issuer
+	return defaultIssuer, nil
+}
+
+// issuerOrDefault returns i or the DefaultTokenIssuer if i is nil
+func issuerOrDefault(i *TokenIssuer) (*TokenIssuer, error) {
+	if i == nil {
+		return DefaultTokenIssuer()
+	}
+	return i, nil
+}
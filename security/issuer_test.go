@@ -0,0 +1,104 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var testRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+
+func TestTokenIssuerIssue(t *testing.T) {
+
+	issuer, err := NewTokenIssuer(TokenIssuerConfig{
+		SigningKey: testRSAKey,
+		Audience:   []string{"api.terno.io"},
+		TTL:        time.Minute,
+		Claims: func(subject string) map[string]interface{} {
+			return map[string]interface{}{"tenant": "terno", "iss": "overridden", "aud": "overridden"}
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected err to be nil and got %s instead", err)
+	}
+
+	tokenstring, err := issuer.Issue("patata", map[string]interface{}{"sid": "session", "sub": "overridden", "aud": "overridden"})
+	if err != nil {
+		t.Fatalf("expected err to be nil and got %s instead", err)
+	}
+
+	token, err := jwt.Parse(tokenstring, func(t *jwt.Token) (interface{}, error) {
+		return &testRSAKey.PublicKey, nil
+	})
+	if err != nil || !token.Valid {
+		t.Fatalf("expected issued token to be valid and got %v", err)
+	}
+
+	if token.Method.Alg() != AlgorithmRS512 {
+		t.Errorf("expected token to be signed with %s and got %s", AlgorithmRS512, token.Method.Alg())
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	var expected_claims = map[string]interface{}{
+		"sub":    "patata",
+		"iss":    DefaultIssuer,
+		"aud":    "api.terno.io",
+		"tenant": "terno",
+		"sid":    "session",
+	}
+	for name, value := range expected_claims {
+		if claims[name] != value {
+			t.Errorf("expected claim %s to be '%v' and got '%v'", name, value, claims[name])
+		}
+	}
+
+	if exp := int64(claims["exp"].(float64)) - int64(claims["iat"].(float64)); exp != 60 {
+		t.Errorf("expected token lifetime to be 60 seconds and got %d", exp)
+	}
+
+	//every token gets its own id so it can be revoked on its own
+	other, _ := issuer.Issue("patata", nil)
+	otherToken, _ := jwt.Parse(other, func(t *jwt.Token) (interface{}, error) { return &testRSAKey.PublicKey, nil })
+	if jti, _ := claims["jti"].(string); jti == "" || jti == otherToken.Claims.(jwt.MapClaims)["jti"] {
+		t.Errorf("expected tokens to carry unique ids and got '%v'", claims["jti"])
+	}
+}
+
+func TestNewTokenIssuerErrors(t *testing.T) {
+
+	if _, err := NewTokenIssuer(TokenIssuerConfig{}); err == nil {
+		t.Errorf("expected an error when no signing key is given")
+	}
+	if _, err := NewTokenIssuer(TokenIssuerConfig{SigningKey: testRSAKey, SigningMethod: "XX999"}); err == nil {
+		t.Errorf("expected an error for an unknown signing method")
+	}
+}
+
+func TestDefaultTokenIssuerRetries(t *testing.T) {
+
+	location := t.TempDir() + string(filepath.Separator)
+	t.Setenv(JwtCertsLocation, location)
+	defer func() { defaultIssuer = nil }()
+
+	//a key that is not there yet is not cached as missing
+	if _, err := DefaultTokenIssuer(); err == nil {
+		t.Fatalf("expected an error while the key does not exist")
+	}
+
+	key := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testRSAKey)})
+	os.WriteFile(location+"private_key.pem", key, 0600)
+	issuer, err := DefaultTokenIssuer()
+	if err != nil {
+		t.Fatalf("expected the key to be loaded once it exists and got %s", err)
+	}
+	if again, _ := DefaultTokenIssuer(); again != issuer {
+		t.Errorf("expected the loaded issuer to be reused")
+	}
+}
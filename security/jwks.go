@@ -0,0 +1,142 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// JWKSPath is the well known location a key set is published at, see RFC 8414 section 3
+const JWKSPath = "/.well-known/jwks.json"
+
+type (
+	// JSONWebKey is the RFC 7517 representation of a public key. Only the members needed for RSA, EC and OKP
+	// (Ed25519) keys are supported.
+	JSONWebKey struct {
+		KeyType   string `json:"kty"`
+		KeyID     string `json:"kid,omitempty"`
+		Use       string `json:"use,omitempty"`
+		Algorithm string `json:"alg,omitempty"`
+
+		// RSA members
+		N string `json:"n,omitempty"`
+		E string `json:"e,omitempty"`
+
+		// EC and OKP members
+		Curve string `json:"crv,omitempty"`
+		X     string `json:"x,omitempty"`
+		Y     string `json:"y,omitempty"`
+	}
+
+	// JSONWebKeySet is the RFC 7517 representation of a set of keys.
+	JSONWebKeySet struct {
+		Keys []JSONWebKey `json:"keys"`
+	}
+)
+
+// NewJSONWebKey returns the JWK representation of the given public key, to be used with alg
+func NewJSONWebKey(id string, alg string, publicKey interface{}) (JSONWebKey, error) {
+
+	jwk := JSONWebKey{KeyID: id, Algorithm: alg, Use: "sig"}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = key.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(padCoordinate(key.X.Bytes(), size))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(padCoordinate(key.Y.Bytes(), size))
+
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(key)
+
+	default:
+		return jwk, fmt.Errorf("keys of type %T cannot be published as JWK", publicKey)
+	}
+
+	return jwk, nil
+}
+
+// padCoordinate left pads an EC coordinate with zeros up to the curve size as required by RFC 7518 section 6.2.1.2
+func padCoordinate(coordinate []byte, size int) []byte {
+	if len(coordinate) >= size {
+		return coordinate
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(coordinate):], coordinate)
+	return padded
+}
+
+// PublicKey decodes the public key represented by the JWK
+func (k JSONWebKey) PublicKey() (interface{}, error) {
+
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported EC curve %s", k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported OKP curve %s", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.KeyType)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid JWK integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
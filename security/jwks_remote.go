@@ -0,0 +1,243 @@
+package security
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/gommon/log"
+)
+
+// Remote key set defaults
+const (
+	DefaultJWKSCacheTTL           = time.Hour
+	DefaultJWKSMinRefreshInterval = time.Minute
+)
+
+type (
+	// RemoteKeySet is a KeyResolver verifying tokens with the keys published on a remote JWKS, e.g. the one of an
+	// OIDC provider. Keys are cached for TTL and revalidated with the ETag returned by the server. A token carrying an
+	// unknown `kid` triggers a refresh so keys rotated by the provider are picked up without waiting for the cache to
+	// expire. The JWKS is fetched at most once per MinRefreshInterval, and stale keys are served while it cannot be.
+	RemoteKeySet struct {
+		// URL of the JWKS.
+		// Required.
+		URL string
+
+		// How long fetched keys are trusted before revalidating them.
+		// Optional. Default value DefaultJWKSCacheTTL.
+		TTL time.Duration
+
+		// Minimum time between two attempts to fetch the JWKS, successful or not.
+		// Optional. Default value DefaultJWKSMinRefreshInterval.
+		MinRefreshInterval time.Duration
+
+		// Client used to fetch the JWKS.
+		// Optional. Default value a client with a 10 seconds timeout.
+		Client *http.Client
+
+		mutex       sync.Mutex
+		keys        map[string]remoteKey
+		etag        string
+		validatedAt time.Time
+		attemptedAt time.Time
+		lastErr     error
+		// fetching is closed once the fetch in flight, if any, completes
+		fetching chan struct{}
+	}
+
+	remoteKey struct {
+		algorithm string
+		publicKey interface{}
+	}
+)
+
+// ErrKeySetUnavailable is returned when the keys of a RemoteKeySet cannot be fetched
+var ErrKeySetUnavailable = errors.New("jwks is unavailable")
+
+var defaultJWKSClient = &http.Client{Timeout: 10 * time.Second}
+
+// NewRemoteKeySet returns a RemoteKeySet fetching keys from url with the default cache settings. Keys are fetched
+// lazily, on the first token to be verified.
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{URL: url}
+}
+
+// ResolveKey returns the key matching the `kid` header of token, fetching the JWKS if needed
+func (rks *RemoteKeySet) ResolveKey(token *jwt.Token) (interface{}, error) {
+
+	id, _ := token.Header["kid"].(string)
+	if id == "" {
+		return nil, ErrMissingKeyID
+	}
+
+	keys, err := rks.currentKeys(false)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys[id]
+	if !ok {
+		if keys, err = rks.currentKeys(true); err != nil {
+			return nil, err
+		}
+		key, ok = keys[id]
+	}
+	if !ok {
+		return nil, ErrUnknownKeyID
+	}
+
+	// Check the signing method, either the one declared by the key or any matching its type
+	alg := token.Method.Alg()
+	if key.algorithm != "" && key.algorithm != alg {
+		return nil, fmt.Errorf("unexpected jwt signing method=%v", token.Header["alg"])
+	}
+	if err := checkKeyType(alg, key.publicKey, false); err != nil {
+		return nil, err
+	}
+
+	return key.publicKey, nil
+}
+
+// Refresh fetches the JWKS right away, or waits for the fetch already in flight
+func (rks *RemoteKeySet) Refresh() error {
+
+	rks.mutex.Lock()
+	defer rks.mutex.Unlock()
+
+	if rks.fetching != nil {
+		rks.wait()
+	} else {
+		rks.refresh()
+	}
+	return rks.lastErr
+}
+
+// currentKeys returns the cached keys, refreshing them first if they are stale, or if missing is set because they
+// lack a key id. Refreshes are attempted at most once per MinRefreshInterval, whether they succeed or not, so a
+// provider that is down is not hammered by every request. Callers holding stale keys keep using them while a
+// refresh is in flight, the others wait for it.
+func (rks *RemoteKeySet) currentKeys(missing bool) (map[string]remoteKey, error) {
+
+	rks.mutex.Lock()
+	defer rks.mutex.Unlock()
+
+	needed := missing || rks.keys == nil || time.Since(rks.validatedAt) > rks.ttl()
+	if rks.fetching != nil && (missing || rks.keys == nil) {
+		rks.wait()
+	} else if rks.fetching == nil && needed && time.Since(rks.attemptedAt) > rks.minRefreshInterval() {
+		rks.refresh()
+	}
+
+	if rks.keys == nil || missing {
+		return rks.keys, rks.lastErr
+	}
+	return rks.keys, nil
+}
+
+// wait blocks until the fetch in flight completes, callers must hold the mutex
+func (rks *RemoteKeySet) wait() {
+	fetching := rks.fetching
+	rks.mutex.Unlock()
+	<-fetching
+	rks.mutex.Lock()
+}
+
+// refresh fetches the JWKS and caches the outcome, callers must hold the mutex. It is released while the request is
+// in flight so callers are not serialised behind a slow provider.
+func (rks *RemoteKeySet) refresh() {
+
+	fetching := make(chan struct{})
+	rks.fetching = fetching
+	rks.attemptedAt = time.Now()
+	attemptedAt, etag := rks.attemptedAt, rks.etag
+	if rks.keys == nil {
+		etag = ""
+	}
+
+	rks.mutex.Unlock()
+	keys, etag, err := rks.fetch(etag)
+	rks.mutex.Lock()
+
+	switch {
+	case err != nil && rks.keys != nil:
+		//keep serving the stale keys rather than rejecting every token while the provider is down
+		log.Warnf("Failed to revalidate JWKS at %s: %s", rks.URL, err.Error())
+	case err != nil:
+	case keys == nil:
+		rks.validatedAt = attemptedAt
+	default:
+		rks.keys, rks.etag, rks.validatedAt = keys, etag, attemptedAt
+	}
+	rks.lastErr = err
+	rks.fetching = nil
+	close(fetching)
+}
+
+// fetch requests the JWKS, conditionally on etag if not empty. It returns no keys if they have not been modified.
+func (rks *RemoteKeySet) fetch(etag string) (map[string]remoteKey, string, error) {
+
+	req, err := http.NewRequest(http.MethodGet, rks.URL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	client := rks.Client
+	if client == nil {
+		client = defaultJWKSClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %s", ErrKeySetUnavailable, err.Error())
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		return nil, etag, nil
+	case http.StatusOK:
+	default:
+		return nil, "", fmt.Errorf("%w: unexpected status %d fetching JWKS at %s", ErrKeySetUnavailable, res.StatusCode, rks.URL)
+	}
+
+	var set JSONWebKeySet
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return nil, "", fmt.Errorf("%w: malformed JWKS at %s: %s", ErrKeySetUnavailable, rks.URL, err.Error())
+	}
+
+	keys := map[string]remoteKey{}
+	for _, jwk := range set.Keys {
+		if jwk.KeyID == "" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		publicKey, err := jwk.PublicKey()
+		if err != nil {
+			log.Warnf("Skipping key %s of JWKS at %s: %s", jwk.KeyID, rks.URL, err.Error())
+			continue
+		}
+		keys[jwk.KeyID] = remoteKey{algorithm: jwk.Algorithm, publicKey: publicKey}
+	}
+	return keys, res.Header.Get("ETag"), nil
+}
+
+func (rks *RemoteKeySet) ttl() time.Duration {
+	if rks.TTL == 0 {
+		return DefaultJWKSCacheTTL
+	}
+	return rks.TTL
+}
+
+func (rks *RemoteKeySet) minRefreshInterval() time.Duration {
+	if rks.MinRefreshInterval == 0 {
+		return DefaultJWKSMinRefreshInterval
+	}
+	return rks.MinRefreshInterval
+}
@@ -0,0 +1,160 @@
+package security
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// newTestJWKSServer serves the JWKS of keys using the number of keys as ETag
+func newTestJWKSServer(keys *KeySet, hits *int32, notModified *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		set := keys.JWKS()
+		etag := fmt.Sprintf(`"%d"`, len(set.Keys))
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		json.NewEncoder(w).Encode(set)
+	}))
+}
+
+func TestRemoteKeySet(t *testing.T) {
+
+	keys := NewKeySet()
+	keys.Add("first", AlgorithmES256, testECP256Key)
+	keys.Activate("first")
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{KeySet: keys})
+
+	var hits, notModified int32
+	server := newTestJWKSServer(keys, &hits, &notModified)
+	defer server.Close()
+
+	remote := NewRemoteKeySet(server.URL)
+	remote.MinRefreshInterval = time.Nanosecond
+	config := JWTConfig{KeyResolver: remote}
+
+	first, _ := issuer.Issue("patata", nil)
+	for i := 0; i < 3; i++ {
+		if token, err := jwt.Parse(first, config.keyFunc); err != nil || !token.Valid {
+			t.Fatalf("expected token to be valid and got %v", err)
+		}
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("expected the JWKS to be fetched once and got %d fetches", hits)
+	}
+
+	//a key rotated by the provider is fetched as soon as a token signed with it shows up
+	keys.Add("second", AlgorithmRS256, testRSAKey)
+	keys.Activate("second")
+	second, _ := issuer.Issue("patata", nil)
+	if token, err := jwt.Parse(second, config.keyFunc); err != nil || !token.Valid {
+		t.Errorf("expected token signed by the rotated key to be valid and got %v", err)
+	}
+	if atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("expected the JWKS to be refetched on unknown kid and got %d fetches", hits)
+	}
+
+	//once the cache expires keys are revalidated using the ETag
+	remote.TTL = time.Nanosecond
+	if _, err := jwt.Parse(second, config.keyFunc); err != nil {
+		t.Errorf("expected token to be valid and got %v", err)
+	}
+	if atomic.LoadInt32(&notModified) != 1 {
+		t.Errorf("expected the JWKS to be revalidated with its ETag and got %d not modified responses", notModified)
+	}
+
+	//the algorithm declared by the key is enforced
+	forged := jwt.NewWithClaims(jwt.SigningMethodPS256, jwt.MapClaims{"sub": "patata"})
+	forged.Header["kid"] = "second"
+	forgedstring, _ := forged.SignedString(testRSAKey)
+	if _, err := jwt.Parse(forgedstring, config.keyFunc); err == nil {
+		t.Errorf("expected a token not matching the algorithm of its key to be rejected")
+	}
+
+	unknown := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"sub": "patata"})
+	unknown.Header["kid"] = "unknown"
+	unknownstring, _ := unknown.SignedString(testECP256Key)
+	if _, err := jwt.Parse(unknownstring, config.keyFunc); err == nil {
+		t.Errorf("expected a token with an unknown kid to be rejected")
+	}
+}
+
+func TestRemoteKeySetUnreachable(t *testing.T) {
+
+	keys := NewKeySet()
+	keys.Add("first", AlgorithmES256, testECP256Key)
+	keys.Activate("first")
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{KeySet: keys})
+	tokenstring, _ := issuer.Issue("patata", nil)
+
+	var hits int32
+	var down atomic.Value
+	down.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		//slow enough for concurrent requests to overlap
+		time.Sleep(20 * time.Millisecond)
+		if down.Load().(bool) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(keys.JWKS())
+	}))
+	defer server.Close()
+
+	remote := NewRemoteKeySet(server.URL)
+	config := JWTConfig{KeyResolver: remote}
+
+	//concurrent requests share a single fetch, and failed fetches are not retried before MinRefreshInterval
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := jwt.Parse(tokenstring, config.keyFunc)
+			if validation, ok := err.(*jwt.ValidationError); !ok || !errors.Is(validation.Inner, ErrKeySetUnavailable) {
+				t.Errorf("expected token to be rejected with ErrKeySetUnavailable and got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := jwt.Parse(tokenstring, config.keyFunc); err == nil {
+		t.Errorf("expected token to be rejected when the JWKS cannot be fetched")
+	}
+	if atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("expected the unreachable JWKS to be fetched once and got %d fetches", hits)
+	}
+
+	down.Store(false)
+	if err := remote.Refresh(); err != nil {
+		t.Fatalf("expected err to be nil and got %s instead", err)
+	}
+
+	//stale keys are served while the JWKS cannot be revalidated, which is attempted once per MinRefreshInterval
+	down.Store(true)
+	remote.TTL = time.Nanosecond
+	remote.MinRefreshInterval = time.Nanosecond
+	for i := 0; i < 3; i++ {
+		if i == 1 {
+			remote.MinRefreshInterval = time.Hour
+		}
+		if token, err := jwt.Parse(tokenstring, config.keyFunc); err != nil || !token.Valid {
+			t.Errorf("expected token to be valid with the stale keys and got %v", err)
+		}
+	}
+	if atomic.LoadInt32(&hits) != 3 {
+		t.Errorf("expected a single failed revalidation and got %d fetches", hits-2)
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
 	"crypto/rsa"
 )
 
@@ -15,26 +18,93 @@ import (
 type (
 	// JWTConfig defines the config for JWT auth middleware.
 	JWTConfig struct {
-		// Signing key to validate token.
-		// Required.
-		//in this case it is a rsa private key therefore  not being
-		SigningKey *rsa.PublicKey `json:"signing_key"`
+		// Signing key to validate token. Its type has to match the signing method:
+		// - *rsa.PublicKey for RS256, RS384, RS512, PS256, PS384 and PS512
+		// - *ecdsa.PublicKey on the P-256, P-384 or P-521 curve for ES256, ES384 and ES512 respectively
+		// - ed25519.PublicKey for EdDSA
+		// - []byte holding the shared secret for HS256, HS384 and HS512
+		// Required unless KeyResolver is set.
+		SigningKey interface{} `json:"signing_key"`
 
-		// Signing method, used to check token signing method.
-		// Optional. Default value HS256.
+		// KeyResolver resolves the key each token is verified with, e.g. a KeySet matching the `kid` header. When set
+		// SigningKey and SigningMethod are ignored, since the signing method is pinned by the resolved key.
+		// Optional.
+		KeyResolver KeyResolver `json:"-"`
+
+		// Signing method, used to check token signing method. Tokens signed with any other method are rejected.
+		// Optional. Default value RS512.
 		SigningMethod string `json:"signing_method"`
 
 		// Context key to store user information from the token into context.
 		// Optional. Default value "user".
 		ContextKey string `json:"context_key"`
 
-		// TokenLookup is a string in the form of "<source>:<name>" that is used
-		// to extract token from the request.
-		// Optional. Default value "header:Authorization".
+		// TokenLookup is a comma separated list of "<source>:<name>[:<prefix>]" lookups used to extract the token
+		// from the request, tried in order until one of them finds it.
+		// Optional. Default value "header:Authorization,header:Authorization:jwt$", which accepts both the standard
+		// `Bearer` scheme and the legacy `jwt$` prefix.
 		// Possible values:
-		// - "header:<name>"
-		// - "query:<name>"
+		// - "header:<name>", the prefix defaults to AuthScheme
+		// - "query:<name>", beware tokens in URLs end up in access logs and browser history
+		// - "cookie:<name>"
+		// - "form:<name>"
 		TokenLookup string `json:"token_lookup"`
+
+		// AuthScheme prefixing the token on header lookups not declaring their own prefix. Schemes ending in a letter
+		// or digit are matched case insensitively and must be followed by a space, as in RFC 6750.
+		// Optional. Default value "Bearer".
+		AuthScheme string `json:"auth_scheme"`
+
+		// Issuers accepted on the `iss` claim.
+		// Optional. Default value empty, any issuer is accepted.
+		Issuers []string `json:"issuers"`
+
+		// Audiences accepted on the `aud` claim, tokens must be addressed to at least one of them.
+		// Optional. Default value empty, any audience is accepted.
+		Audiences []string `json:"audiences"`
+
+		// Claims that must be present on every token, e.g. "exp" or "sub".
+		// Optional.
+		RequiredClaims []string `json:"required_claims"`
+
+		// Maximum time elapsed since the `iat` claim, which becomes required when set.
+		// Optional. Default value 0, no maximum age.
+		MaxAge time.Duration `json:"max_age"`
+
+		// Leeway allowed when checking the time based claims, to account for clock skew between the token issuer and
+		// this server.
+		// Optional. Default value 0.
+		Leeway time.Duration `json:"leeway"`
+
+		// NewClaims returns a pointer to a user defined struct the token claims get decoded into, available to the
+		// handlers through CustomClaimsFromContext. The typed Claims are available through ClaimsFromContext in
+		// any case.
+		// Optional.
+		NewClaims func() interface{} `json:"-"`
+
+		// Store the revoked tokens are checked against.
+		// Optional. Default value DefaultRevocationStore.
+		Revocations RevocationStore `json:"-"`
+
+		// Audit receives an EventTokenRejected event for every token rejected by the middleware.
+		// Optional. Default value nil, no events are emitted.
+		Audit AuditSink `json:"-"`
+
+		// RevocationPolicy tells how to treat tokens whose revocation status cannot be checked.
+		// Optional. Default value RevocationFailClosed.
+		RevocationPolicy RevocationPolicy `json:"revocation_policy"`
+
+		// PublicRoutes holds the routes reachable without a token.
+		// Optional. Default value DefaultPublicRoutes.
+		PublicRoutes *PublicRoutes `json:"-"`
+
+		// Skipper tells whether to let a request through without a token, on top of PublicRoutes.
+		// Optional. Default value nil.
+		Skipper func(c echo.Context) bool `json:"-"`
+
+		// ErrorHandler responds to the requests rejected by the middleware, e.g. to render problems in another format.
+		// Optional. Default value WriteProblem.
+		ErrorHandler ProblemHandler `json:"-"`
 	}
 
 	jwtExtractor func(echo.Context) (string, error)
@@ -42,11 +112,26 @@ type (
 
 const (
 	bearer = "jwt$"
+
+	// DefaultAuthScheme is the RFC 6750 authentication scheme
+	DefaultAuthScheme = "Bearer"
 )
 
 // Algorithims
 const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmRS384 = "RS384"
 	AlgorithmRS512 = "RS512"
+	AlgorithmPS256 = "PS256"
+	AlgorithmPS384 = "PS384"
+	AlgorithmPS512 = "PS512"
+	AlgorithmES256 = "ES256"
+	AlgorithmES384 = "ES384"
+	AlgorithmES512 = "ES512"
+	AlgorithmEdDSA = "EdDSA"
+	AlgorithmHS256 = "HS256"
+	AlgorithmHS384 = "HS384"
+	AlgorithmHS512 = "HS512"
 )
 
 var (
@@ -54,15 +139,15 @@ var (
 	DefaultJWTConfig = JWTConfig{
 		SigningMethod: AlgorithmRS512,
 		ContextKey:    "user_id",
-		TokenLookup:   "header:" + echo.HeaderAuthorization,
+		TokenLookup:   "header:" + echo.HeaderAuthorization + ",header:" + echo.HeaderAuthorization + ":" + bearer,
+		AuthScheme:    DefaultAuthScheme,
 	}
 )
 
 // JWT returns a JSON Web Token (JWT) auth middleware.
 // The key parameter with default configuration has to be a rsa_public_key
 // For valid token, it sets the user in context and calls next handler.
-// For invalid token, it sends "401 - Unauthorized" response.
-// For empty or invalid `Authorization` header, it sends "400 - Bad Request".
+// For missing or invalid token, it sends "401 - Unauthorized" problem response with a WWW-Authenticate challenge.
 //
 // See: https://jwt.io/introduction
 func RSA_JWT(key *rsa.PublicKey) echo.MiddlewareFunc {
@@ -71,53 +156,195 @@ func RSA_JWT(key *rsa.PublicKey) echo.MiddlewareFunc {
 	return jwtWithConfig(c)
 }
 
-// JWTWithConfig returns a JWT auth middleware from config.
-// See: `JWT()`.
+// JWTWithConfig returns a JWT auth middleware from config. The type of config.SigningKey has to match
+// config.SigningMethod, otherwise it panics.
+// See: `RSA_JWT()`.
+func JWTWithConfig(config JWTConfig) echo.MiddlewareFunc {
+	return jwtWithConfig(config)
+}
+
 func jwtWithConfig(config JWTConfig) echo.MiddlewareFunc {
 	// Defaults
-	if config.SigningKey == nil {
+	if config.SigningKey == nil && config.KeyResolver == nil {
 		panic("jwt middleware requires signing key")
 	}
 	if config.SigningMethod == "" {
 		config.SigningMethod = DefaultJWTConfig.SigningMethod
 	}
+	if config.KeyResolver == nil {
+		if err := checkKeyType(config.SigningMethod, config.SigningKey, false); err != nil {
+			panic("jwt middleware: " + err.Error())
+		}
+	}
 	if config.ContextKey == "" {
 		config.ContextKey = DefaultJWTConfig.ContextKey
 	}
 	if config.TokenLookup == "" {
 		config.TokenLookup = DefaultJWTConfig.TokenLookup
 	}
+	if config.AuthScheme == "" {
+		config.AuthScheme = DefaultJWTConfig.AuthScheme
+	}
+	if config.PublicRoutes == nil {
+		config.PublicRoutes = DefaultPublicRoutes
+	}
+	if config.ErrorHandler == nil {
+		config.ErrorHandler = WriteProblem
+	}
 
 	// Initialize
-	parts := strings.Split(config.TokenLookup, ":")
-	extractor := JwtFromHeader(parts[1])
+	extractor := config.extractor()
 
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			if NonAuthenticationRequired(c.Request().URL.Path) {
+			if config.isPublic(c) {
 				//if its an open query point bypass jwp auth
 				return next(c)
 			}
 			auth, err := extractor(c)
 			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+				return config.ErrorHandler(c, missingTokenProblem())
+			}
+			reject := func(subject string, problem *Problem) error {
+				emitAuthEvent(config.Audit, c, EventTokenRejected, subject, OutcomeFailure, problem.Code)
+				return config.ErrorHandler(c, problem)
 			}
-			token, err := jwt.Parse(auth, func(t *jwt.Token) (interface{}, error) {
-				// Check the signing method
-				if t.Method.Alg() != config.SigningMethod {
-					return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
+
+			token, err := config.parseToken(auth)
+			if err != nil {
+				return reject("", tokenProblem(err))
+			}
+			if !token.Valid {
+				return reject("", invalidTokenProblem(CodeInvalidSignature, "token signature is invalid"))
+			}
+
+			// Store user information from token into context.
+			mapClaims := token.Claims.(jwt.MapClaims)
+			subject, _ := mapClaims["sub"].(string)
+			valid, err := config.checkRevocation(*token)
+			if err != nil {
+				log.Warnf("Failed to check token revocation: %s", err.Error())
+				return reject(subject, NewProblem(http.StatusServiceUnavailable, CodeRevocationUnavailable,
+					ErrRevocationUnavailable.Error()))
+			}
+			if !valid {
+				return reject(subject, invalidTokenProblem(CodeTokenRevoked, "token is revoked"))
+			}
+			if isMFAPending(*token) {
+				// half authenticated, only good for the second login step
+				return reject(subject, invalidTokenProblem(CodeMFAPending, "token is only good to complete the two-factor login"))
+			}
+			claims, err := NewClaims(mapClaims)
+			if err != nil {
+				return reject(subject, invalidTokenProblem(CodeInvalidClaims, err.Error()))
+			}
+			if config.NewClaims != nil {
+				custom, err := decodeCustomClaims(mapClaims, config.NewClaims)
+				if err != nil {
+					return reject(subject, invalidTokenProblem(CodeInvalidClaims, err.Error()))
 				}
-				return config.SigningKey, nil
+				c.Set(customClaimsContextKey, custom)
+			}
+			c.Set(config.ContextKey, mapClaims["sub"])
+			c.Set(claimsContextKey, claims)
+			return next(c)
+		}
+	}
+}
 
-			})
-			if err == nil && token.Valid && IsJWTValid(*token) {
-				// Store user information from token into context.
-				c.Set(config.ContextKey, token.Claims.(jwt.MapClaims)["sub"])
-				return next(c)
+// isPublic reports whether the request of c can go through without a token
+func (config JWTConfig) isPublic(c echo.Context) bool {
+	if config.Skipper != nil && config.Skipper(c) {
+		return true
+	}
+	return config.PublicRoutes.Matches(c.Request().Method, routedPath(c.Request()))
+}
+
+// parseToken verifies the signature of auth and validates its registered claims
+func (config JWTConfig) parseToken(auth string) (*jwt.Token, error) {
+
+	parser := jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(auth, config.keyFunc)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrMalformedClaim
+	}
+	if err := config.ValidateClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// keyFunc returns the key to validate t with, as long as t is signed with the configured signing method
+func (config JWTConfig) keyFunc(t *jwt.Token) (interface{}, error) {
+	if config.KeyResolver != nil {
+		return config.KeyResolver.ResolveKey(t)
+	}
+	// Check the signing method
+	if t.Method.Alg() != config.SigningMethod {
+		return nil, fmt.Errorf("unexpected jwt signing method=%v", t.Header["alg"])
+	}
+	return config.SigningKey, nil
+}
+
+// extractor returns the chain of extractors described by TokenLookup. It panics if TokenLookup is malformed.
+func (config JWTConfig) extractor() jwtExtractor {
+
+	scheme := config.AuthScheme
+	if scheme == "" {
+		scheme = DefaultAuthScheme
+	}
+
+	var extractors []jwtExtractor
+	for _, lookup := range strings.Split(config.TokenLookup, ",") {
+		parts := strings.SplitN(strings.TrimSpace(lookup), ":", 3)
+		if len(parts) < 2 || parts[1] == "" {
+			panic("jwt middleware: malformed token lookup " + lookup)
+		}
+		switch parts[0] {
+		case "header":
+			prefix := scheme
+			if len(parts) == 3 {
+				prefix = parts[2]
 			}
+			extractors = append(extractors, JwtFromHeaderWithScheme(parts[1], prefix))
+		case "query":
+			extractors = append(extractors, JwtFromQuery(parts[1]))
+		case "cookie":
+			extractors = append(extractors, JwtFromCookie(parts[1]))
+		case "form":
+			extractors = append(extractors, JwtFromForm(parts[1]))
+		default:
+			panic("jwt middleware: unknown token lookup source " + parts[0])
+		}
+	}
 
-			return echo.ErrUnauthorized
+	return JwtFromAny(extractors...)
+}
+
+// JwtFromAny returns a `jwtExtractor` that tries extractors in order and returns the first token found. If none
+// finds a token it returns the error of the first one.
+func JwtFromAny(extractors ...jwtExtractor) jwtExtractor {
+	return func(c echo.Context) (string, error) {
+		var first error
+		for _, extractor := range extractors {
+			auth, err := extractor(c)
+			if err == nil {
+				return auth, nil
+			}
+			if first == nil {
+				first = err
+			}
 		}
+		if first == nil {
+			first = errors.New("empty or invalid jwt")
+		}
+		return "", first
 	}
 }
 
@@ -134,10 +361,31 @@ func JwtFromHeader(header string) jwtExtractor {
 	}
 }
 
-//not allowing authentication in query parameter otfp
-// jwtFromQuery returns a `jwtExtractor` that extracts token from the provided query
+// JwtFromHeaderWithScheme returns a `jwtExtractor` that extracts token from the provided request header, where it
+// is prefixed by scheme. Schemes ending in a letter or digit, such as "Bearer", are matched case insensitively and
+// followed by a space, any other scheme, such as "jwt$", is matched as is.
+func JwtFromHeaderWithScheme(header, scheme string) jwtExtractor {
+
+	prefix := scheme
+	if l := len(scheme); l > 0 && (unicode.IsLetter(rune(scheme[l-1])) || unicode.IsDigit(rune(scheme[l-1]))) {
+		prefix += " "
+	}
+
+	return func(c echo.Context) (string, error) {
+		auth := c.Request().Header.Get(header)
+		l := len(prefix)
+		if len(auth) > l && strings.EqualFold(auth[:l], prefix) {
+			if token := strings.TrimSpace(auth[l:]); token != "" {
+				return token, nil
+			}
+		}
+		return "", errors.New("empty or invalid jwt in " + strings.ToLower(header) + " header")
+	}
+}
+
+// JwtFromQuery returns a `jwtExtractor` that extracts token from the provided query
 // parameter.
-/*func jwtFromQuery(param string) jwtExtractor {
+func JwtFromQuery(param string) jwtExtractor {
 	return func(c echo.Context) (string, error) {
 		token := c.QueryParam(param)
 		if token == "" {
@@ -145,4 +393,26 @@ func JwtFromHeader(header string) jwtExtractor {
 		}
 		return token, nil
 	}
-}*/
+}
+
+// JwtFromCookie returns a `jwtExtractor` that extracts token from the provided cookie.
+func JwtFromCookie(name string) jwtExtractor {
+	return func(c echo.Context) (string, error) {
+		cookie, err := c.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return "", errors.New("empty jwt in cookie")
+		}
+		return cookie.Value, nil
+	}
+}
+
+// JwtFromForm returns a `jwtExtractor` that extracts token from the provided form field.
+func JwtFromForm(field string) jwtExtractor {
+	return func(c echo.Context) (string, error) {
+		token := c.FormValue(field)
+		if token == "" {
+			return "", errors.New("empty jwt in form field")
+		}
+		return token, nil
+	}
+}
@@ -9,6 +9,8 @@ import (
 	"github.com/guidola/go-utils/database"
 	"path/filepath"
 	"os"
+	"net/url"
+	"strings"
 	"net/http/httptest"
 )
 
@@ -98,10 +100,11 @@ func TestRSA_JWT(t *testing.T) {
 
 		auth := "jwt$" + test_case.token
 		req.Header.Set(echo.HeaderAuthorization, auth)
+		res := httptest.NewRecorder()
 		m := RSA_JWT(GetRSAPublicKey(os.Getenv(JwtCertsLocation) + "public_key.pem"))(handler)
-		me := m(c).(*echo.HTTPError)
-		if me.Code != test_case.code {
-			t.Errorf("expected HTTP error code %d and got %d instead", test_case.code, me.Code)
+		m(e.NewContext(req, res))
+		if res.Code != test_case.code {
+			t.Errorf("expected HTTP error code %d and got %d instead", test_case.code, res.Code)
 		}
 
 	}
@@ -110,7 +113,7 @@ func TestRSA_JWT(t *testing.T) {
 	for _, test_case := range must_pass_test_cases{
 
 		auth := "jwt$" + test_case.token
-		req.Header().Set(echo.HeaderAuthorization, auth)
+		req.Header.Set(echo.HeaderAuthorization, auth)
 		m := RSA_JWT(GetRSAPublicKey(os.Getenv(JwtCertsLocation) + "public_key.pem"))(handler)
 		err := m(c)
 		if err != nil {
@@ -134,3 +137,65 @@ func TestRSA_JWT(t *testing.T) {
 	}
 
 }
+
+func TestJWTExtractor(t *testing.T) {
+
+	var test_cases = []struct {
+		lookup, scheme string
+		header, query  string
+		cookie, form   string
+		out            string
+	}{
+		{DefaultJWTConfig.TokenLookup, "", "Bearer whatever", "", "", "", "whatever"},
+		{DefaultJWTConfig.TokenLookup, "", "bearer whatever", "", "", "", "whatever"},
+		{DefaultJWTConfig.TokenLookup, "", "jwt$whatever", "", "", "", "whatever"},
+		{DefaultJWTConfig.TokenLookup, "", "Bearerwhatever", "", "", "", ""},
+		{DefaultJWTConfig.TokenLookup, "", "Bearer ", "", "", "", ""},
+		{DefaultJWTConfig.TokenLookup, "", "Basic whatever", "", "", "", ""},
+		{"header:Authorization", "Token", "Token whatever", "", "", "", "whatever"},
+		{"header:X-Auth:", "", "whatever", "", "", "", "whatever"},
+		{"query:token", "", "", "whatever", "", "", "whatever"},
+		{"cookie:session", "", "", "", "whatever", "", "whatever"},
+		{"form:access_token", "", "", "", "", "whatever", "whatever"},
+		{"cookie:session,header:Authorization", "", "Bearer header", "", "cookie", "", "cookie"},
+		{"cookie:session,header:Authorization", "", "Bearer header", "", "", "", "header"},
+		{"cookie:session,query:token", "", "Bearer header", "", "", "", ""},
+	}
+
+	e := echo.New()
+	for _, test_case := range test_cases {
+
+		form := url.Values{}
+		if test_case.form != "" {
+			form.Set("access_token", test_case.form)
+		}
+		req := httptest.NewRequest(echo.POST, "/?token="+test_case.query, strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		req.Header.Set(echo.HeaderAuthorization, test_case.header)
+		req.Header.Set("X-Auth", test_case.header)
+		if test_case.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "session", Value: test_case.cookie})
+		}
+		c := e.NewContext(req, httptest.NewRecorder())
+
+		config := JWTConfig{TokenLookup: test_case.lookup, AuthScheme: test_case.scheme}
+		auth, err := config.extractor()(c)
+		if auth != test_case.out {
+			t.Errorf("expected auth to be '%s' with lookup '%s' and got '%s'", test_case.out, test_case.lookup, auth)
+		}
+		if test_case.out == "" && err == nil {
+			t.Errorf("expected err with lookup '%s' and got nil", test_case.lookup)
+		}
+	}
+
+	for _, lookup := range []string{"header", "body:token", "query:"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected malformed lookup %s to panic", lookup)
+				}
+			}()
+			JWTConfig{TokenLookup: lookup}.extractor()
+		}()
+	}
+}
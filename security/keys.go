@@ -0,0 +1,69 @@
+package security
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+)
+
+// ErrNotPEMEncoded is returned when a key file does not hold a PEM block
+var ErrNotPEMEncoded = errors.New("key must be PEM encoded")
+
+// LoadPublicKey reads a PEM encoded public key from filepath. PKIX encoded RSA, ECDSA and Ed25519 keys as well as
+// PKCS#1 RSA keys are supported. The returned key can be used as JWTConfig.SigningKey.
+func LoadPublicKey(filepath string) (interface{}, error) {
+
+	block, err := readPEMBlock(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if certificate, err := x509.ParseCertificate(block.Bytes); err == nil {
+		return certificate.PublicKey, nil
+	}
+
+	return nil, errors.New("unsupported public key format")
+}
+
+// LoadPrivateKey reads a PEM encoded private key from filepath. PKCS#8 encoded RSA, ECDSA and Ed25519 keys as well as
+// PKCS#1 RSA keys and SEC 1 EC keys are supported. The returned key can be used as TokenIssuerConfig.SigningKey.
+func LoadPrivateKey(filepath string) (interface{}, error) {
+
+	block, err := readPEMBlock(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return nil, errors.New("unsupported private key format")
+}
+
+func readPEMBlock(filepath string) (*pem.Block, error) {
+
+	key_file, err := ioutil.ReadFile(filepath)
+	if err != nil {
+		return nil, errors.New("The provided file path does not point to an existing file")
+	}
+
+	block, _ := pem.Decode(key_file)
+	if block == nil {
+		return nil, ErrNotPEMEncoded
+	}
+	return block, nil
+}
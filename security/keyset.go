@@ -0,0 +1,204 @@
+package security
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+var (
+	// ErrMissingKeyID is returned when a token verified against a key set carries no `kid` header
+	ErrMissingKeyID = errors.New("jwt has no kid header")
+
+	// ErrUnknownKeyID is returned when the `kid` header of a token does not match any usable key
+	ErrUnknownKeyID = errors.New("jwt kid does not match any known key")
+
+	// ErrNoActiveKey is returned when signing with a key set that has no active key
+	ErrNoActiveKey = errors.New("key set has no active key")
+)
+
+type (
+	// KeyResolver resolves the key a token has to be verified with, usually from its `kid` header. Resolvers are
+	// responsible for rejecting tokens whose signing method does not match the one of the resolved key.
+	KeyResolver interface {
+		ResolveKey(token *jwt.Token) (interface{}, error)
+	}
+
+	// KeySet holds several asymmetric keys identified by ID to allow rotating them without invalidating live tokens.
+	// A key goes through the following states:
+	// - published: right after being added. Tokens signed with it are accepted and it is listed on the JWKS, so
+	//   other services can learn about it before it gets used.
+	// - active: the single key new tokens are signed with. Activating a key demotes the previous one to published.
+	// - retired: tokens signed with it are rejected and it is no longer listed on the JWKS.
+	KeySet struct {
+		mutex  sync.RWMutex
+		keys   map[string]*keySetEntry
+		order  []string //insertion order, so the JWKS output is stable
+		active string
+	}
+
+	keySetEntry struct {
+		algorithm  string
+		privateKey interface{}
+		publicKey  interface{}
+		retired    bool
+	}
+)
+
+// NewKeySet returns an empty key set
+func NewKeySet() *KeySet {
+	return &KeySet{keys: map[string]*keySetEntry{}}
+}
+
+// Add stores privateKey under id to be used with alg. The key is published but not active, see Activate.
+func (ks *KeySet) Add(id string, alg string, privateKey interface{}) error {
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("keys of type %T cannot be added to a key set", privateKey)
+	}
+	if err := checkKeyType(alg, privateKey, true); err != nil {
+		return err
+	}
+
+	return ks.add(id, &keySetEntry{algorithm: alg, privateKey: privateKey, publicKey: signer.Public()})
+}
+
+// AddPublic stores publicKey under id to be used with alg. The key can only be used to verify tokens, so it cannot
+// be activated. Useful to keep verifying tokens signed by a key whose private half lives somewhere else.
+func (ks *KeySet) AddPublic(id string, alg string, publicKey interface{}) error {
+
+	if err := checkKeyType(alg, publicKey, false); err != nil {
+		return err
+	}
+	if _, err := NewJSONWebKey(id, alg, publicKey); err != nil {
+		return err
+	}
+
+	return ks.add(id, &keySetEntry{algorithm: alg, publicKey: publicKey})
+}
+
+func (ks *KeySet) add(id string, entry *keySetEntry) error {
+
+	if id == "" {
+		return errors.New("key id cannot be empty")
+	}
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	if _, exists := ks.keys[id]; exists {
+		return fmt.Errorf("key %s already exists on the key set", id)
+	}
+
+	ks.keys[id] = entry
+	ks.order = append(ks.order, id)
+	return nil
+}
+
+// Activate makes the key identified by id the one new tokens are signed with
+func (ks *KeySet) Activate(id string) error {
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	entry, ok := ks.keys[id]
+	switch {
+	case !ok:
+		return ErrUnknownKeyID
+	case entry.retired:
+		return fmt.Errorf("key %s is retired", id)
+	case entry.privateKey == nil:
+		return fmt.Errorf("key %s has no private key to sign with", id)
+	}
+
+	ks.active = id
+	return nil
+}
+
+// Retire stops accepting tokens signed by the key identified by id and removes it from the JWKS. The active key
+// cannot be retired, activate another one first.
+func (ks *KeySet) Retire(id string) error {
+
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	entry, ok := ks.keys[id]
+	if !ok {
+		return ErrUnknownKeyID
+	}
+	if id == ks.active {
+		return fmt.Errorf("key %s is the active key", id)
+	}
+
+	entry.retired = true
+	return nil
+}
+
+// Active returns the id, signing method and private key of the active key
+func (ks *KeySet) Active() (string, string, interface{}, error) {
+
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	entry, ok := ks.keys[ks.active]
+	if !ok {
+		return "", "", nil, ErrNoActiveKey
+	}
+	return ks.active, entry.algorithm, entry.privateKey, nil
+}
+
+// ResolveKey returns the public key matching the `kid` header of token as long as it is not retired and the token
+// is signed with the signing method the key was added for
+func (ks *KeySet) ResolveKey(token *jwt.Token) (interface{}, error) {
+
+	id, _ := token.Header["kid"].(string)
+	if id == "" {
+		return nil, ErrMissingKeyID
+	}
+
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	entry, ok := ks.keys[id]
+	if !ok || entry.retired {
+		return nil, ErrUnknownKeyID
+	}
+	// Check the signing method
+	if token.Method.Alg() != entry.algorithm {
+		return nil, fmt.Errorf("unexpected jwt signing method=%v", token.Header["alg"])
+	}
+
+	return entry.publicKey, nil
+}
+
+// JWKS returns the public half of every key that is not retired
+func (ks *KeySet) JWKS() JSONWebKeySet {
+
+	ks.mutex.RLock()
+	defer ks.mutex.RUnlock()
+
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, id := range ks.order {
+		entry := ks.keys[id]
+		if entry.retired {
+			continue
+		}
+		if jwk, err := NewJSONWebKey(id, entry.algorithm, entry.publicKey); err == nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+
+	return set
+}
+
+// JWKSHandler is a request handler that responds with the JWKS of the key set. Meant to be mounted on JWKSPath.
+func (ks *KeySet) JWKSHandler(c echo.Context) error {
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return c.JSON(http.StatusOK, ks.JWKS())
+}
@@ -0,0 +1,121 @@
+package security
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+func TestKeySetRotation(t *testing.T) {
+
+	keys := NewKeySet()
+	if err := keys.Add("2016-06", AlgorithmRS512, testRSAKey); err != nil {
+		t.Fatalf("expected err to be nil and got %s instead", err)
+	}
+	if err := keys.Add("2016-07", AlgorithmES256, testECP256Key); err != nil {
+		t.Fatalf("expected err to be nil and got %s instead", err)
+	}
+	if err := keys.Add("2016-07", AlgorithmES256, testECP256Key); err == nil {
+		t.Errorf("expected duplicated key ids to be rejected")
+	}
+	if err := keys.Add("hmac", AlgorithmHS256, testHMACSecret); err == nil {
+		t.Errorf("expected shared secrets to be rejected")
+	}
+
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{KeySet: keys})
+	if _, err := issuer.Issue("patata", nil); err != ErrNoActiveKey {
+		t.Errorf("expected err to be '%s' and got '%v' instead", ErrNoActiveKey, err)
+	}
+
+	keys.Activate("2016-06")
+	old, _ := issuer.Issue("patata", nil)
+
+	keys.Activate("2016-07")
+	current, _ := issuer.Issue("patata", nil)
+
+	config := JWTConfig{KeyResolver: keys}
+	for _, tokenstring := range []string{old, current} {
+		if token, err := jwt.Parse(tokenstring, config.keyFunc); err != nil || !token.Valid {
+			t.Errorf("expected token signed by a published key to be valid and got %v", err)
+		}
+	}
+
+	token, _ := jwt.Parse(current, config.keyFunc)
+	if token.Header["kid"] != "2016-07" || token.Method.Alg() != AlgorithmES256 {
+		t.Errorf("expected token to be signed by the active key and got kid %v alg %s", token.Header["kid"],
+			token.Method.Alg())
+	}
+
+	if err := keys.Retire("2016-07"); err == nil {
+		t.Errorf("expected the active key not to be retirable")
+	}
+	if err := keys.Retire("2016-06"); err != nil {
+		t.Errorf("expected err to be nil and got %s instead", err)
+	}
+	if _, err := jwt.Parse(old, config.keyFunc); err == nil {
+		t.Errorf("expected tokens signed by a retired key to be rejected")
+	}
+
+	//a token whose header points to a key of another algorithm must be rejected
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "patata"})
+	forged.Header["kid"] = "2016-07"
+	forgedstring, _ := forged.SignedString(testHMACSecret)
+	if _, err := jwt.Parse(forgedstring, config.keyFunc); err == nil {
+		t.Errorf("expected a token not matching the algorithm of its key to be rejected")
+	}
+
+	unidentified, _ := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{}).SignedString(testECP256Key)
+	if _, err := jwt.Parse(unidentified, config.keyFunc); err == nil {
+		t.Errorf("expected a token without kid to be rejected")
+	}
+}
+
+func TestKeySetJWKSHandler(t *testing.T) {
+
+	keys := NewKeySet()
+	keys.Add("rsa", AlgorithmRS256, testRSAKey)
+	keys.Add("ec", AlgorithmES384, testECP384Key)
+	keys.Add("ed", AlgorithmEdDSA, testEd25519Key)
+	keys.Add("retired", AlgorithmES256, testECP256Key)
+	keys.Retire("retired")
+
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, JWKSPath, nil)
+	res := httptest.NewRecorder()
+	c := e.NewContext(req, res)
+
+	if err := keys.JWKSHandler(c); err != nil || res.Code != http.StatusOK {
+		t.Fatalf("expected status 200 and got %d with err %v", res.Code, err)
+	}
+
+	var set JSONWebKeySet
+	if err := json.Unmarshal(res.Body.Bytes(), &set); err != nil {
+		t.Fatalf("expected a valid JWKS and got %s", err)
+	}
+
+	var expected_keys = []struct {
+		kid, kty, alg, crv string
+	}{
+		{"rsa", "RSA", AlgorithmRS256, ""},
+		{"ec", "EC", AlgorithmES384, "P-384"},
+		{"ed", "OKP", AlgorithmEdDSA, "Ed25519"},
+	}
+
+	if len(set.Keys) != len(expected_keys) {
+		t.Fatalf("expected %d keys and got %d", len(expected_keys), len(set.Keys))
+	}
+	for i, expected := range expected_keys {
+		key := set.Keys[i]
+		if key.KeyID != expected.kid || key.KeyType != expected.kty || key.Algorithm != expected.alg ||
+			key.Curve != expected.crv {
+			t.Errorf("expected key %+v and got %+v", expected, key)
+		}
+	}
+	if len(set.Keys[1].X) != 64 || len(set.Keys[1].Y) != 64 {
+		t.Errorf("expected P-384 coordinates to be 48 bytes long and got x=%s y=%s", set.Keys[1].X, set.Keys[1].Y)
+	}
+}
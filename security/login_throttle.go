@@ -0,0 +1,481 @@
+package security
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/guidola/go-utils/database"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// Kinds of keys failed login attempts are counted on
+const (
+	ThrottleAccount = "account"
+	ThrottleIP      = "ip"
+)
+
+type (
+	// LoginThrottleConfig defines the brute force protection of the login handler. Failed attempts are counted per
+	// account and per client IP over a sliding Window. Once FreeFailures are exceeded on an account each new attempt
+	// on it has to wait an exponentially growing delay since the last failure, and reaching the maximum failures
+	// locks the account or IP out for LockoutDuration. IPs are not backed off, so the typos of a few users behind a
+	// shared IP do not slow down everyone else. Attempts made too early get "429 - Too Many Requests" with a
+	// Retry-After header.
+	LoginThrottleConfig struct {
+		// Store the failed attempts are counted on.
+		// Optional. Default value a RedisLoginAttemptStore.
+		Store LoginAttemptStore
+
+		// Sliding window failed attempts are counted over.
+		// Optional. Default value 15 minutes.
+		Window time.Duration
+
+		// Failures allowed on an account within Window before it gets locked out.
+		// Optional. Default value 10.
+		MaxAccountFailures int
+
+		// Failures allowed from an IP within Window before it gets locked out.
+		// Optional. Default value 50.
+		MaxIPFailures int
+
+		// Failures allowed on an account before the backoff delay applies.
+		// Optional. Default value 3.
+		FreeFailures int
+
+		// Delay after the first failure beyond FreeFailures, doubled on every further failure up to MaxDelay.
+		// Optional. Default value 1 second.
+		BaseDelay time.Duration
+
+		// Maximum backoff delay.
+		// Optional. Default value 1 minute.
+		MaxDelay time.Duration
+
+		// How long accounts and IPs reaching their maximum failures are locked out.
+		// Optional. Default value 15 minutes.
+		LockoutDuration time.Duration
+
+		// OnLockout is called whenever an account or IP gets locked out, e.g. to notify the account owner.
+		// Optional.
+		OnLockout func(event LockoutEvent)
+	}
+
+	// LockoutEvent describes an account or IP getting locked out.
+	LockoutEvent struct {
+		// Kind is either ThrottleAccount or ThrottleIP.
+		Kind string
+		// Identifier of the locked account or the locked IP.
+		Identifier string
+		// IP the last failed attempt came from.
+		IP string
+		// Failures counted within the window.
+		Failures int
+		// Until when the lockout lasts.
+		Until time.Time
+	}
+
+	// LoginAttemptStore counts failed login attempts over a sliding window and keeps lockouts.
+	LoginAttemptStore interface {
+		// RecordFailure records a failed attempt on key at the given time and returns the number of failures
+		// within window.
+		RecordFailure(key string, at time.Time, window time.Duration) (int, error)
+
+		// Failures returns the number of failures on key within window and the time of the last one.
+		Failures(key string, window time.Duration) (int, time.Time, error)
+
+		// Reset forgets the failures of key.
+		Reset(key string) error
+
+		// Lock locks key out until the given time.
+		Lock(key string, until time.Time) error
+
+		// LockedUntil returns until when key is locked out, the zero time if it is not.
+		LockedUntil(key string) (time.Time, error)
+	}
+)
+
+var (
+	// DefaultLoginThrottleConfig is the default login brute force protection config.
+	DefaultLoginThrottleConfig = LoginThrottleConfig{
+		Window:             15 * time.Minute,
+		MaxAccountFailures: 10,
+		MaxIPFailures:      50,
+		FreeFailures:       3,
+		BaseDelay:          time.Second,
+		MaxDelay:           time.Minute,
+		LockoutDuration:    15 * time.Minute,
+	}
+)
+
+// withDefaults returns config with its unset fields taken from DefaultLoginThrottleConfig
+func (config LoginThrottleConfig) withDefaults() LoginThrottleConfig {
+	if config.Store == nil {
+		config.Store = NewRedisLoginAttemptStore()
+	}
+	if config.Window == 0 {
+		config.Window = DefaultLoginThrottleConfig.Window
+	}
+	if config.MaxAccountFailures == 0 {
+		config.MaxAccountFailures = DefaultLoginThrottleConfig.MaxAccountFailures
+	}
+	if config.MaxIPFailures == 0 {
+		config.MaxIPFailures = DefaultLoginThrottleConfig.MaxIPFailures
+	}
+	if config.FreeFailures == 0 {
+		config.FreeFailures = DefaultLoginThrottleConfig.FreeFailures
+	}
+	if config.BaseDelay == 0 {
+		config.BaseDelay = DefaultLoginThrottleConfig.BaseDelay
+	}
+	if config.MaxDelay == 0 {
+		config.MaxDelay = DefaultLoginThrottleConfig.MaxDelay
+	}
+	if config.LockoutDuration == 0 {
+		config.LockoutDuration = DefaultLoginThrottleConfig.LockoutDuration
+	}
+	return config
+}
+
+// throttleKey returns the key the failures of identifier are counted on
+func throttleKey(kind string, identifier string) string {
+	if kind == ThrottleAccount {
+		identifier = strings.ToLower(identifier)
+	}
+	return kind + ":" + identifier
+}
+
+// backoff returns the delay to wait after the last of failures
+func (config LoginThrottleConfig) backoff(failures int) time.Duration {
+
+	if failures <= config.FreeFailures {
+		return 0
+	}
+
+	exponent := float64(failures - config.FreeFailures - 1)
+	delay := time.Duration(float64(config.BaseDelay) * math.Pow(2, exponent))
+	if delay > config.MaxDelay || delay <= 0 {
+		return config.MaxDelay
+	}
+	return delay
+}
+
+// RetryAfter returns how long the client has to wait before attempting to log in again as identifier from ip, zero
+// if it can try right away. The account has to wait for its lockout and backoff delay, the IP only for its lockout.
+// Checking and recording an attempt are not atomic, so concurrent attempts all pass the check before any of them is
+// recorded: a client can fire a burst of guesses in parallel before being backed off. The lockouts still bound them,
+// as every failure is counted.
+func (config LoginThrottleConfig) RetryAfter(identifier string, ip string) (time.Duration, error) {
+
+	config = config.withDefaults()
+	now := time.Now()
+
+	account := throttleKey(ThrottleAccount, identifier)
+
+	var wait time.Duration
+	for _, key := range []string{account, throttleKey(ThrottleIP, ip)} {
+
+		until, err := config.Store.LockedUntil(key)
+		if err != nil {
+			return 0, err
+		}
+		if left := until.Sub(now); left > wait {
+			wait = left
+		}
+	}
+
+	failures, last, err := config.Store.Failures(account, config.Window)
+	if err != nil {
+		return 0, err
+	}
+	if left := last.Add(config.backoff(failures)).Sub(now); failures > 0 && left > wait {
+		wait = left
+	}
+
+	return wait, nil
+}
+
+// RecordFailure counts a failed attempt to log in as identifier from ip, locking them out once they reach their
+// maximum failures
+func (config LoginThrottleConfig) RecordFailure(identifier string, ip string) error {
+
+	config = config.withDefaults()
+	now := time.Now()
+
+	limits := []struct {
+		kind, identifier string
+		max              int
+	}{
+		{ThrottleAccount, identifier, config.MaxAccountFailures},
+		{ThrottleIP, ip, config.MaxIPFailures},
+	}
+
+	for _, limit := range limits {
+		key := throttleKey(limit.kind, limit.identifier)
+		failures, err := config.Store.RecordFailure(key, now, config.Window)
+		if err != nil {
+			return err
+		}
+		if failures < limit.max {
+			continue
+		}
+
+		until := now.Add(config.LockoutDuration)
+		if err := config.Store.Lock(key, until); err != nil {
+			return err
+		}
+		if err := config.Store.Reset(key); err != nil {
+			return err
+		}
+		if config.OnLockout != nil {
+			config.OnLockout(LockoutEvent{Kind: limit.kind, Identifier: limit.identifier, IP: ip,
+				Failures: failures, Until: until})
+		}
+	}
+
+	return nil
+}
+
+// RecordSuccess forgets the failed attempts on the account of identifier
+func (config LoginThrottleConfig) RecordSuccess(identifier string) error {
+	config = config.withDefaults()
+	return config.Store.Reset(throttleKey(ThrottleAccount, identifier))
+}
+
+// tooManyAttempts sets the Retry-After header and returns the "429 - Too Many Requests" problem
+func tooManyAttempts(c echo.Context, wait time.Duration) error {
+	seconds := int64(math.Ceil(wait.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	return NewProblem(http.StatusTooManyRequests, CodeTooManyRequests, "too many failed login attempts, retry later")
+}
+
+// throttleLogin checks whether identifier can attempt to log in from the client of c. Store errors are logged and
+// let the attempt through, so an outage does not lock every user out.
+func (config LoginThrottleConfig) throttleLogin(c echo.Context, identifier string) error {
+
+	wait, err := config.RetryAfter(identifier, c.RealIP())
+	if err != nil {
+		log.Warnf("Failed to check login attempts of %s: %s", identifier, err.Error())
+		return nil
+	}
+	if wait > 0 {
+		return tooManyAttempts(c, wait)
+	}
+	return nil
+}
+
+// recordAttempt records the outcome of an attempt to log in as identifier from ip, logging any store error
+func (config LoginThrottleConfig) recordAttempt(identifier string, ip string, allowed bool) {
+
+	var err error
+	if allowed {
+		err = config.RecordSuccess(identifier)
+	} else {
+		err = config.RecordFailure(identifier, ip)
+	}
+	if err != nil {
+		log.Warnf("Failed to record login attempt of %s: %s", identifier, err.Error())
+	}
+}
+
+// ****************************
+// Redis login attempt store
+// ****************************
+
+// DefaultLoginAttemptKeyPrefix is the prefix of the keys written by a RedisLoginAttemptStore
+const DefaultLoginAttemptKeyPrefix = "login:"
+
+// LoginAttemptStore keeping the failed attempts of each key on a redis sorted set scored by their time, so the ones
+// out of the sliding window can be trimmed.
+type RedisLoginAttemptStore struct {
+	// Prefix of every key written by the store.
+	// Optional. Default value DefaultLoginAttemptKeyPrefix.
+	Prefix string
+}
+
+// NewRedisLoginAttemptStore returns a login attempt store using the global redis instance
+func NewRedisLoginAttemptStore() *RedisLoginAttemptStore {
+	return &RedisLoginAttemptStore{Prefix: DefaultLoginAttemptKeyPrefix}
+}
+
+func (s *RedisLoginAttemptStore) key(kind string, key string) string {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = DefaultLoginAttemptKeyPrefix
+	}
+	return prefix + kind + ":" + key
+}
+
+func (s *RedisLoginAttemptStore) RecordFailure(key string, at time.Time, window time.Duration) (int, error) {
+
+	r := database.GetRedisInstance()
+	failures := s.key("failures", key)
+
+	member, err := randomString(8)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.Execute("ZADD", failures, at.UnixNano()/int64(time.Millisecond), member); err != nil {
+		return 0, err
+	}
+	if _, err := r.Execute("PEXPIRE", failures, int64(window/time.Millisecond)); err != nil {
+		return 0, err
+	}
+
+	count, _, err := s.Failures(key, window)
+	return count, err
+}
+
+func (s *RedisLoginAttemptStore) Failures(key string, window time.Duration) (int, time.Time, error) {
+
+	r := database.GetRedisInstance()
+	failures := s.key("failures", key)
+
+	// trim the failures out of the window before counting them
+	start := time.Now().Add(-window).UnixNano() / int64(time.Millisecond)
+	if _, err := r.Execute("ZREMRANGEBYSCORE", failures, "-inf", start); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	response, err := r.Execute("ZCARD", failures)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	count, err := response.Int()
+	if err != nil || count == 0 {
+		return 0, time.Time{}, err
+	}
+
+	response, err = r.Execute("ZREVRANGE", failures, 0, 0, "WITHSCORES")
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	values, err := response.List()
+	if err != nil || len(values) < 2 {
+		return 0, time.Time{}, err
+	}
+
+	last, err := strconv.ParseFloat(values[1], 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return count, time.Unix(0, int64(last)*int64(time.Millisecond)), nil
+}
+
+func (s *RedisLoginAttemptStore) Reset(key string) error {
+	_, err := database.GetRedisInstance().Execute("DEL", s.key("failures", key))
+	return err
+}
+
+func (s *RedisLoginAttemptStore) Lock(key string, until time.Time) error {
+	_, err := database.GetRedisInstance().Execute("SET", s.key("locked", key), until.Unix(),
+		"EX", secondsUntil(until.Unix()))
+	return err
+}
+
+func (s *RedisLoginAttemptStore) LockedUntil(key string) (time.Time, error) {
+
+	response, err := database.GetRedisInstance().Execute("GET", s.key("locked", key))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if response.IsType(redis.Nil) {
+		return time.Time{}, nil
+	}
+
+	unix, err := response.Int64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unix, 0), nil
+}
+
+// ****************************
+// In memory login attempt store
+// ****************************
+
+// MemoryLoginAttemptStore counts failed login attempts in memory, so behind a load balancer each instance grants
+// its own allowance.
+type MemoryLoginAttemptStore struct {
+	mutex    sync.Mutex
+	failures map[string][]time.Time
+	locks    map[string]time.Time
+}
+
+// NewMemoryLoginAttemptStore returns an empty in memory login attempt store
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{failures: map[string][]time.Time{}, locks: map[string]time.Time{}}
+}
+
+func (s *MemoryLoginAttemptStore) RecordFailure(key string, at time.Time, window time.Duration) (int, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.failures[key] = append(s.trim(key, window), at)
+	return len(s.failures[key]), nil
+}
+
+func (s *MemoryLoginAttemptStore) Failures(key string, window time.Duration) (int, time.Time, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	failures := s.trim(key, window)
+	if len(failures) == 0 {
+		return 0, time.Time{}, nil
+	}
+	return len(failures), failures[len(failures)-1], nil
+}
+
+func (s *MemoryLoginAttemptStore) Reset(key string) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.failures, key)
+	return nil
+}
+
+func (s *MemoryLoginAttemptStore) Lock(key string, until time.Time) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.locks[key] = until
+	return nil
+}
+
+func (s *MemoryLoginAttemptStore) LockedUntil(key string) (time.Time, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	until, ok := s.locks[key]
+	if ok && time.Now().After(until) {
+		delete(s.locks, key)
+		return time.Time{}, nil
+	}
+	return until, nil
+}
+
+// trim drops the failures of key out of the window and returns the remaining ones, callers must hold the mutex
+func (s *MemoryLoginAttemptStore) trim(key string, window time.Duration) []time.Time {
+
+	failures := s.failures[key]
+	start := time.Now().Add(-window)
+	i := 0
+	for i < len(failures) && failures[i].Before(start) {
+		i++
+	}
+	if i == len(failures) {
+		delete(s.failures, key)
+		return nil
+	}
+	s.failures[key] = failures[i:]
+	return s.failures[key]
+}
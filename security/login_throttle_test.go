@@ -0,0 +1,151 @@
+package security
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func TestLoginThrottleBackoff(t *testing.T) {
+
+	config := LoginThrottleConfig{FreeFailures: 2, BaseDelay: time.Second, MaxDelay: 10 * time.Second}.withDefaults()
+
+	var test_cases = []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{6, 8 * time.Second},
+		{7, 10 * time.Second},
+		{200, 10 * time.Second},
+	}
+
+	for _, test_case := range test_cases {
+		if delay := config.backoff(test_case.failures); delay != test_case.delay {
+			t.Errorf("expected delay after %d failures to be %s and got %s", test_case.failures, test_case.delay, delay)
+		}
+	}
+}
+
+func TestMemoryLoginAttemptStore(t *testing.T) {
+
+	store := NewMemoryLoginAttemptStore()
+	now := time.Now()
+
+	store.RecordFailure("account:patata", now.Add(-2*time.Minute), time.Minute)
+	store.RecordFailure("account:patata", now.Add(-30*time.Second), time.Minute)
+	if failures, _ := store.RecordFailure("account:patata", now, time.Minute); failures != 2 {
+		t.Errorf("expected failures out of the window to be dropped and got %d failures", failures)
+	}
+	if failures, last, _ := store.Failures("account:patata", time.Minute); failures != 2 || !last.Equal(now) {
+		t.Errorf("expected 2 failures, the last one at %s, and got %d at %s", now, failures, last)
+	}
+
+	store.Reset("account:patata")
+	if failures, _, _ := store.Failures("account:patata", time.Minute); failures != 0 {
+		t.Errorf("expected failures to be reset and got %d", failures)
+	}
+
+	store.Lock("ip:192.0.2.1", now.Add(time.Minute))
+	store.Lock("ip:192.0.2.2", now.Add(-time.Second))
+	if until, _ := store.LockedUntil("ip:192.0.2.1"); !until.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected ip to be locked until %s and got %s", now.Add(time.Minute), until)
+	}
+	if until, _ := store.LockedUntil("ip:192.0.2.2"); !until.IsZero() {
+		t.Errorf("expected expired lock to be dropped and got %s", until)
+	}
+}
+
+func TestLoginHandlerThrottle(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher}
+	secret, _ := store.Hasher.Hash("pwned")
+	store.Add(Credentials{Subject: "patata-id", Email: "patata@terno.io", Secret: secret})
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+
+	var lockouts []LockoutEvent
+	attempts := NewMemoryLoginAttemptStore()
+	throttle := &LoginThrottleConfig{
+		Store:              attempts,
+		MaxAccountFailures: 3,
+		FreeFailures:       1,
+		BaseDelay:          time.Hour,
+		MaxDelay:           time.Hour,
+		LockoutDuration:    time.Hour,
+		OnLockout: func(event LockoutEvent) {
+			lockouts = append(lockouts, event)
+		},
+	}
+
+	e := echo.New()
+	e.POST("/login", LoginHandler(AuthenticationConfig{Credentials: store, Issuer: issuer, LoginThrottle: throttle}))
+
+	login := func(pwd string) *httptest.ResponseRecorder {
+		payload := `{"uuid":"patata@terno.io","pwd":"` + pwd + `"}`
+		req := httptest.NewRequest(echo.POST, "/login", bytes.NewBufferString(payload))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		return res
+	}
+
+	//a successful login resets the failures of the account
+	login("wrong")
+	if res := login("pwned"); res.Code != http.StatusOK {
+		t.Errorf("expected status %d and got %d", http.StatusOK, res.Code)
+	}
+	if failures, _, _ := attempts.Failures(throttleKey(ThrottleAccount, "patata@terno.io"), time.Hour); failures != 0 {
+		t.Errorf("expected failures to be reset on success and got %d", failures)
+	}
+
+	if res := login("wrong"); res.Code != http.StatusForbidden {
+		t.Errorf("expected status %d and got %d", http.StatusForbidden, res.Code)
+	}
+	if res := login("wrong"); res.Code != http.StatusForbidden {
+		t.Errorf("expected status %d and got %d", http.StatusForbidden, res.Code)
+	}
+
+	//beyond the free failures the client has to back off, even with the right password
+	res := login("pwned")
+	if res.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d and got %d", http.StatusTooManyRequests, res.Code)
+	}
+	if retry, _ := strconv.Atoi(res.Header().Get("Retry-After")); retry <= 0 || retry > 3600 {
+		t.Errorf("expected Retry-After to be within the backoff delay and got '%s'", res.Header().Get("Retry-After"))
+	}
+
+	//other accounts behind the same IP are not backed off
+	throttle.RecordFailure("pollo@terno.io", "192.0.2.1")
+	if wait, _ := throttle.RetryAfter("boniato@terno.io", "192.0.2.1"); wait != 0 {
+		t.Errorf("expected failures of other accounts not to back off the IP and got %s", wait)
+	}
+
+	//reaching the maximum failures locks the account out
+	attempts.Reset(throttleKey(ThrottleAccount, "patata@terno.io"))
+	attempts.Reset(throttleKey(ThrottleIP, "192.0.2.1"))
+	for i := 0; i < 3; i++ {
+		attempts.RecordFailure(throttleKey(ThrottleAccount, "patata@terno.io"), time.Now().Add(-2*time.Hour), time.Hour)
+	}
+	throttle.RecordFailure("Patata@terno.io", "192.0.2.1")
+	throttle.RecordFailure("Patata@terno.io", "192.0.2.1")
+	throttle.RecordFailure("Patata@terno.io", "192.0.2.1")
+
+	if len(lockouts) != 1 || lockouts[0].Kind != ThrottleAccount || lockouts[0].IP != "192.0.2.1" {
+		t.Fatalf("expected a single account lockout and got %+v", lockouts)
+	}
+	if until, _ := attempts.LockedUntil(throttleKey(ThrottleAccount, "patata@terno.io")); !until.Equal(lockouts[0].Until) {
+		t.Errorf("expected account to be locked until %s and got %s", lockouts[0].Until, until)
+	}
+	if res := login("pwned"); res.Code != http.StatusTooManyRequests {
+		t.Errorf("expected locked account to get status %d and got %d", http.StatusTooManyRequests, res.Code)
+	}
+}
@@ -0,0 +1,55 @@
+package security
+
+import (
+	"sync"
+)
+
+type (
+	// MailMessage is a plain text email sent to a user.
+	MailMessage struct {
+		To      string
+		Subject string
+		Body    string
+	}
+
+	// Mailer abstracts the delivery of the emails sent by the account flows, e.g. password reset links, so services
+	// can plug their SMTP server or mailing provider.
+	Mailer interface {
+		Send(message MailMessage) error
+	}
+)
+
+// MemoryMailer keeps the messages sent instead of delivering them, so they can be read back with Messages.
+type MemoryMailer struct {
+	mutex    sync.Mutex
+	messages []MailMessage
+}
+
+// NewMemoryMailer returns a mailer that has sent nothing yet
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(message MailMessage) error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.messages = append(m.messages, message)
+	return nil
+}
+
+// Messages returns the messages sent to the given address, oldest first
+func (m *MemoryMailer) Messages(to string) []MailMessage {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var messages []MailMessage
+	for _, message := range m.messages {
+		if message.To == to {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
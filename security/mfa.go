@@ -0,0 +1,723 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/guidola/go-utils/database"
+	"github.com/guidola/go-utils/helper"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MFAPendingClaim marks the tokens issued after a successful password check to accounts with two-factor
+// authentication enabled. They are only accepted by the `/login/mfa` endpoint, the jwt middleware rejects them.
+const MFAPendingClaim = "mfa_pending"
+
+// MFAPendingAudience is the only audience of mfa pending tokens, so they are rejected by every JWTConfig not
+// expecting it and by any service checking the audience of the tokens verified against the published JWKS.
+const MFAPendingAudience = "urn:mfa:pending"
+
+// DefaultMFACollection is the collection the default mongo MFA store keeps enrollments on
+const DefaultMFACollection = "mfa"
+
+// ErrMFANotEnrolled is returned by an MFAStore when the subject has no TOTP enrollment
+var ErrMFANotEnrolled = errors.New("subject is not enrolled on two-factor authentication")
+
+type (
+	// MFAConfig defines the config for two-factor authentication. Accounts with a confirmed TOTP enrollment log in
+	// in two steps: `/login` checks the password and responds with a short lived mfa pending token, which
+	// `/login/mfa` exchanges for the actual tokens along with a TOTP or recovery code.
+	MFAConfig struct {
+		// Store holding the TOTP enrollments.
+		// Optional. Default value a MongoMFAStore over DefaultMFACollection.
+		Store MFAStore
+
+		// TOTP setup codes are generated and verified with.
+		// Optional. Default value DefaultTOTP.
+		TOTP *TOTP
+
+		// Issuer name shown by authenticator apps.
+		// Optional. Default value DefaultIssuer.
+		Issuer string
+
+		// AccountName returns the name authenticator apps list the codes of subject under, e.g. its email.
+		// Optional. Default value the subject itself.
+		AccountName func(subject string) string
+
+		// Lifetime of the mfa pending tokens.
+		// Optional. Default value 5 minutes.
+		PendingTokenTTL time.Duration
+
+		// Number of recovery codes handed out when an enrollment is confirmed. Each one can be used once in place of
+		// a TOTP code, e.g. when the device is lost.
+		// Optional. Default value 10.
+		RecoveryCodes int
+
+		// Invalid codes allowed per mfa pending token, which is revoked once they are used up, and per subject within
+		// AttemptsWindow, both on the second login step and when disabling two-factor authentication. Enforced on
+		// top of any LoginThrottle, so logging in again for a fresh mfa pending token does not get more guesses.
+		// Optional. Default value 5.
+		MaxAttempts int
+
+		// Sliding window the invalid codes of each subject are counted over.
+		// Optional. Default value 1 hour.
+		AttemptsWindow time.Duration
+
+		// Store the invalid codes are counted on.
+		// Optional. Default value a RedisLoginAttemptStore.
+		Attempts LoginAttemptStore
+	}
+
+	// MFAEnrollment is the TOTP enrollment of a subject.
+	MFAEnrollment struct {
+		Subject string `bson:"_id"`
+		// Secret shared with the authenticator app. It has to be stored as is to compute the codes.
+		Secret string `bson:"secret"`
+		// Confirmed is set once the subject proves its app generates valid codes. Unconfirmed enrollments are not
+		// required on login.
+		Confirmed bool `bson:"confirmed"`
+		// LastCounter is the TOTP period of the last accepted code, so codes cannot be replayed.
+		LastCounter int64 `bson:"last_counter"`
+		// Hashes of the unused recovery codes.
+		RecoveryCodes []string `bson:"recovery_codes"`
+	}
+
+	// MFAStore abstracts the backend holding the TOTP enrollments.
+	MFAStore interface {
+		// Enrollment returns the enrollment of subject, ErrMFANotEnrolled if there is none.
+		Enrollment(subject string) (MFAEnrollment, error)
+
+		// SaveEnrollment stores enrollment, replacing the one of the same subject.
+		SaveEnrollment(enrollment MFAEnrollment) error
+
+		// DeleteEnrollment removes the enrollment of subject.
+		DeleteEnrollment(subject string) error
+
+		// UseCounter atomically records counter as the last TOTP period used by subject, as long as it is after the
+		// last recorded one. Reports whether it was recorded.
+		UseCounter(subject string, counter int64) (bool, error)
+
+		// UseRecoveryCode atomically removes hash from the recovery codes of subject. Reports whether it was there.
+		UseRecoveryCode(subject string, hash string) (bool, error)
+	}
+
+	mfaPendingResponse struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+
+	mfaLoginRequest struct {
+		MFAToken string `json:"mfa_token" form:"mfa_token"`
+		Code     string `json:"code" form:"code"`
+	}
+
+	mfaCodeRequest struct {
+		Code string `json:"code" form:"code"`
+	}
+
+	totpEnrollmentResponse struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+
+	recoveryCodesResponse struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+)
+
+var (
+	// DefaultMFAConfig is the default two-factor authentication config.
+	DefaultMFAConfig = MFAConfig{
+		TOTP:            &DefaultTOTP,
+		Issuer:          DefaultIssuer,
+		PendingTokenTTL: 5 * time.Minute,
+		RecoveryCodes:   10,
+		MaxAttempts:     5,
+		AttemptsWindow:  time.Hour,
+	}
+)
+
+// withDefaults returns config with its unset fields taken from DefaultMFAConfig
+func (config MFAConfig) withDefaults() MFAConfig {
+	if config.Store == nil {
+		config.Store = NewMongoMFAStore("", DefaultMFACollection)
+	}
+	if config.TOTP == nil {
+		config.TOTP = DefaultMFAConfig.TOTP
+	}
+	if config.Issuer == "" {
+		config.Issuer = DefaultMFAConfig.Issuer
+	}
+	if config.AccountName == nil {
+		config.AccountName = func(subject string) string { return subject }
+	}
+	if config.PendingTokenTTL == 0 {
+		config.PendingTokenTTL = DefaultMFAConfig.PendingTokenTTL
+	}
+	if config.RecoveryCodes == 0 {
+		config.RecoveryCodes = DefaultMFAConfig.RecoveryCodes
+	}
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = DefaultMFAConfig.MaxAttempts
+	}
+	if config.AttemptsWindow == 0 {
+		config.AttemptsWindow = DefaultMFAConfig.AttemptsWindow
+	}
+	if config.Attempts == nil {
+		config.Attempts = NewRedisLoginAttemptStore()
+	}
+	return config
+}
+
+// attemptsLeft reports whether invalid codes on key within window have not used up MaxAttempts
+func (config MFAConfig) attemptsLeft(key string, window time.Duration) (bool, error) {
+	failures, _, err := config.Attempts.Failures(key, window)
+	return failures < config.MaxAttempts, err
+}
+
+// recordInvalidCode counts an invalid code on key and reports whether MaxAttempts within window are used up
+func (config MFAConfig) recordInvalidCode(key string, window time.Duration) (bool, error) {
+	failures, err := config.Attempts.RecordFailure(key, time.Now(), window)
+	return failures >= config.MaxAttempts, err
+}
+
+// isMFAPending reports whether token is an mfa pending token
+func isMFAPending(token jwt.Token) bool {
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if _, ok := claims[MFAPendingClaim]; ok {
+		return true
+	}
+	audiences, _ := stringsClaim(claims, "aud")
+	return helper.ContainsString(audiences, []string{MFAPendingAudience})
+}
+
+// required reports whether subject has to go through the second login step
+func (config MFAConfig) required(subject string) (bool, error) {
+
+	enrollment, err := config.Store.Enrollment(subject)
+	if err == ErrMFANotEnrolled {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return enrollment.Confirmed, nil
+}
+
+// verify checks code, either a TOTP or a recovery code, against the confirmed enrollment of subject and consumes it.
+// recovery tells whether the code accepted was a recovery code.
+func (config MFAConfig) verify(subject string, code string) (ok bool, recovery bool, err error) {
+
+	enrollment, err := config.Store.Enrollment(subject)
+	if err == ErrMFANotEnrolled {
+		return false, false, nil
+	} else if err != nil || !enrollment.Confirmed {
+		return false, false, err
+	}
+
+	counter, ok, err := config.TOTP.Verify(enrollment.Secret, code, time.Now(), enrollment.LastCounter)
+	if err != nil {
+		return false, false, err
+	}
+	if ok {
+		ok, err = config.Store.UseCounter(subject, counter)
+		return ok, false, err
+	}
+
+	ok, err = config.Store.UseRecoveryCode(subject, hashRecoveryCode(code))
+	return ok, ok, err
+}
+
+// recoveryEncoding is the alphabet recovery codes are written with
+var recoveryEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// generateRecoveryCodes returns n random recovery codes formatted as `xxxxx-xxxxx` along with their hashes
+func generateRecoveryCodes(n int) ([]string, []string, error) {
+
+	codes := make([]string, n)
+	hashes := make([]string, n)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := recoveryEncoding.EncodeToString(b)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the hash a recovery code is stored under, ignoring case, spaces and dashes
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// ****************************
+// Two-step login
+// ****************************
+
+// mfaChallenge responds with an mfa pending token for subject, to be exchanged at `/login/mfa`
+func (config MFAConfig) mfaChallenge(c echo.Context, issuer *TokenIssuer, subject string) error {
+
+	claims := map[string]interface{}{MFAPendingClaim: true}
+	token, err := issuer.issue(subject, claims, []string{MFAPendingAudience}, config.PendingTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, mfaPendingResponse{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int64(config.PendingTokenTTL / time.Second),
+	})
+}
+
+// request handler that completes the two-step login using the DefaultAuthenticationConfig
+func HandleMFALoginRequest(c echo.Context) error {
+	return MFALoginHandler(DefaultAuthenticationConfig)(c)
+}
+
+// MFALoginHandler returns a request handler exchanging the mfa pending token given on the `mfa_token` field of the
+// payload, along with a TOTP or recovery code on the `code` field, for the tokens the login handler hands out.
+// Each mfa pending token can only be exchanged once. For invalid tokens or codes it sends "401 - Unauthorized"
+// problem response.
+func MFALoginHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.MFA == nil {
+		config.MFA = &MFAConfig{}
+	}
+	if config.RefreshTokenTTL == 0 {
+		config.RefreshTokenTTL = DefaultRefreshTokenTTL
+	}
+	mfa := config.MFA.withDefaults()
+
+	return func(c echo.Context) error {
+
+		r := new(mfaLoginRequest)
+		if err := c.Bind(r); err != nil {
+			return err
+		}
+		if r.MFAToken == "" || r.Code == "" {
+			return WriteProblem(c, NewProblem(http.StatusBadRequest, CodeInvalidRequest, "missing mfa_token or code"))
+		}
+
+		issuer, err := issuerOrDefault(config.Issuer)
+		if err != nil {
+			return err
+		}
+
+		verifier := issuer.verifier()
+		verifier.Audiences = []string{MFAPendingAudience}
+		token, err := verifier.parseToken(r.MFAToken)
+		if err != nil {
+			problem := tokenProblem(err)
+			emitAuthEvent(config.Audit, c, EventLoginMFA, "", OutcomeFailure, problem.Code)
+			return WriteProblem(c, problem)
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		subject, _ := claims["sub"].(string)
+		id, _ := claims["jti"].(string)
+		if pending, _ := claims[MFAPendingClaim].(bool); !pending || subject == "" || id == "" {
+			emitAuthEvent(config.Audit, c, EventLoginMFA, subject, OutcomeFailure, CodeInvalidClaims)
+			return WriteProblem(c, invalidTokenProblem(CodeInvalidClaims, "not an mfa token"))
+		}
+
+		revocations := revocationStoreOrDefault(config.Revocations)
+		if revoked, err := IsTokenRevoked(revocations, *token); err != nil {
+			log.Warnf("Failed to check mfa token revocation: %s", err.Error())
+			return WriteProblem(c, NewProblem(http.StatusServiceUnavailable, CodeRevocationUnavailable,
+				ErrRevocationUnavailable.Error()))
+		} else if revoked {
+			emitAuthEvent(config.Audit, c, EventLoginMFA, subject, OutcomeFailure, "mfa token already used")
+			return WriteProblem(c, invalidTokenProblem(CodeTokenRevoked, "mfa token is already used"))
+		}
+
+		attempts, subjectAttempts := "mfa_token:"+id, "mfa_login:"+subject
+		if left, err := mfa.attemptsLeft(attempts, mfa.PendingTokenTTL); err != nil {
+			log.Warnf("Failed to check the mfa attempts of %s: %s", subject, err.Error())
+			return err
+		} else if !left {
+			emitAuthEvent(config.Audit, c, EventLoginMFA, subject, OutcomeFailure, "too many attempts")
+			return WriteProblem(c, invalidTokenProblem(CodeTokenRevoked, "mfa token is used up"))
+		}
+		if left, err := mfa.attemptsLeft(subjectAttempts, mfa.AttemptsWindow); err != nil {
+			log.Warnf("Failed to check the mfa attempts of %s: %s", subject, err.Error())
+			return err
+		} else if !left {
+			emitAuthEvent(config.Audit, c, EventLoginMFA, subject, OutcomeFailure, "too many attempts")
+			return WriteProblem(c, NewProblem(http.StatusTooManyRequests, CodeTooManyRequests, "too many invalid codes, retry later"))
+		}
+
+		identifier := "mfa:" + subject
+		if config.LoginThrottle != nil {
+			if err := config.LoginThrottle.throttleLogin(c, identifier); err != nil {
+				emitAuthEvent(config.Audit, c, EventLoginMFA, subject, OutcomeFailure, "too many attempts")
+				return respondWithProblem(c, err)
+			}
+		}
+
+		ok, recovery, err := mfa.verify(subject, r.Code)
+		if err != nil {
+			log.Warnf("Failed to verify the mfa code of %s: %s", subject, err.Error())
+			return err
+		}
+		if recovery {
+			emitAuthEvent(config.Audit, c, EventRecoveryCodeUsed, subject, OutcomeSuccess, EventLoginMFA)
+		}
+		if config.LoginThrottle != nil {
+			config.LoginThrottle.recordAttempt(identifier, c.RealIP(), ok)
+		}
+		if !ok {
+			emitAuthEvent(config.Audit, c, EventLoginMFA, subject, OutcomeFailure, "invalid code")
+			if _, err := mfa.recordInvalidCode(subjectAttempts, mfa.AttemptsWindow); err != nil {
+				log.Warnf("Failed to record the mfa attempt of %s: %s", subject, err.Error())
+			}
+			exhausted, err := mfa.recordInvalidCode(attempts, mfa.PendingTokenTTL)
+			if err != nil {
+				log.Warnf("Failed to record the mfa attempt of %s: %s", subject, err.Error())
+			}
+			if exhausted || err != nil {
+				if err := RevokeToken(revocations, *token); err != nil {
+					log.Warnf("Failed to revoke mfa token: %s", err.Error())
+				}
+			}
+			return WriteProblem(c, NewProblem(http.StatusUnauthorized, CodeInvalidMFACode, "invalid code"))
+		}
+
+		if err := RevokeToken(revocations, *token); err != nil {
+			log.Warnf("Failed to revoke mfa token: %s", err.Error())
+		}
+		if err := mfa.Attempts.Reset(subjectAttempts); err != nil {
+			log.Warnf("Failed to reset the mfa attempts of %s: %s", subject, err.Error())
+		}
+		if err := respondWithTokens(c, config, issuer, subject); err != nil {
+			return err
+		}
+		emitAuthEvent(config.Audit, c, EventLoginMFA, subject, OutcomeSuccess, "")
+		return nil
+	}
+}
+
+// ****************************
+// TOTP enrollment
+// ****************************
+
+// TOTPEnrollHandler returns a request handler that starts the TOTP enrollment of the authenticated subject,
+// responding with a new secret and its otpauth:// URI. The enrollment is not required on login until confirmed
+// with TOTPConfirmHandler. Subjects with a confirmed enrollment get "409 - Conflict" problem response.
+// It must be mounted behind the jwt middleware.
+func TOTPEnrollHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.MFA == nil {
+		config.MFA = &MFAConfig{}
+	}
+	mfa := config.MFA.withDefaults()
+
+	return func(c echo.Context) error {
+
+		claims, ok := ClaimsFromContext(c)
+		if !ok || claims.Subject == "" {
+			return WriteProblem(c, missingTokenProblem())
+		}
+
+		enrolled, err := mfa.required(claims.Subject)
+		if err != nil {
+			return err
+		}
+		if enrolled {
+			return WriteProblem(c, NewProblem(http.StatusConflict, CodeConflict, "two-factor authentication is already enabled"))
+		}
+
+		secret, err := GenerateTOTPSecret()
+		if err != nil {
+			return err
+		}
+		if err := mfa.Store.SaveEnrollment(MFAEnrollment{Subject: claims.Subject, Secret: secret}); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, totpEnrollmentResponse{
+			Secret: secret,
+			URI:    mfa.TOTP.URI(secret, mfa.Issuer, mfa.AccountName(claims.Subject)),
+		})
+	}
+}
+
+// TOTPConfirmHandler returns a request handler that confirms the pending TOTP enrollment of the authenticated
+// subject with the code given on the `code` field of the payload, enabling two-factor authentication. It responds
+// with the recovery codes of the subject, which are not shown again.
+// It must be mounted behind the jwt middleware.
+func TOTPConfirmHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.MFA == nil {
+		config.MFA = &MFAConfig{}
+	}
+	mfa := config.MFA.withDefaults()
+
+	return func(c echo.Context) error {
+
+		claims, ok := ClaimsFromContext(c)
+		if !ok || claims.Subject == "" {
+			return WriteProblem(c, missingTokenProblem())
+		}
+
+		r := new(mfaCodeRequest)
+		if err := c.Bind(r); err != nil {
+			return err
+		}
+
+		enrollment, err := mfa.Store.Enrollment(claims.Subject)
+		if err == ErrMFANotEnrolled {
+			return WriteProblem(c, NewProblem(http.StatusNotFound, CodeNotFound, "no pending two-factor enrollment"))
+		} else if err != nil {
+			return err
+		}
+		if enrollment.Confirmed {
+			return WriteProblem(c, NewProblem(http.StatusConflict, CodeConflict, "two-factor authentication is already enabled"))
+		}
+
+		counter, ok, err := mfa.TOTP.Verify(enrollment.Secret, r.Code, time.Now(), enrollment.LastCounter)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			emitAuthEvent(config.Audit, c, EventTOTPEnroll, claims.Subject, OutcomeFailure, "invalid code")
+			return WriteProblem(c, NewProblem(http.StatusForbidden, CodeInvalidMFACode, "invalid code"))
+		}
+
+		codes, hashes, err := generateRecoveryCodes(mfa.RecoveryCodes)
+		if err != nil {
+			return err
+		}
+
+		enrollment.Confirmed = true
+		enrollment.LastCounter = counter
+		enrollment.RecoveryCodes = hashes
+		if err := mfa.Store.SaveEnrollment(enrollment); err != nil {
+			return err
+		}
+
+		emitAuthEvent(config.Audit, c, EventTOTPEnroll, claims.Subject, OutcomeSuccess, "")
+		return c.JSON(http.StatusOK, recoveryCodesResponse{RecoveryCodes: codes})
+	}
+}
+
+// TOTPDisableHandler returns a request handler that disables two-factor authentication for the authenticated
+// subject, given a valid TOTP or recovery code on the `code` field of the payload.
+// It must be mounted behind the jwt middleware.
+func TOTPDisableHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.MFA == nil {
+		config.MFA = &MFAConfig{}
+	}
+	mfa := config.MFA.withDefaults()
+
+	return func(c echo.Context) error {
+
+		claims, ok := ClaimsFromContext(c)
+		if !ok || claims.Subject == "" {
+			return WriteProblem(c, missingTokenProblem())
+		}
+
+		r := new(mfaCodeRequest)
+		if err := c.Bind(r); err != nil {
+			return err
+		}
+
+		attempts := "mfa_disable:" + claims.Subject
+		if left, err := mfa.attemptsLeft(attempts, mfa.AttemptsWindow); err != nil {
+			return err
+		} else if !left {
+			return WriteProblem(c, NewProblem(http.StatusTooManyRequests, CodeTooManyRequests, "too many invalid codes, retry later"))
+		}
+
+		ok, recovery, err := mfa.verify(claims.Subject, r.Code)
+		if err != nil {
+			return err
+		}
+		if recovery {
+			emitAuthEvent(config.Audit, c, EventRecoveryCodeUsed, claims.Subject, OutcomeSuccess, EventTOTPDisable)
+		}
+		if !ok {
+			emitAuthEvent(config.Audit, c, EventTOTPDisable, claims.Subject, OutcomeFailure, "invalid code")
+			if _, err := mfa.recordInvalidCode(attempts, mfa.AttemptsWindow); err != nil {
+				return err
+			}
+			return WriteProblem(c, NewProblem(http.StatusForbidden, CodeInvalidMFACode, "invalid code"))
+		}
+
+		if err := mfa.Store.DeleteEnrollment(claims.Subject); err != nil {
+			return err
+		}
+		emitAuthEvent(config.Audit, c, EventTOTPDisable, claims.Subject, OutcomeSuccess, "")
+		return c.JSON(http.StatusOK, nil)
+	}
+}
+
+// ****************************
+// MongoDB MFA store
+// ****************************
+
+// MongoMFAStore keeps TOTP enrollments on a mongo collection through the global database.Mongo instance, one
+// document per subject.
+type MongoMFAStore struct {
+	// Database holding the collection. When empty the database of the dialed session is used.
+	Database string
+	// Collection holding the enrollments.
+	Collection string
+}
+
+// NewMongoMFAStore returns an MFA store backed by the given mongo database and collection
+func NewMongoMFAStore(db string, collection string) *MongoMFAStore {
+	return &MongoMFAStore{Database: db, Collection: collection}
+}
+
+func (s *MongoMFAStore) Enrollment(subject string) (MFAEnrollment, error) {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	var enrollment MFAEnrollment
+	err := mg.DB(s.Database).C(s.Collection).FindId(subject).One(&enrollment)
+	if err == mgo.ErrNotFound {
+		return MFAEnrollment{}, ErrMFANotEnrolled
+	}
+	return enrollment, err
+}
+
+func (s *MongoMFAStore) SaveEnrollment(enrollment MFAEnrollment) error {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	_, err := mg.DB(s.Database).C(s.Collection).UpsertId(enrollment.Subject, enrollment)
+	return err
+}
+
+func (s *MongoMFAStore) DeleteEnrollment(subject string) error {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	err := mg.DB(s.Database).C(s.Collection).RemoveId(subject)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func (s *MongoMFAStore) UseCounter(subject string, counter int64) (bool, error) {
+	return s.update(bson.M{"_id": subject, "last_counter": bson.M{"$lt": counter}},
+		bson.M{"$set": bson.M{"last_counter": counter}})
+}
+
+func (s *MongoMFAStore) UseRecoveryCode(subject string, hash string) (bool, error) {
+	return s.update(bson.M{"_id": subject, "recovery_codes": hash}, bson.M{"$pull": bson.M{"recovery_codes": hash}})
+}
+
+// update applies change to the document matching selector, reporting whether there was one
+func (s *MongoMFAStore) update(selector bson.M, change bson.M) (bool, error) {
+
+	mg := database.GetMongoInstance().GetCopy()
+	defer mg.Close()
+
+	err := mg.DB(s.Database).C(s.Collection).Update(selector, change)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ****************************
+// In memory MFA store
+// ****************************
+
+// MemoryMFAStore keeps TOTP enrollments in memory, one per subject.
+type MemoryMFAStore struct {
+	mutex       sync.Mutex
+	enrollments map[string]MFAEnrollment
+}
+
+// NewMemoryMFAStore returns an empty in memory MFA store
+func NewMemoryMFAStore() *MemoryMFAStore {
+	return &MemoryMFAStore{enrollments: map[string]MFAEnrollment{}}
+}
+
+func (s *MemoryMFAStore) Enrollment(subject string) (MFAEnrollment, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	enrollment, ok := s.enrollments[subject]
+	if !ok {
+		return MFAEnrollment{}, ErrMFANotEnrolled
+	}
+	enrollment.RecoveryCodes = append([]string(nil), enrollment.RecoveryCodes...)
+	return enrollment, nil
+}
+
+func (s *MemoryMFAStore) SaveEnrollment(enrollment MFAEnrollment) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	enrollment.RecoveryCodes = append([]string(nil), enrollment.RecoveryCodes...)
+	s.enrollments[enrollment.Subject] = enrollment
+	return nil
+}
+
+func (s *MemoryMFAStore) DeleteEnrollment(subject string) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.enrollments, subject)
+	return nil
+}
+
+func (s *MemoryMFAStore) UseCounter(subject string, counter int64) (bool, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	enrollment, ok := s.enrollments[subject]
+	if !ok || counter <= enrollment.LastCounter {
+		return false, nil
+	}
+	enrollment.LastCounter = counter
+	s.enrollments[subject] = enrollment
+	return true, nil
+}
+
+func (s *MemoryMFAStore) UseRecoveryCode(subject string, hash string) (bool, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	enrollment, ok := s.enrollments[subject]
+	if !ok {
+		return false, nil
+	}
+	for i, stored := range enrollment.RecoveryCodes {
+		if secretsMatch(stored, hash) {
+			enrollment.RecoveryCodes = append(enrollment.RecoveryCodes[:i:i], enrollment.RecoveryCodes[i+1:]...)
+			s.enrollments[subject] = enrollment
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,255 @@
+package security
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+func TestMemoryMFAStore(t *testing.T) {
+
+	store := NewMemoryMFAStore()
+	if _, err := store.Enrollment("patata-id"); err != ErrMFANotEnrolled {
+		t.Errorf("expected error %v and got %v", ErrMFANotEnrolled, err)
+	}
+
+	store.SaveEnrollment(MFAEnrollment{Subject: "patata-id", Secret: "JBSWY3DPEHPK3PXP", LastCounter: 10,
+		RecoveryCodes: []string{hashRecoveryCode("aaaaa-bbbbb")}})
+
+	var test_cases = []struct {
+		counter int64
+		ok      bool
+	}{
+		{9, false},
+		{10, false},
+		{11, true},
+		{11, false},
+	}
+
+	for _, test_case := range test_cases {
+		if ok, _ := store.UseCounter("patata-id", test_case.counter); ok != test_case.ok {
+			t.Errorf("expected counter %d to be used %t and got %t", test_case.counter, test_case.ok, ok)
+		}
+	}
+
+	if ok, _ := store.UseRecoveryCode("patata-id", hashRecoveryCode("AAAAA BBBBB")); !ok {
+		t.Errorf("expected recovery code to be accepted regardless of case and separators")
+	}
+	if ok, _ := store.UseRecoveryCode("patata-id", hashRecoveryCode("aaaaa-bbbbb")); ok {
+		t.Errorf("expected recovery code to be single use")
+	}
+}
+
+func TestMFALogin(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher}
+	secret, _ := store.Hasher.Hash("pwned")
+	store.Add(Credentials{Subject: "patata-id", Email: "patata@terno.io", Secret: secret})
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+
+	config := AuthenticationConfig{
+		Credentials: store,
+		Issuer:      issuer,
+		Revocations: NewMemoryRevocationStore(),
+		MFA:         &MFAConfig{Store: NewMemoryMFAStore(), RecoveryCodes: 2, Attempts: NewMemoryLoginAttemptStore()},
+	}
+
+	e := echo.New()
+	e.Use(JWTWithConfig(JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256,
+		Revocations: NewMemoryRevocationStore()}))
+	LoadAuthenticationRoutesWithConfig(e, config)
+
+	request := func(method string, path string, token string, payload interface{}, response interface{}) int {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		if response != nil {
+			json.Unmarshal(res.Body.Bytes(), response)
+		}
+		return res.Code
+	}
+	credentials := LoginRequest{Uuid: "patata@terno.io", Pwd: "pwned"}
+
+	//without enrollment the password is enough
+	var token string
+	if code := request(echo.POST, "/login", "", credentials, &token); code != http.StatusOK || token == "" {
+		t.Fatalf("expected status %d and a token and got %d", http.StatusOK, code)
+	}
+
+	var enrollment totpEnrollmentResponse
+	if code := request(echo.POST, "/mfa/totp", token, nil, &enrollment); code != http.StatusOK || enrollment.Secret == "" {
+		t.Fatalf("expected status %d and a secret and got %d", http.StatusOK, code)
+	}
+
+	//an unconfirmed enrollment is not required on login
+	if code := request(echo.POST, "/login", "", credentials, &token); code != http.StatusOK || token == "" {
+		t.Fatalf("expected status %d and a token and got %d", http.StatusOK, code)
+	}
+
+	now, _ := DefaultTOTP.Code(enrollment.Secret, time.Now())
+	next, _ := DefaultTOTP.Code(enrollment.Secret, time.Now().Add(30*time.Second))
+
+	if code := request(echo.POST, "/mfa/totp/confirm", token, mfaCodeRequest{Code: "000000x"}, nil); code != http.StatusForbidden {
+		t.Errorf("expected invalid code to get status %d and got %d", http.StatusForbidden, code)
+	}
+	var recovery recoveryCodesResponse
+	if code := request(echo.POST, "/mfa/totp/confirm", token, mfaCodeRequest{Code: now}, &recovery); code != http.StatusOK || len(recovery.RecoveryCodes) != 2 {
+		t.Fatalf("expected status %d and 2 recovery codes and got %d, %v", http.StatusOK, code, recovery.RecoveryCodes)
+	}
+	if code := request(echo.POST, "/mfa/totp", token, nil, nil); code != http.StatusConflict {
+		t.Errorf("expected enrolling twice to get status %d and got %d", http.StatusConflict, code)
+	}
+
+	//the password step only hands out an mfa pending token
+	var pending mfaPendingResponse
+	if code := request(echo.POST, "/login", "", credentials, &pending); code != http.StatusOK || !pending.MFARequired || pending.MFAToken == "" {
+		t.Fatalf("expected status %d and an mfa pending token and got %d, %+v", http.StatusOK, code, pending)
+	}
+	if code := request(echo.POST, "/mfa/totp", pending.MFAToken, nil, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected mfa pending token to get status %d on other routes and got %d", http.StatusUnauthorized, code)
+	}
+	if code := request(echo.POST, "/login/mfa", "", mfaLoginRequest{MFAToken: token, Code: next}, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected access token to get status %d on /login/mfa and got %d", http.StatusUnauthorized, code)
+	}
+
+	var test_cases = []struct {
+		code   string
+		status int
+	}{
+		{now, http.StatusUnauthorized}, //replayed, it was used to confirm the enrollment
+		{"123", http.StatusUnauthorized},
+		{next, http.StatusOK},
+	}
+
+	for _, test_case := range test_cases {
+		token = ""
+		code := request(echo.POST, "/login/mfa", "", mfaLoginRequest{MFAToken: pending.MFAToken, Code: test_case.code}, &token)
+		if code != test_case.status {
+			t.Errorf("expected code '%s' to get status %d and got %d", test_case.code, test_case.status, code)
+		}
+	}
+	if token == "" {
+		t.Errorf("expected a token once the second step succeeded")
+	}
+
+	//each mfa pending token is exchanged once, recovery codes are used once
+	if code := request(echo.POST, "/login/mfa", "", mfaLoginRequest{MFAToken: pending.MFAToken, Code: recovery.RecoveryCodes[0]}, nil); code != http.StatusUnauthorized {
+		t.Errorf("expected exchanged mfa token to get status %d and got %d", http.StatusUnauthorized, code)
+	}
+	for _, status := range []int{http.StatusOK, http.StatusUnauthorized} {
+		request(echo.POST, "/login", "", credentials, &pending)
+		if code := request(echo.POST, "/login/mfa", "", mfaLoginRequest{MFAToken: pending.MFAToken, Code: recovery.RecoveryCodes[0]}, nil); code != status {
+			t.Errorf("expected recovery code to get status %d and got %d", status, code)
+		}
+	}
+
+	//disabling requires a valid code
+	if code := request(echo.DELETE, "/mfa/totp", token, mfaCodeRequest{Code: recovery.RecoveryCodes[1]}, nil); code != http.StatusOK {
+		t.Errorf("expected status %d and got %d", http.StatusOK, code)
+	}
+	if code := request(echo.POST, "/login", "", credentials, &token); code != http.StatusOK || token == "" {
+		t.Errorf("expected status %d and a token once disabled and got %d", http.StatusOK, code)
+	}
+}
+
+func TestMFAAttempts(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher}
+	secret, _ := store.Hasher.Hash("pwned")
+	store.Add(Credentials{Subject: "patata-id", Email: "patata@terno.io", Secret: secret})
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+	enrollments := NewMemoryMFAStore()
+	totpSecret, _ := GenerateTOTPSecret()
+	enrollments.SaveEnrollment(MFAEnrollment{Subject: "patata-id", Secret: totpSecret, Confirmed: true})
+
+	e := echo.New()
+	e.Use(JWTWithConfig(JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256,
+		Revocations: NewMemoryRevocationStore()}))
+	LoadAuthenticationRoutesWithConfig(e, AuthenticationConfig{
+		Credentials: store,
+		Issuer:      issuer,
+		Revocations: NewMemoryRevocationStore(),
+		MFA:         &MFAConfig{Store: enrollments, MaxAttempts: 3, Attempts: NewMemoryLoginAttemptStore()},
+	})
+
+	request := func(method string, path string, token string, payload interface{}, response interface{}) int {
+		body, _ := json.Marshal(payload)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		if response != nil {
+			json.Unmarshal(res.Body.Bytes(), response)
+		}
+		return res.Code
+	}
+
+	var pending mfaPendingResponse
+	request(echo.POST, "/login", "", LoginRequest{Uuid: "patata@terno.io", Pwd: "pwned"}, &pending)
+
+	//mfa pending tokens are not access tokens anywhere but on the second login step
+	if _, err := issuer.verifier().parseToken(pending.MFAToken); !errors.Is(err, ErrMFAPendingToken) {
+		t.Errorf("expected verifying the mfa token as an access token to fail with %v and got %v", ErrMFAPendingToken, err)
+	}
+	parsed, _ := new(jwt.Parser).Parse(pending.MFAToken, func(*jwt.Token) (interface{}, error) { return testHMACSecret, nil })
+	if valid, _ := CheckJWT(*parsed); valid {
+		t.Errorf("expected CheckJWT to reject the mfa pending token")
+	}
+
+	//the token is revoked once its attempts are used up, even without a login throttle
+	code, _ := DefaultTOTP.Code(totpSecret, time.Now())
+	for i, test_case := range []struct {
+		code   string
+		status int
+	}{
+		{"000000", http.StatusUnauthorized},
+		{"000001", http.StatusUnauthorized},
+		{"000002", http.StatusUnauthorized},
+		{code, http.StatusUnauthorized},
+	} {
+		if status := request(echo.POST, "/login/mfa", "", mfaLoginRequest{MFAToken: pending.MFAToken, Code: test_case.code}, nil); status != test_case.status {
+			t.Errorf("case %d: expected status %d and got %d", i, test_case.status, status)
+		}
+	}
+
+	//logging in again for a fresh mfa pending token does not get more guesses
+	for i := 0; i < 2; i++ {
+		request(echo.POST, "/login", "", LoginRequest{Uuid: "patata@terno.io", Pwd: "pwned"}, &pending)
+		if status := request(echo.POST, "/login/mfa", "", mfaLoginRequest{MFAToken: pending.MFAToken, Code: code}, nil); status != http.StatusTooManyRequests {
+			t.Errorf("login %d: expected the second factor of the subject to be locked and got status %d", i, status)
+		}
+	}
+
+	//disabling is capped too
+	token, _ := issuer.Issue("patata-id", nil)
+	for i, test_case := range []struct {
+		code   string
+		status int
+	}{
+		{"000000", http.StatusForbidden},
+		{"000001", http.StatusForbidden},
+		{"000002", http.StatusForbidden},
+		{code, http.StatusTooManyRequests},
+	} {
+		if status := request(echo.DELETE, "/mfa/totp", token, mfaCodeRequest{Code: test_case.code}, nil); status != test_case.status {
+			t.Errorf("case %d: expected disabling to get status %d and got %d", i, test_case.status, status)
+		}
+	}
+}
@@ -0,0 +1,696 @@
+package security
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/guidola/go-utils/database"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// DefaultOAuthStateCookie is the cookie binding an authorization request to the browser that started it
+const DefaultOAuthStateCookie = "oauth_state"
+
+var (
+	// ErrUnknownProvider is returned for identity providers missing from the OAuthConfig
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	// ErrInvalidOAuthState is returned for callbacks whose state is unknown, expired, already used or does not
+	// belong to the browser completing the flow
+	ErrInvalidOAuthState = errors.New("invalid oauth state")
+	// ErrInvalidIDToken is returned when the ID token of a provider does not verify
+	ErrInvalidIDToken = errors.New("invalid id token")
+	// ErrIdentityLinked is returned when linking an external identity already linked to another account
+	ErrIdentityLinked = errors.New("identity is already linked to another account")
+)
+
+type (
+	// OAuthConfig defines the config for the social login through external OpenID Connect providers, using the
+	// authorization code flow with PKCE. Users are sent to `/login/oauth/:provider`, come back to
+	// `/login/oauth/:provider/callback` and get the tokens the login handler hands out to the account linked to
+	// their identity at the provider. Authenticated users link new identities through `/login/oauth/:provider/link`.
+	OAuthConfig struct {
+		// Providers users can sign in with.
+		// Required.
+		Providers []*OIDCProvider
+
+		// Store keeping the authorization requests in flight.
+		// Optional. Default value a RedisOAuthStateStore.
+		States OAuthStateStore
+
+		// How long users have to complete the flow at the provider.
+		// Optional. Default value 10 minutes.
+		StateTTL time.Duration
+
+		// LinkVerifiedEmail links unknown identities to the account with the same email, as long as both the provider
+		// and the account state the email is verified, so an account registered with someone else's email cannot
+		// take over their identity. Only enable it for providers whose email verification is trusted.
+		// Optional. Default value false.
+		LinkVerifiedEmail bool
+
+		// RegisterUnknown registers a new account for identities not linked to any account, using the email of the
+		// ID token and a random password. It requires a credential store implementing CredentialRegistrar.
+		// Optional. Default value false, unknown identities get "403 - Forbidden" response.
+		RegisterUnknown bool
+
+		// Name of the cookie binding each authorization request to the browser that started it.
+		// Optional. Default value DefaultOAuthStateCookie.
+		StateCookie string
+
+		// InsecureStateCookie lets the state cookie be sent over plain http. Only meant for local development.
+		// Optional. Default value false, the cookie is Secure.
+		InsecureStateCookie bool
+	}
+
+	// OIDCProvider is an OpenID Connect identity provider. Its endpoints are discovered from the
+	// `/.well-known/openid-configuration` document of Issuer unless they are all set.
+	OIDCProvider struct {
+		// Name identifying the provider on the routes and linked identities, e.g. "google".
+		// Required.
+		Name string
+
+		// Issuer identifier of the provider, matched against the `iss` claim of its ID tokens.
+		// Required.
+		Issuer string
+
+		// Credentials of the client registered at the provider.
+		// Required.
+		ClientID     string
+		ClientSecret string
+
+		// RedirectURL registered at the provider, pointing to the callback route of the provider.
+		// Required.
+		RedirectURL string
+
+		// Scopes requested to the provider.
+		// Optional. Default value "openid", "email" and "profile".
+		Scopes []string
+
+		// Endpoints of the provider.
+		// Optional. Default value the ones discovered from Issuer.
+		AuthorizationEndpoint string
+		TokenEndpoint         string
+		JWKSURL               string
+
+		// Client used to reach the provider.
+		// Optional. Default value a client with a 10 seconds timeout.
+		Client *http.Client
+
+		mutex sync.Mutex
+		keys  *RemoteKeySet
+	}
+
+	// IdentityLinker is implemented by credential stores able to link identities at external providers to their
+	// accounts.
+	IdentityLinker interface {
+		// LookupIdentity returns the credentials of the account linked to subject at provider. ErrUnknownAccount
+		// is returned if there is no such account.
+		LookupIdentity(provider string, subject string) (Credentials, error)
+
+		// LinkIdentity links subject at provider to the account identified by account.
+		LinkIdentity(account string, provider string, subject string) error
+	}
+
+	// OAuthState is an authorization request in flight.
+	OAuthState struct {
+		Provider string `json:"provider"`
+		Nonce    string `json:"nonce"`
+		Verifier string `json:"verifier"`
+		// Account the identity gets linked to, empty when signing in.
+		Account string `json:"account,omitempty"`
+	}
+
+	// OAuthStateStore abstracts the backend keeping the authorization requests in flight.
+	OAuthStateStore interface {
+		// Save stores state under key for ttl.
+		Save(key string, state OAuthState, ttl time.Duration) error
+
+		// Take removes and returns the state stored under key, reporting whether there was one, so each one can
+		// only be used once.
+		Take(key string) (OAuthState, bool, error)
+	}
+
+	// IDToken holds the claims of a verified ID token used to link identities to accounts.
+	IDToken struct {
+		Subject       string
+		Email         string
+		EmailVerified bool
+	}
+
+	oidcDiscovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+
+	oidcTokenResponse struct {
+		IDToken string `json:"id_token"`
+	}
+)
+
+var defaultOIDCClient = &http.Client{Timeout: 10 * time.Second}
+
+// withDefaults returns config with its unset fields set to the defaults
+func (config OAuthConfig) withDefaults() OAuthConfig {
+	if config.States == nil {
+		config.States = NewRedisOAuthStateStore()
+	}
+	if config.StateTTL == 0 {
+		config.StateTTL = 10 * time.Minute
+	}
+	if config.StateCookie == "" {
+		config.StateCookie = DefaultOAuthStateCookie
+	}
+	return config
+}
+
+// provider returns the provider called name
+func (config OAuthConfig) provider(name string) (*OIDCProvider, error) {
+	for _, provider := range config.Providers {
+		if provider.Name == name {
+			return provider, nil
+		}
+	}
+	return nil, ErrUnknownProvider
+}
+
+// ****************************
+// OpenID Connect provider
+// ****************************
+
+// discover fills the endpoints of the provider that are not set from its discovery document, once
+func (p *OIDCProvider) discover() error {
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.keys != nil {
+		return nil
+	}
+
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURL == "" {
+		location := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+		res, err := p.client().Get(location)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %d fetching %s", res.StatusCode, location)
+		}
+
+		var discovery oidcDiscovery
+		if err := json.NewDecoder(res.Body).Decode(&discovery); err != nil {
+			return fmt.Errorf("malformed discovery document at %s: %s", location, err.Error())
+		}
+		if discovery.Issuer != p.Issuer {
+			return fmt.Errorf("discovery document at %s is for issuer %s", location, discovery.Issuer)
+		}
+
+		if p.AuthorizationEndpoint == "" {
+			p.AuthorizationEndpoint = discovery.AuthorizationEndpoint
+		}
+		if p.TokenEndpoint == "" {
+			p.TokenEndpoint = discovery.TokenEndpoint
+		}
+		if p.JWKSURL == "" {
+			p.JWKSURL = discovery.JWKSURI
+		}
+	}
+
+	p.keys = &RemoteKeySet{URL: p.JWKSURL, Client: p.Client}
+	return nil
+}
+
+func (p *OIDCProvider) client() *http.Client {
+	if p.Client == nil {
+		return defaultOIDCClient
+	}
+	return p.Client
+}
+
+// AuthCodeURL returns the URL of the provider users are sent to, carrying state, nonce and the S256 PKCE challenge
+// of verifier
+func (p *OIDCProvider) AuthCodeURL(state string, nonce string, verifier string) (string, error) {
+
+	if err := p.discover(); err != nil {
+		return "", err
+	}
+
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", strings.Join(scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", pkceChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems the authorization code for the tokens of the user, proving the request was started with
+// verifier, and returns the claims of its verified ID token
+func (p *OIDCProvider) Exchange(code string, verifier string, nonce string) (IDToken, error) {
+
+	if err := p.discover(); err != nil {
+		return IDToken{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return IDToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	res, err := p.client().Do(req)
+	if err != nil {
+		return IDToken{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return IDToken{}, fmt.Errorf("unexpected status %d redeeming code at %s", res.StatusCode, p.TokenEndpoint)
+	}
+
+	var tokens oidcTokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&tokens); err != nil {
+		return IDToken{}, fmt.Errorf("malformed token response from %s: %s", p.TokenEndpoint, err.Error())
+	}
+
+	return p.VerifyIDToken(tokens.IDToken, nonce)
+}
+
+// VerifyIDToken checks the signature of an ID token against the keys of the provider along with its issuer,
+// audience, lifetime and nonce, and returns its claims
+func (p *OIDCProvider) VerifyIDToken(idToken string, nonce string) (IDToken, error) {
+
+	if err := p.discover(); err != nil {
+		return IDToken{}, err
+	}
+
+	config := JWTConfig{
+		KeyResolver:    p.keys,
+		Issuers:        []string{p.Issuer},
+		Audiences:      []string{p.ClientID},
+		RequiredClaims: []string{"sub", "exp", "iat"},
+		Leeway:         time.Minute,
+	}
+	token, err := config.parseToken(idToken)
+	if err != nil {
+		return IDToken{}, fmt.Errorf("%w: %s", ErrInvalidIDToken, err.Error())
+	}
+
+	claims := token.Claims.(jwt.MapClaims)
+	if given, _ := claims["nonce"].(string); !secretsMatch(nonce, given) {
+		return IDToken{}, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.ClientID {
+		return IDToken{}, fmt.Errorf("%w: authorized party %s", ErrInvalidIDToken, azp)
+	}
+
+	id := IDToken{}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claims["email"].(string)
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		id.EmailVerified = verified
+	case string:
+		id.EmailVerified = verified == "true"
+	}
+	if id.Subject == "" {
+		return IDToken{}, fmt.Errorf("%w: %s", ErrMalformedClaim, "sub")
+	}
+
+	return id, nil
+}
+
+// pkceChallenge returns the S256 code challenge of verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// ****************************
+// Request handlers
+// ****************************
+
+// OAuthStartHandler returns a request handler that redirects users to the provider named on the `provider` path
+// parameter to sign in.
+func OAuthStartHandler(config AuthenticationConfig) echo.HandlerFunc {
+	return oauthStartHandler(config, false)
+}
+
+// OAuthLinkHandler returns a request handler that redirects the authenticated user to the provider named on the
+// `provider` path parameter, linking the identity it signs in with to its account on callback.
+// It must be mounted behind the jwt middleware.
+func OAuthLinkHandler(config AuthenticationConfig) echo.HandlerFunc {
+	return oauthStartHandler(config, true)
+}
+
+func oauthStartHandler(config AuthenticationConfig, link bool) echo.HandlerFunc {
+	// Defaults
+	if config.OAuth == nil {
+		config.OAuth = &OAuthConfig{}
+	}
+	oauth := config.OAuth.withDefaults()
+
+	return func(c echo.Context) error {
+
+		provider, err := oauth.provider(c.Param("provider"))
+		if err != nil {
+			return WriteProblem(c, NewProblem(http.StatusNotFound, CodeNotFound, err.Error()))
+		}
+
+		state := OAuthState{Provider: provider.Name}
+		if link {
+			claims, ok := ClaimsFromContext(c)
+			if !ok || claims.Subject == "" {
+				return WriteProblem(c, missingTokenProblem())
+			}
+			state.Account = claims.Subject
+		}
+
+		key, err := randomString(32)
+		if err != nil {
+			return err
+		}
+		if state.Nonce, err = randomString(16); err != nil {
+			return err
+		}
+		if state.Verifier, err = randomString(32); err != nil {
+			return err
+		}
+
+		location, err := provider.AuthCodeURL(key, state.Nonce, state.Verifier)
+		if err != nil {
+			log.Warnf("Failed to reach identity provider %s: %s", provider.Name, err.Error())
+			return WriteProblem(c, NewProblem(http.StatusBadGateway, CodeProviderUnavailable, "identity provider unavailable"))
+		}
+		if err := oauth.States.Save(key, state, oauth.StateTTL); err != nil {
+			return err
+		}
+
+		c.SetCookie(&http.Cookie{
+			Name:     oauth.StateCookie,
+			Value:    key,
+			Path:     "/login/oauth/",
+			MaxAge:   int(oauth.StateTTL / time.Second),
+			Secure:   !oauth.InsecureStateCookie,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		return c.Redirect(http.StatusFound, location)
+	}
+}
+
+// OAuthCallbackHandler returns the request handler providers redirect users back to. It checks the state of the
+// request, redeems the authorization code and verifies the ID token of the user, then responds like the login
+// handler for the account linked to its identity, or links the identity when the flow was started to do so.
+// Identities not linked to any account get "403 - Forbidden" problem response, unless config allows linking them by
+// email or registering them.
+func OAuthCallbackHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.OAuth == nil {
+		config.OAuth = &OAuthConfig{}
+	}
+	if config.Credentials == nil {
+		config.Credentials = DefaultAuthenticationConfig.Credentials
+	}
+	if config.RefreshTokenTTL == 0 {
+		config.RefreshTokenTTL = DefaultRefreshTokenTTL
+	}
+	oauth := config.OAuth.withDefaults()
+
+	linker, ok := config.Credentials.(IdentityLinker)
+	if !ok {
+		panic("oauth handlers require a credential store implementing IdentityLinker")
+	}
+
+	return func(c echo.Context) error {
+
+		provider, err := oauth.provider(c.Param("provider"))
+		if err != nil {
+			return WriteProblem(c, NewProblem(http.StatusNotFound, CodeNotFound, err.Error()))
+		}
+
+		key := c.QueryParam("state")
+		cookie, err := c.Cookie(oauth.StateCookie)
+		if err != nil || key == "" || !secretsMatch(cookie.Value, key) {
+			return WriteProblem(c, NewProblem(http.StatusBadRequest, CodeInvalidRequest, ErrInvalidOAuthState.Error()))
+		}
+		c.SetCookie(&http.Cookie{Name: oauth.StateCookie, Path: "/login/oauth/", MaxAge: -1, Secure: !oauth.InsecureStateCookie})
+
+		state, ok, err := oauth.States.Take(key)
+		if err != nil {
+			return err
+		}
+		if !ok || state.Provider != provider.Name {
+			return WriteProblem(c, NewProblem(http.StatusBadRequest, CodeInvalidRequest, ErrInvalidOAuthState.Error()))
+		}
+
+		if reason := c.QueryParam("error"); reason != "" {
+			emitAuthEvent(config.Audit, c, EventLoginOAuth, "", OutcomeFailure, provider.Name+" denied the request: "+reason)
+			return WriteProblem(c, NewProblem(http.StatusForbidden, CodeAccessDenied, "identity provider denied the request: "+reason))
+		}
+
+		id, err := provider.Exchange(c.QueryParam("code"), state.Verifier, state.Nonce)
+		if errors.Is(err, ErrInvalidIDToken) {
+			log.Warnf("Rejected id token from %s: %s", provider.Name, err.Error())
+			emitAuthEvent(config.Audit, c, EventLoginOAuth, "", OutcomeFailure, "invalid id token from "+provider.Name)
+			return WriteProblem(c, NewProblem(http.StatusUnauthorized, CodeInvalidIDToken, "identity provider sent an invalid id token"))
+		} else if err != nil {
+			log.Warnf("Failed to redeem authorization code at %s: %s", provider.Name, err.Error())
+			return WriteProblem(c, NewProblem(http.StatusBadGateway, CodeProviderUnavailable, "identity provider unavailable"))
+		}
+
+		if state.Account != "" {
+			if err := linkIdentity(linker, state.Account, provider.Name, id.Subject); err == ErrIdentityLinked {
+				return WriteProblem(c, NewProblem(http.StatusConflict, CodeConflict, err.Error()))
+			} else if err != nil {
+				return err
+			}
+			return c.JSON(http.StatusOK, nil)
+		}
+
+		subject, err := oauth.resolveAccount(config.Credentials, linker, provider.Name, id)
+		if err == ErrUnknownAccount {
+			emitAuthEvent(config.Audit, c, EventLoginOAuth, "", OutcomeFailure, "no account linked to "+provider.Name+" identity "+id.Subject)
+			return WriteProblem(c, NewProblem(http.StatusForbidden, CodeAccountNotLinked, "no account is linked to the identity"))
+		} else if err != nil {
+			log.Warnf("Failed to resolve the account of %s at %s: %s", id.Subject, provider.Name, err.Error())
+			return err
+		}
+
+		issuer, err := issuerOrDefault(config.Issuer)
+		if err != nil {
+			return err
+		}
+		return completeLogin(c, config, issuer, subject, EventLoginOAuth)
+	}
+}
+
+// linkIdentity links subject at provider to account unless it is linked to another account already
+func linkIdentity(linker IdentityLinker, account string, provider string, subject string) error {
+
+	credentials, err := linker.LookupIdentity(provider, subject)
+	if err == nil {
+		if credentials.Subject != account {
+			return ErrIdentityLinked
+		}
+		return nil
+	} else if err != ErrUnknownAccount {
+		return err
+	}
+
+	return linker.LinkIdentity(account, provider, subject)
+}
+
+// resolveAccount returns the subject of the account linked to id at provider, linking or registering one as allowed
+// by config. ErrUnknownAccount is returned if there is none.
+func (config OAuthConfig) resolveAccount(store CredentialStore, linker IdentityLinker, provider string, id IDToken) (string, error) {
+
+	credentials, err := linker.LookupIdentity(provider, id.Subject)
+	if err == nil {
+		return credentials.Subject, nil
+	} else if err != ErrUnknownAccount {
+		return "", err
+	}
+
+	if config.LinkVerifiedEmail && id.EmailVerified && id.Email != "" {
+		credentials, err := store.Lookup(id.Email)
+		if err == nil && credentials.EmailVerified {
+			return credentials.Subject, linker.LinkIdentity(credentials.Subject, provider, id.Subject)
+		} else if err == nil {
+			// the email was never proven to belong to the account owner
+			return "", ErrUnknownAccount
+		} else if err != ErrUnknownAccount {
+			return "", err
+		}
+	}
+
+	registrar, ok := store.(CredentialRegistrar)
+	if !config.RegisterUnknown || !ok || id.Email == "" {
+		return "", ErrUnknownAccount
+	}
+
+	secret, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	credentials, err = registrar.Register(Credentials{Email: id.Email, Username: provider + "-" + id.Subject}, secret)
+	if err == ErrAccountExists {
+		// the email belongs to an account the identity cannot be linked to
+		return "", ErrUnknownAccount
+	} else if err != nil {
+		return "", err
+	}
+
+	return credentials.Subject, linker.LinkIdentity(credentials.Subject, provider, id.Subject)
+}
+
+// ****************************
+// Redis oauth state store
+// ****************************
+
+// DefaultOAuthStateKeyPrefix is the prefix of the keys written by a RedisOAuthStateStore
+const DefaultOAuthStateKeyPrefix = "oauth:"
+
+// takeScript gets and deletes a key atomically, as GETDEL does on Redis 6.2 onwards
+const takeScript = `
+local value = redis.call('GET', KEYS[1])
+if value then
+	redis.call('DEL', KEYS[1])
+end
+return value
+`
+
+// RedisOAuthStateStore keeps the authorization requests in flight on the global redis instance.
+type RedisOAuthStateStore struct {
+	// Prefix of every key written by the store.
+	// Optional. Default value DefaultOAuthStateKeyPrefix.
+	Prefix string
+}
+
+// NewRedisOAuthStateStore returns an oauth state store backed by the global redis instance
+func NewRedisOAuthStateStore() *RedisOAuthStateStore {
+	return &RedisOAuthStateStore{Prefix: DefaultOAuthStateKeyPrefix}
+}
+
+func (s *RedisOAuthStateStore) key(key string) string {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = DefaultOAuthStateKeyPrefix
+	}
+	return prefix + key
+}
+
+func (s *RedisOAuthStateStore) Save(key string, state OAuthState, ttl time.Duration) error {
+
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.GetRedisInstance().Execute("SET", s.key(key), value, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+func (s *RedisOAuthStateStore) Take(key string) (OAuthState, bool, error) {
+
+	var state OAuthState
+
+	response, err := database.GetRedisInstance().Execute("EVAL", takeScript, 1, s.key(key))
+	if err != nil {
+		return state, false, err
+	}
+	if response.IsType(redis.Nil) {
+		return state, false, nil
+	}
+
+	value, err := response.Bytes()
+	if err != nil {
+		return state, false, err
+	}
+	if err := json.Unmarshal(value, &state); err != nil {
+		return state, false, err
+	}
+	return state, true, nil
+}
+
+// ****************************
+// In memory oauth state store
+// ****************************
+
+// MemoryOAuthStateStore keeps the authorization requests in flight in memory, so callbacks have to reach the
+// instance that started the flow.
+type MemoryOAuthStateStore struct {
+	mutex  sync.Mutex
+	states map[string]memoryOAuthState
+}
+
+type memoryOAuthState struct {
+	state     OAuthState
+	expiresAt time.Time
+}
+
+// NewMemoryOAuthStateStore returns an empty in memory oauth state store
+func NewMemoryOAuthStateStore() *MemoryOAuthStateStore {
+	return &MemoryOAuthStateStore{states: map[string]memoryOAuthState{}}
+}
+
+func (s *MemoryOAuthStateStore) Save(key string, state OAuthState, ttl time.Duration) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for stored, entry := range s.states {
+		if now.After(entry.expiresAt) {
+			delete(s.states, stored)
+		}
+	}
+	s.states[key] = memoryOAuthState{state: state, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+func (s *MemoryOAuthStateStore) Take(key string) (OAuthState, bool, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.states[key]
+	delete(s.states, key)
+	if !ok || time.Now().After(entry.expiresAt) {
+		return OAuthState{}, false, nil
+	}
+	return entry.state, true, nil
+}
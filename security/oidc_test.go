@@ -0,0 +1,222 @@
+package security
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+type mockOIDCGrant struct {
+	challenge string
+	claims    map[string]interface{}
+}
+
+// mockOIDCServer is a local OpenID Connect provider handing out ID tokens for the grants registered on codes
+type mockOIDCServer struct {
+	*httptest.Server
+	issuer *TokenIssuer
+	mutex  sync.Mutex
+	codes  map[string]mockOIDCGrant
+}
+
+func newMockOIDCServer(t *testing.T, clientID string) *mockOIDCServer {
+
+	keys := NewKeySet()
+	keys.Add("mock", AlgorithmRS256, testRSAKey)
+	keys.Activate("mock")
+
+	mock := &mockOIDCServer{codes: map[string]mockOIDCGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                mock.URL,
+			AuthorizationEndpoint: mock.URL + "/authorize",
+			TokenEndpoint:         mock.URL + "/token",
+			JWKSURI:               mock.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(keys.JWKS())
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		mock.mutex.Lock()
+		grant, ok := mock.codes[r.FormValue("code")]
+		delete(mock.codes, r.FormValue("code"))
+		mock.mutex.Unlock()
+		if id != clientID || secret != "s3cr3t" || !ok || pkceChallenge(r.FormValue("code_verifier")) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		idToken, _ := mock.issuer.Issue(grant.claims["sub"].(string), grant.claims)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "access_token": "opaque"})
+	})
+	mock.Server = httptest.NewServer(mux)
+
+	var err error
+	mock.issuer, err = NewTokenIssuer(TokenIssuerConfig{KeySet: keys, Issuer: mock.URL, Audience: []string{clientID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mock
+}
+
+// authorize plays the user signing in at the provider for the authorization request at location, returning the
+// code and state the provider redirects back with
+func (mock *mockOIDCServer) authorize(location string, claims map[string]interface{}) (string, string) {
+
+	request, _ := url.Parse(location)
+	query := request.Query()
+	if claims["nonce"] == nil {
+		claims["nonce"] = query.Get("nonce")
+	}
+
+	code, _ := randomString(8)
+	mock.mutex.Lock()
+	mock.codes[code] = mockOIDCGrant{challenge: query.Get("code_challenge"), claims: claims}
+	mock.mutex.Unlock()
+	return code, query.Get("state")
+}
+
+func TestOAuthLogin(t *testing.T) {
+
+	mock := newMockOIDCServer(t, "go-utils")
+	defer mock.Close()
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher}
+	store.Add(Credentials{Subject: "patata-id", Email: "patata@terno.io", EmailVerified: true})
+	store.Add(Credentials{Subject: "cebolla-id", Email: "cebolla@terno.io"})
+	store.Add(Credentials{Subject: "ternera-id", Email: "ternera@terno.io"})
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+
+	config := AuthenticationConfig{
+		Credentials: store,
+		Issuer:      issuer,
+		OAuth: &OAuthConfig{
+			Providers: []*OIDCProvider{{
+				Name:         "mock",
+				Issuer:       mock.URL,
+				ClientID:     "go-utils",
+				ClientSecret: "s3cr3t",
+				RedirectURL:  "https://api.terno.io/login/oauth/mock/callback",
+			}},
+			States:            NewMemoryOAuthStateStore(),
+			LinkVerifiedEmail: true,
+		},
+	}
+
+	e := echo.New()
+	e.Use(JWTWithConfig(JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256,
+		Revocations: NewMemoryRevocationStore()}))
+	LoadAuthenticationRoutesWithConfig(e, config)
+
+	// start runs the first leg of the flow, returning the location of the provider and the state cookie
+	start := func(path string, token string) (string, *http.Cookie) {
+		req := httptest.NewRequest(echo.GET, path, nil)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		if res.Code != http.StatusFound {
+			t.Fatalf("expected status %d starting the flow and got %d", http.StatusFound, res.Code)
+		}
+		return res.Header().Get(echo.HeaderLocation), res.Result().Cookies()[0]
+	}
+	callback := func(code string, state string, cookie *http.Cookie) (int, string) {
+		req := httptest.NewRequest(echo.GET, "/login/oauth/mock/callback?code="+code+"&state="+state, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		var subject string
+		var token string
+		if json.Unmarshal(res.Body.Bytes(), &token) == nil && token != "" {
+			if parsed, err := issuer.verifier().parseToken(token); err == nil {
+				subject, _ = parsed.Claims.(jwt.MapClaims)["sub"].(string)
+			}
+		}
+		return res.Code, subject
+	}
+
+	location, cookie := start("/login/oauth/mock", "")
+	if !cookie.Secure || !cookie.HttpOnly {
+		t.Errorf("expected the state cookie to be Secure and HttpOnly and got %+v", cookie)
+	}
+	if request, _ := url.Parse(location); request.Query().Get("code_challenge_method") != "S256" ||
+		request.Query().Get("client_id") != "go-utils" || request.Query().Get("scope") != "openid email profile" {
+		t.Errorf("unexpected authorization request %s", location)
+	}
+
+	var test_cases = []struct {
+		name    string
+		claims  map[string]interface{}
+		tamper  func(code string, state string, cookie *http.Cookie) (string, string, *http.Cookie)
+		status  int
+		subject string
+	}{
+		{"unverified email", map[string]interface{}{"sub": "g-1", "email": "patata@terno.io"}, nil, http.StatusForbidden, ""},
+		{"verified email", map[string]interface{}{"sub": "g-1", "email": "patata@terno.io", "email_verified": true}, nil, http.StatusOK, "patata-id"},
+		{"linked identity", map[string]interface{}{"sub": "g-1"}, nil, http.StatusOK, "patata-id"},
+		{"unverified account email", map[string]interface{}{"sub": "g-4", "email": "cebolla@terno.io", "email_verified": true}, nil, http.StatusForbidden, ""},
+		{"unknown email", map[string]interface{}{"sub": "g-2", "email": "pollo@terno.io", "email_verified": true}, nil, http.StatusForbidden, ""},
+		{"nonce mismatch", map[string]interface{}{"sub": "g-1", "nonce": "replayed"}, nil, http.StatusUnauthorized, ""},
+		{"missing cookie", map[string]interface{}{"sub": "g-1"}, func(code string, state string, cookie *http.Cookie) (string, string, *http.Cookie) {
+			return code, state, nil
+		}, http.StatusBadRequest, ""},
+		{"forged state", map[string]interface{}{"sub": "g-1"}, func(code string, state string, cookie *http.Cookie) (string, string, *http.Cookie) {
+			return code, "forged", &http.Cookie{Name: DefaultOAuthStateCookie, Value: "forged"}
+		}, http.StatusBadRequest, ""},
+		{"unknown code", map[string]interface{}{"sub": "g-1"}, func(code string, state string, cookie *http.Cookie) (string, string, *http.Cookie) {
+			return "stolen", state, cookie
+		}, http.StatusBadGateway, ""},
+	}
+
+	for _, test_case := range test_cases {
+		location, cookie := start("/login/oauth/mock", "")
+		code, state := mock.authorize(location, test_case.claims)
+		if test_case.tamper != nil {
+			code, state, cookie = test_case.tamper(code, state, cookie)
+		}
+		status, subject := callback(code, state, cookie)
+		if status != test_case.status || subject != test_case.subject {
+			t.Errorf("%s: expected status %d for '%s' and got %d for '%s'", test_case.name, test_case.status,
+				test_case.subject, status, subject)
+		}
+	}
+
+	//each state can only be used once
+	location, cookie = start("/login/oauth/mock", "")
+	code, state := mock.authorize(location, map[string]interface{}{"sub": "g-1"})
+	callback(code, state, cookie)
+	code, _ = mock.authorize(location, map[string]interface{}{"sub": "g-1"})
+	if status, _ := callback(code, state, cookie); status != http.StatusBadRequest {
+		t.Errorf("expected replayed state to get status %d and got %d", http.StatusBadRequest, status)
+	}
+
+	//authenticated users link new identities to their account, but not the ones linked to other accounts
+	token, _ := issuer.Issue("ternera-id", nil)
+	for _, link := range []struct {
+		sub    string
+		status int
+	}{{"g-3", http.StatusOK}, {"g-1", http.StatusConflict}} {
+		location, cookie = start("/login/oauth/mock/link", token)
+		code, state = mock.authorize(location, map[string]interface{}{"sub": link.sub})
+		if status, _ := callback(code, state, cookie); status != link.status {
+			t.Errorf("expected linking %s to get status %d and got %d", link.sub, link.status, status)
+		}
+	}
+	location, cookie = start("/login/oauth/mock", "")
+	code, state = mock.authorize(location, map[string]interface{}{"sub": "g-3"})
+	if status, subject := callback(code, state, cookie); status != http.StatusOK || subject != "ternera-id" {
+		t.Errorf("expected linked identity to log in as ternera-id and got %d for '%s'", status, subject)
+	}
+}
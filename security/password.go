@@ -0,0 +1,293 @@
+package security
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrUnknownPasswordHash is returned when a stored hash was not produced by any of the accepted algorithms
+	ErrUnknownPasswordHash = errors.New("stored password hash uses an unknown or unsupported format")
+
+	// ErrMalformedPasswordHash is returned when a stored hash cannot be decoded
+	ErrMalformedPasswordHash = errors.New("stored password hash is malformed")
+)
+
+type (
+	// PasswordAlgorithm is a password hashing scheme producing self describing hashes, that is, hashes that carry the
+	// parameters needed to verify them.
+	PasswordAlgorithm interface {
+		// Hash returns the encoded hash of password.
+		Hash(password string) (string, error)
+
+		// Verify reports whether password matches the encoded hash. Comparison is done in constant time.
+		Verify(encoded string, password string) (bool, error)
+
+		// Identifies reports whether encoded was produced by this algorithm.
+		Identifies(encoded string) bool
+
+		// NeedsRehash reports whether encoded was produced with weaker parameters than the configured ones.
+		NeedsRehash(encoded string) bool
+	}
+
+	// PasswordHasher hashes new passwords with its main algorithm and verifies stored hashes produced by either the
+	// main algorithm or any of the legacy ones.
+	PasswordHasher struct {
+		// Algorithm used to hash new passwords. Hashes produced by any other algorithm are reported as needing
+		// a rehash.
+		// Required.
+		Algorithm PasswordAlgorithm
+
+		// Legacy algorithms that are still accepted when verifying.
+		// Optional.
+		Legacy []PasswordAlgorithm
+
+		// AllowPlaintext accepts secrets stored in plain text, which is how passwords were stored before hashing was
+		// introduced. Any stored value starting with '$' is never considered plain text.
+		// Optional. Default value false.
+		AllowPlaintext bool
+
+		dummyOnce sync.Once
+		dummy     string
+	}
+
+	// Argon2idHasher hashes passwords with argon2id producing PHC formatted strings:
+	// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>
+	Argon2idHasher struct {
+		// Number of passes over the memory.
+		Time uint32
+		// Memory used in KiB.
+		Memory uint32
+		// Degree of parallelism.
+		Threads uint8
+		// Length of the derived key in bytes.
+		KeyLength uint32
+		// Length of the random salt in bytes.
+		SaltLength uint32
+	}
+
+	// BcryptHasher hashes passwords with bcrypt at the given cost.
+	BcryptHasher struct {
+		Cost int
+	}
+)
+
+const argon2idPrefix = "$argon2id$"
+
+// Ceilings on the parameters of the argon2id hashes accepted when verifying, so a tampered stored hash cannot make
+// each login exhaust the memory or CPU of the service
+const (
+	maxArgon2idMemory  = 1024 * 1024 //KiB, 1GiB
+	maxArgon2idTime    = 10
+	maxArgon2idThreads = 16
+)
+
+var (
+	// DefaultArgon2idHasher follows the second recommended option of RFC 9106 scaled down to 64MiB of memory
+	DefaultArgon2idHasher = Argon2idHasher{
+		Time:       3,
+		Memory:     64 * 1024,
+		Threads:    2,
+		KeyLength:  32,
+		SaltLength: 16,
+	}
+
+	// DefaultBcryptHasher uses the bcrypt library default cost
+	DefaultBcryptHasher = BcryptHasher{Cost: bcrypt.DefaultCost}
+
+	// DefaultPasswordHasher hashes with argon2id and still accepts bcrypt secrets so they get upgraded on the next
+	// successful login. Deployments still holding plain text secrets have to set AllowPlaintext to get them
+	// upgraded as well.
+	DefaultPasswordHasher = &PasswordHasher{
+		Algorithm: DefaultArgon2idHasher,
+		Legacy:    []PasswordAlgorithm{DefaultBcryptHasher},
+	}
+)
+
+// HashPassword hashes password with the DefaultPasswordHasher. Meant to be used when registering accounts or changing
+// passwords.
+func HashPassword(password string) (string, error) {
+	return DefaultPasswordHasher.Hash(password)
+}
+
+// VerifyPassword checks password against encoded using the DefaultPasswordHasher
+func VerifyPassword(encoded string, password string) (bool, error) {
+	return DefaultPasswordHasher.Verify(encoded, password)
+}
+
+// ****************************
+// Password hasher
+// ****************************
+
+// Hash returns the encoded hash of password produced by the main algorithm
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	return h.Algorithm.Hash(password)
+}
+
+// Verify reports whether password matches the encoded hash
+func (h *PasswordHasher) Verify(encoded string, password string) (bool, error) {
+
+	if algorithm := h.identify(encoded); algorithm != nil {
+		return algorithm.Verify(encoded, password)
+	}
+
+	if h.AllowPlaintext && !strings.HasPrefix(encoded, "$") {
+		return secretsMatch(encoded, password), nil
+	}
+
+	return false, ErrUnknownPasswordHash
+}
+
+// NeedsRehash reports whether encoded should be replaced by a hash of the main algorithm
+func (h *PasswordHasher) NeedsRehash(encoded string) bool {
+	if h.Algorithm.Identifies(encoded) {
+		return h.Algorithm.NeedsRehash(encoded)
+	}
+	return true
+}
+
+// dummyHash returns a hash of a random password produced by the main algorithm, computed once, to verify secrets
+// against when there is no stored hash so it takes as long as when there is one
+func (h *PasswordHasher) dummyHash() string {
+	h.dummyOnce.Do(func() {
+		if password, err := randomString(16); err == nil {
+			h.dummy, _ = h.Algorithm.Hash(password)
+		}
+	})
+	return h.dummy
+}
+
+func (h *PasswordHasher) identify(encoded string) PasswordAlgorithm {
+	if h.Algorithm.Identifies(encoded) {
+		return h.Algorithm
+	}
+	for _, algorithm := range h.Legacy {
+		if algorithm.Identifies(encoded) {
+			return algorithm
+		}
+	}
+	return nil
+}
+
+// ****************************
+// argon2id
+// ****************************
+
+func (a Argon2idHasher) Hash(password string) (string, error) {
+
+	salt := make([]byte, a.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, a.KeyLength)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, a.Memory, a.Time, a.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a Argon2idHasher) Verify(encoded string, password string) (bool, error) {
+
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLength)
+	return subtle.ConstantTimeCompare(key, computed) == 1, nil
+}
+
+func (a Argon2idHasher) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, argon2idPrefix)
+}
+
+func (a Argon2idHasher) NeedsRehash(encoded string) bool {
+
+	params, _, _, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return params.Time < a.Time || params.Memory < a.Memory || params.Threads < a.Threads ||
+		params.KeyLength < a.KeyLength
+}
+
+// decodeArgon2id splits a PHC formatted argon2id hash into its parameters, salt and key
+func decodeArgon2id(encoded string) (Argon2idHasher, []byte, []byte, error) {
+
+	var params Argon2idHasher
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrMalformedPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return params, nil, nil, ErrMalformedPasswordHash
+	}
+	if version != argon2.Version {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, ErrMalformedPasswordHash
+	}
+	//argon2 panics on zero passes or lanes
+	if params.Time < 1 || params.Threads < 1 {
+		return params, nil, nil, ErrMalformedPasswordHash
+	}
+	if params.Memory > maxArgon2idMemory || params.Time > maxArgon2idTime || params.Threads > maxArgon2idThreads {
+		return params, nil, nil, ErrUnknownPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(salt) == 0 {
+		return params, nil, nil, ErrMalformedPasswordHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrMalformedPasswordHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// ****************************
+// bcrypt
+// ****************************
+
+func (b BcryptHasher) Hash(password string) (string, error) {
+	encoded, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	return string(encoded), err
+}
+
+func (b BcryptHasher) Verify(encoded string, password string) (bool, error) {
+
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (b BcryptHasher) Identifies(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") ||
+		strings.HasPrefix(encoded, "$2y$")
+}
+
+func (b BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < b.Cost
+}
@@ -0,0 +1,113 @@
+package security
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testArgon2idHasher = Argon2idHasher{Time: 1, Memory: 1024, Threads: 1, KeyLength: 32, SaltLength: 16}
+
+func TestPasswordAlgorithms(t *testing.T) {
+
+	var test_cases = []struct {
+		name      string
+		algorithm PasswordAlgorithm
+		prefix    string
+	}{
+		{"argon2id", testArgon2idHasher, "$argon2id$v=19$m=1024,t=1,p=1$"},
+		{"bcrypt", BcryptHasher{Cost: bcrypt.MinCost}, "$2a$04$"},
+	}
+
+	for _, test_case := range test_cases {
+
+		encoded, err := test_case.algorithm.Hash("pwned")
+		if err != nil {
+			t.Errorf("%s: expected err to be nil and got %s instead", test_case.name, err)
+			continue
+		}
+		if !strings.HasPrefix(encoded, test_case.prefix) {
+			t.Errorf("%s: expected hash to start with '%s' and got '%s'", test_case.name, test_case.prefix, encoded)
+		}
+		if !test_case.algorithm.Identifies(encoded) {
+			t.Errorf("%s: expected algorithm to identify its own hash '%s'", test_case.name, encoded)
+		}
+		if ok, err := test_case.algorithm.Verify(encoded, "pwned"); !ok || err != nil {
+			t.Errorf("%s: expected valid password to verify and got (%t, %v)", test_case.name, ok, err)
+		}
+		if ok, err := test_case.algorithm.Verify(encoded, "pwned!"); ok || err != nil {
+			t.Errorf("%s: expected invalid password to be rejected and got (%t, %v)", test_case.name, ok, err)
+		}
+		if test_case.algorithm.NeedsRehash(encoded) {
+			t.Errorf("%s: expected fresh hash not to need a rehash", test_case.name)
+		}
+	}
+}
+
+func TestPasswordHasherRehash(t *testing.T) {
+
+	hasher := &PasswordHasher{
+		Algorithm:      testArgon2idHasher,
+		Legacy:         []PasswordAlgorithm{BcryptHasher{Cost: bcrypt.MinCost}},
+		AllowPlaintext: true,
+	}
+
+	weak, _ := Argon2idHasher{Time: 1, Memory: 512, Threads: 1, KeyLength: 32, SaltLength: 16}.Hash("pwned")
+	legacy, _ := BcryptHasher{Cost: bcrypt.MinCost}.Hash("pwned")
+	current, _ := hasher.Hash("pwned")
+
+	var test_cases = []struct {
+		encoded     string
+		valid       bool
+		needsRehash bool
+	}{
+		{current, true, false},
+		{weak, true, true},
+		{legacy, true, true},
+		{"pwned", true, true},
+		{"$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5", false, true},
+		{"$argon2id$v=19$m=1024,t=0,p=1$c2FsdA$a2V5", false, true},
+		{"$argon2id$v=19$m=1024,t=1,p=0$c2FsdA$a2V5", false, true},
+		{"$argon2id$v=19$m=4194304,t=1,p=1$c2FsdA$a2V5", false, true},
+		{"$argon2id$v=19$m=1024,t=1000,p=1$c2FsdA$a2V5", false, true},
+		{"$argon2id$v=19$m=1024,t=1,p=255$c2FsdA$a2V5", false, true},
+		{"$argon2id$v=19$m=1024,t=1,p=1$$a2V5", false, true},
+		{"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$", false, true},
+	}
+
+	for _, test_case := range test_cases {
+		valid, _ := hasher.Verify(test_case.encoded, "pwned")
+		if valid != test_case.valid {
+			t.Errorf("expected verification of '%s' to be %t and got %t", test_case.encoded, test_case.valid, valid)
+		}
+		if rehash := hasher.NeedsRehash(test_case.encoded); rehash != test_case.needsRehash {
+			t.Errorf("expected rehash of '%s' to be %t and got %t", test_case.encoded, test_case.needsRehash, rehash)
+		}
+	}
+
+	hasher.AllowPlaintext = false
+	if _, err := hasher.Verify("pwned", "pwned"); err != ErrUnknownPasswordHash {
+		t.Errorf("expected plain text secrets to be rejected with '%s' and got '%v'", ErrUnknownPasswordHash, err)
+	}
+}
+
+func TestAuthenticateUserUpgradesLegacySecret(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher, AllowPlaintext: true}
+	store.Add(Credentials{Subject: "patata-id", Username: "patata", Secret: "pwned"})
+
+	if allowed, _, err := AuthenticateUser(store, "patata", "pwned"); !allowed || err != nil {
+		t.Fatalf("expected legacy secret to authenticate and got (%t, %v)", allowed, err)
+	}
+
+	credentials, _ := store.Lookup("patata")
+	if !testArgon2idHasher.Identifies(credentials.Secret) {
+		t.Errorf("expected secret to be upgraded to argon2id and got '%s'", credentials.Secret)
+	}
+
+	if allowed, _, err := AuthenticateUser(store, "patata", "pwned"); !allowed || err != nil {
+		t.Errorf("expected upgraded secret to authenticate and got (%t, %v)", allowed, err)
+	}
+}
@@ -0,0 +1,180 @@
+package security
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+// MIMEApplicationProblemJSON is the media type of the RFC 7807 problem details responses
+const MIMEApplicationProblemJSON = "application/problem+json"
+
+// Problem codes. Unlike the detail of a problem, which is meant for humans, codes are stable and clients can rely
+// on them to tell why a request was rejected.
+const (
+	CodeMissingToken           = "missing_token"
+	CodeMalformedToken         = "malformed_token"
+	CodeInvalidSignature       = "invalid_signature"
+	CodeTokenExpired           = "token_expired"
+	CodeTokenNotYetValid       = "token_not_yet_valid"
+	CodeTokenTooOld            = "token_too_old"
+	CodeInvalidIssuer          = "invalid_issuer"
+	CodeInvalidAudience        = "invalid_audience"
+	CodeInvalidClaims          = "invalid_claims"
+	CodeTokenRevoked           = "token_revoked"
+	CodeMFAPending             = "mfa_pending"
+	CodeRevocationUnavailable  = "revocation_unavailable"
+	CodeInsufficientScope      = "insufficient_scope"
+	CodeInvalidCredentials     = "invalid_credentials"
+	CodeTooManyRequests        = "too_many_requests"
+	CodeMissingAPIKey          = "missing_api_key"
+	CodeInvalidAPIKey          = "invalid_api_key"
+	CodeAPIKeysUnavailable     = "api_keys_unavailable"
+	CodeKeysUnavailable        = "keys_unavailable"
+	CodeInvalidMFACode         = "invalid_mfa_code"
+	CodeInvalidIDToken         = "invalid_id_token"
+	CodeAccessDenied           = "access_denied"
+	CodeAccountNotLinked       = "account_not_linked"
+	CodeProviderUnavailable    = "provider_unavailable"
+	CodeCredentialsUnavailable = "credentials_unavailable"
+	CodeInvalidRequest         = "invalid_request"
+	CodeAccountExists          = "account_exists"
+	CodeInvalidAccountToken    = "invalid_account_token"
+	CodeInvalidRefreshToken    = "invalid_refresh_token"
+	CodeInvalidCSRFToken       = "invalid_csrf_token"
+	CodeNotFound               = "not_found"
+	CodeConflict               = "conflict"
+)
+
+// RFC 6750 error codes of the WWW-Authenticate challenge
+const (
+	bearerInvalidToken      = "invalid_token"
+	bearerInsufficientScope = "insufficient_scope"
+)
+
+type (
+	// Problem is an RFC 7807 problem details response. Problems have no type URI, which stands for "about:blank",
+	// so their title is the status text and the reason they were raised is told by Code.
+	Problem struct {
+		Type   string `json:"type,omitempty"`
+		Title  string `json:"title"`
+		Status int    `json:"status"`
+		// Detail is a human readable explanation of this occurrence of the problem.
+		Detail   string `json:"detail,omitempty"`
+		Instance string `json:"instance,omitempty"`
+		// Code is one of the Code* constants.
+		Code string `json:"code"`
+		// Required is the authorization requirement the token does not satisfy, on CodeInsufficientScope problems.
+		Required string `json:"required,omitempty"`
+		// Challenge sent on the WWW-Authenticate header, if any.
+		Challenge string `json:"-"`
+	}
+
+	// ProblemHandler responds to a request rejected with problem.
+	ProblemHandler func(c echo.Context, problem *Problem) error
+)
+
+// NewProblem returns a problem of the given status, code and detail
+func NewProblem(status int, code string, detail string) *Problem {
+	return &Problem{Title: http.StatusText(status), Status: status, Code: code, Detail: detail}
+}
+
+func (p *Problem) Error() string {
+	if p.Detail == "" {
+		return p.Code
+	}
+	return p.Code + ": " + p.Detail
+}
+
+// WriteProblem sends problem as the problem+json response of c, along with its WWW-Authenticate challenge if any.
+// It is the default ErrorHandler of the jwt middleware.
+func WriteProblem(c echo.Context, problem *Problem) error {
+
+	if problem.Challenge != "" {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, problem.Challenge)
+	}
+	if c.Request().Method == http.MethodHead {
+		return c.NoContent(problem.Status)
+	}
+
+	body, err := json.Marshal(problem)
+	if err != nil {
+		return err
+	}
+	return c.Blob(problem.Status, MIMEApplicationProblemJSON, body)
+}
+
+// respondWithProblem sends err as the response of c if it is a *Problem, otherwise it is returned for echo to handle
+func respondWithProblem(c echo.Context, err error) error {
+	if problem, ok := err.(*Problem); ok {
+		return WriteProblem(c, problem)
+	}
+	return err
+}
+
+// bearerChallenge returns an RFC 6750 Bearer challenge carrying the given error code and description, if any
+func bearerChallenge(code string, description string) string {
+
+	challenge := DefaultAuthScheme
+	if code == "" {
+		return challenge
+	}
+	challenge += ` error="` + code + `"`
+	if description != "" {
+		// quoted strings cannot hold quotes nor backslashes unescaped, and clients seldom unescape them
+		challenge += `, error_description="` + strings.NewReplacer(`"`, `'`, `\`, `/`).Replace(description) + `"`
+	}
+	return challenge
+}
+
+// missingTokenProblem returns the problem of requests without a token
+func missingTokenProblem() *Problem {
+	problem := NewProblem(http.StatusUnauthorized, CodeMissingToken, "the request carries no token")
+	problem.Challenge = bearerChallenge("", "")
+	return problem
+}
+
+// invalidTokenProblem returns a "401 - Unauthorized" problem challenging the client for a valid token
+func invalidTokenProblem(code string, detail string) *Problem {
+	problem := NewProblem(http.StatusUnauthorized, code, detail)
+	problem.Challenge = bearerChallenge(bearerInvalidToken, detail)
+	return problem
+}
+
+// tokenProblem returns the problem of a token rejected by parseToken with err. Tokens whose key cannot be fetched
+// are not told to be invalid, they get a "503 - Service Unavailable" problem instead.
+func tokenProblem(err error) *Problem {
+
+	for _, reason := range []struct {
+		err  error
+		code string
+	}{
+		{ErrTokenExpired, CodeTokenExpired},
+		{ErrTokenNotYetValid, CodeTokenNotYetValid},
+		{ErrTokenIssuedInFuture, CodeTokenNotYetValid},
+		{ErrTokenTooOld, CodeTokenTooOld},
+		{ErrInvalidIssuer, CodeInvalidIssuer},
+		{ErrInvalidAudience, CodeInvalidAudience},
+		{ErrMissingClaim, CodeInvalidClaims},
+		{ErrMalformedClaim, CodeInvalidClaims},
+		{ErrMFAPendingToken, CodeMFAPending},
+	} {
+		if errors.Is(err, reason.err) {
+			return invalidTokenProblem(reason.code, err.Error())
+		}
+	}
+
+	var validation *jwt.ValidationError
+	if errors.As(err, &validation) && validation.Errors&jwt.ValidationErrorMalformed != 0 {
+		return invalidTokenProblem(CodeMalformedToken, "token is malformed")
+	}
+	// jwt-go wraps the errors of the key func without unwrapping them
+	if errors.Is(err, ErrKeySetUnavailable) || (validation != nil && errors.Is(validation.Inner, ErrKeySetUnavailable)) {
+		return NewProblem(http.StatusServiceUnavailable, CodeKeysUnavailable, "the keys to verify the token are unavailable")
+	}
+	return invalidTokenProblem(CodeInvalidSignature, "token signature is invalid")
+}
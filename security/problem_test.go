@@ -0,0 +1,137 @@
+package security
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+func TestJWTProblems(t *testing.T) {
+
+	revocations := NewMemoryRevocationStore()
+	middleware := JWTWithConfig(JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256,
+		Revocations: revocations, Audiences: []string{"orders"}})
+	sign := func(claims jwt.MapClaims) string {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testHMACSecret)
+		return token
+	}
+
+	now := time.Now()
+	valid := jwt.MapClaims{"sub": "patata", "jti": "valid", "aud": "orders", "exp": now.Add(time.Hour).Unix()}
+	revoked := jwt.MapClaims{"sub": "patata", "jti": "revoked", "aud": "orders", "exp": now.Add(time.Hour).Unix()}
+	revocations.RevokeToken("revoked", now.Add(time.Hour))
+
+	var test_cases = []struct {
+		auth      string
+		status    int
+		code      string
+		challenge string
+	}{
+		{"", http.StatusUnauthorized, CodeMissingToken, "Bearer"},
+		{"Bearer not.a.token", http.StatusUnauthorized, CodeMalformedToken, `Bearer error="invalid_token"`},
+		{"Bearer " + sign(valid) + "x", http.StatusUnauthorized, CodeInvalidSignature, `Bearer error="invalid_token"`},
+		{"Bearer " + sign(jwt.MapClaims{"sub": "patata", "aud": "orders", "exp": now.Add(-time.Hour).Unix()}),
+			http.StatusUnauthorized, CodeTokenExpired, `Bearer error="invalid_token"`},
+		{"Bearer " + sign(jwt.MapClaims{"sub": "patata", "aud": "billing", "exp": now.Add(time.Hour).Unix()}),
+			http.StatusUnauthorized, CodeInvalidAudience, `Bearer error="invalid_token"`},
+		{"Bearer " + sign(revoked), http.StatusUnauthorized, CodeTokenRevoked, `Bearer error="invalid_token"`},
+		{"Bearer " + sign(jwt.MapClaims{"sub": "patata", "aud": "orders", "exp": now.Add(time.Hour).Unix(), MFAPendingClaim: true}),
+			http.StatusUnauthorized, CodeMFAPending, `Bearer error="invalid_token"`},
+		{"Bearer " + sign(valid), http.StatusOK, "", ""},
+	}
+
+	e := echo.New()
+	for i, test_case := range test_cases {
+		req := httptest.NewRequest(echo.GET, "/orders", nil)
+		if test_case.auth != "" {
+			req.Header.Set(echo.HeaderAuthorization, test_case.auth)
+		}
+		res := httptest.NewRecorder()
+		middleware(func(c echo.Context) error { return c.NoContent(http.StatusOK) })(e.NewContext(req, res))
+
+		if res.Code != test_case.status {
+			t.Errorf("case %d: expected status %d and got %d", i, test_case.status, res.Code)
+		}
+		if !strings.HasPrefix(res.Header().Get(echo.HeaderWWWAuthenticate), test_case.challenge) {
+			t.Errorf("case %d: expected challenge %q and got %q", i, test_case.challenge, res.Header().Get(echo.HeaderWWWAuthenticate))
+		}
+		if test_case.code == "" {
+			continue
+		}
+		var problem Problem
+		json.Unmarshal(res.Body.Bytes(), &problem)
+		if res.Header().Get(echo.HeaderContentType) != MIMEApplicationProblemJSON || problem.Code != test_case.code ||
+			problem.Status != test_case.status || problem.Title != http.StatusText(test_case.status) {
+			t.Errorf("case %d: unexpected problem response %s", i, res.Body.String())
+		}
+	}
+}
+
+func TestJWTKeysUnavailable(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"sub": "patata"})
+	token.Header["kid"] = "first"
+	tokenstring, _ := token.SignedString(testECP256Key)
+
+	req := httptest.NewRequest(echo.GET, "/orders", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+tokenstring)
+	res := httptest.NewRecorder()
+	JWTWithConfig(JWTConfig{KeyResolver: NewRemoteKeySet(server.URL)})(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})(echo.New().NewContext(req, res))
+
+	var problem Problem
+	json.Unmarshal(res.Body.Bytes(), &problem)
+	if res.Code != http.StatusServiceUnavailable || problem.Code != CodeKeysUnavailable {
+		t.Errorf("expected an unreachable JWKS to get status %d and got %d %s", http.StatusServiceUnavailable, res.Code, res.Body.String())
+	}
+}
+
+func TestJWTErrorHandler(t *testing.T) {
+
+	middleware := JWTWithConfig(JWTConfig{
+		SigningKey:    testHMACSecret,
+		SigningMethod: AlgorithmHS256,
+		ErrorHandler: func(c echo.Context, problem *Problem) error {
+			return c.JSON(problem.Status, map[string]string{"error": problem.Code})
+		},
+	})
+
+	req := httptest.NewRequest(echo.GET, "/orders", nil)
+	res := httptest.NewRecorder()
+	middleware(func(c echo.Context) error { return nil })(echo.New().NewContext(req, res))
+
+	if res.Code != http.StatusUnauthorized || strings.TrimSpace(res.Body.String()) != `{"error":"missing_token"}` {
+		t.Errorf("expected the error handler to respond and got %d %s", res.Code, res.Body.String())
+	}
+}
+
+func TestBearerChallenge(t *testing.T) {
+
+	var test_cases = []struct {
+		code        string
+		description string
+		out         string
+	}{
+		{"", "", `Bearer`},
+		{"invalid_token", "", `Bearer error="invalid_token"`},
+		{"invalid_token", `claim "exp" is \ malformed`, `Bearer error="invalid_token", error_description="claim 'exp' is / malformed"`},
+	}
+
+	for _, test_case := range test_cases {
+		if out := bearerChallenge(test_case.code, test_case.description); out != test_case.out {
+			t.Errorf("expected challenge %q and got %q", test_case.out, out)
+		}
+	}
+}
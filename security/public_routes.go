@@ -0,0 +1,176 @@
+package security
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo"
+)
+
+// AuthenticationPublicRoutes are the routes mounted by LoadAuthenticationRoutes that must be reachable without a token
+var AuthenticationPublicRoutes = []string{"/login", "/login/mfa", "/login/oauth/:provider",
+	"/login/oauth/:provider/callback", "/register", "/token/refresh", "/password/forgot", "/password/reset",
+	"/email/verify", JWKSPath}
+
+// DefaultPublicRoutes is the public route registry used by the jwt middleware when JWTConfig.PublicRoutes is not set.
+// Services can declare their own open endpoints on it with Add.
+var DefaultPublicRoutes = NewPublicRoutes(AuthenticationPublicRoutes...)
+
+type (
+	// PublicRoutes is a registry of route patterns that do not require authentication. Each pattern is a path,
+	// optionally preceded by a method and a space, e.g. "GET /health". Paths are matched segment by segment:
+	// - ":name" matches any single segment, as in echo route params, e.g. "/users/:id/avatar"
+	// - a trailing "*" matches the rest of the path, including nothing, e.g. "/public/*"
+	// - any other segment is a shell pattern as in path.Match, e.g. "/static/*.css"
+	// Patterns without a method match every method. Request paths are matched as the router sees them, not cleaned:
+	// a trailing slash is ignored, but paths with empty, "." or ".." segments such as "/admin/../login" are never
+	// public, since the router would dispatch them to another handler than the one the cleaned path names.
+	PublicRoutes struct {
+		mutex  sync.RWMutex
+		routes []publicRoute
+	}
+
+	publicRoute struct {
+		method   string
+		segments []string
+	}
+)
+
+// NewPublicRoutes returns a registry holding patterns. It panics if any of them is malformed.
+func NewPublicRoutes(patterns ...string) *PublicRoutes {
+	routes := &PublicRoutes{}
+	routes.Add(patterns...)
+	return routes
+}
+
+// Add registers patterns as public. It panics if any of them is malformed.
+func (pr *PublicRoutes) Add(patterns ...string) {
+
+	parsed := make([]publicRoute, len(patterns))
+	for i, pattern := range patterns {
+		parsed[i] = parsePublicRoute(pattern)
+	}
+
+	pr.mutex.Lock()
+	defer pr.mutex.Unlock()
+	pr.routes = append(pr.routes, parsed...)
+}
+
+// Matches reports whether a request for method on path is public. An empty method only matches patterns declared
+// for every method.
+func (pr *PublicRoutes) Matches(method, requestPath string) bool {
+
+	segments, ok := requestSegments(requestPath)
+	if !ok {
+		return false
+	}
+
+	pr.mutex.RLock()
+	defer pr.mutex.RUnlock()
+
+	for _, route := range pr.routes {
+		if route.method != "" && route.method != method {
+			continue
+		}
+		if matchSegments(route.segments, segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// Skipper returns a function telling whether the request of a context is public, suitable for the Skipper of the
+// echo middleware
+func (pr *PublicRoutes) Skipper() func(echo.Context) bool {
+	return func(c echo.Context) bool {
+		return pr.Matches(c.Request().Method, routedPath(c.Request()))
+	}
+}
+
+// routedPath returns the path of req as echo routes it, the escaped path when it differs from the decoded one
+func routedPath(req *http.Request) string {
+	if req.URL.RawPath != "" {
+		return req.URL.RawPath
+	}
+	return req.URL.Path
+}
+
+// parsePublicRoute parses a "[METHOD ]/path" pattern
+func parsePublicRoute(pattern string) publicRoute {
+
+	var route publicRoute
+	fields := strings.Fields(pattern)
+	switch len(fields) {
+	case 1:
+	case 2:
+		route.method = strings.ToUpper(fields[0])
+		if route.method == "*" {
+			route.method = ""
+		}
+		fields = fields[1:]
+	default:
+		panic("security: malformed public route pattern " + pattern)
+	}
+
+	if !strings.HasPrefix(fields[0], "/") {
+		panic("security: public route pattern must start with / " + pattern)
+	}
+	route.segments = splitPath(fields[0])
+	for _, segment := range route.segments {
+		if _, err := path.Match(segment, ""); err != nil || segment == ":" {
+			panic("security: malformed public route pattern " + pattern)
+		}
+	}
+	return route
+}
+
+// splitPath returns the non empty segments of p
+func splitPath(p string) []string {
+	segments := []string{}
+	for _, segment := range strings.Split(p, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+// requestSegments returns the segments of a request path. It is not ok if the path has empty, "." or ".."
+// segments, other than a trailing slash.
+func requestSegments(requestPath string) ([]string, bool) {
+
+	requestPath = strings.TrimSuffix(strings.TrimPrefix(requestPath, "/"), "/")
+	if requestPath == "" {
+		return []string{}, true
+	}
+
+	segments := strings.Split(requestPath, "/")
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, false
+		}
+	}
+	return segments, true
+}
+
+// matchSegments reports whether the segments of a request path match the segments of a pattern
+func matchSegments(pattern, segments []string) bool {
+
+	for i, segment := range pattern {
+		if segment == "*" && i == len(pattern)-1 {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if strings.HasPrefix(segment, ":") {
+			continue
+		}
+		if ok, _ := path.Match(segment, segments[i]); !ok {
+			return false
+		}
+	}
+	return len(pattern) == len(segments)
+}
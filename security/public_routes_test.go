@@ -0,0 +1,135 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestPublicRoutes(t *testing.T) {
+
+	routes := NewPublicRoutes("/login", "GET /health", "/public/*", "/users/:id/avatar", "GET /static/*.css", "* /docs")
+
+	var test_cases = []struct {
+		method string
+		path   string
+		public bool
+	}{
+		{echo.POST, "/login", true},
+		{echo.POST, "/login/", true},
+		{"", "/login", true},
+		{echo.POST, "/login/mfa", false},
+		{echo.GET, "/health", true},
+		{echo.POST, "/health", false},
+		{"", "/health", false},
+		{echo.GET, "/public", true},
+		{echo.GET, "/public/a/b/c", true},
+		{echo.GET, "/public/../admin", false},
+		{echo.GET, "/files/x/../../login", false},
+		{echo.GET, "/files/./../login", false},
+		{echo.POST, "//login", false},
+		{echo.POST, "/./login", false},
+		{echo.GET, "/users/42/avatar", true},
+		{echo.GET, "/users/42", false},
+		{echo.GET, "/users/42/avatar/large", false},
+		{echo.GET, "/static/site.css", true},
+		{echo.GET, "/static/site.js", false},
+		{echo.DELETE, "/docs", true},
+		{echo.GET, "/", false},
+		{echo.GET, "", false},
+	}
+
+	for _, test_case := range test_cases {
+		if public := routes.Matches(test_case.method, test_case.path); public != test_case.public {
+			t.Errorf("expected %s %s to be public %t and got %t", test_case.method, test_case.path, test_case.public, public)
+		}
+	}
+
+	routes.Add("/")
+	if !routes.Matches(echo.GET, "/") {
+		t.Errorf("expected routes added later to be public")
+	}
+
+	for _, pattern := range []string{"login", "GET /a /b", "/[", "/users/:"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected malformed pattern %s to panic", pattern)
+				}
+			}()
+			NewPublicRoutes(pattern)
+		}()
+	}
+}
+
+func TestJWTPublicRoutes(t *testing.T) {
+
+	handler := func(c echo.Context) error {
+		return c.String(http.StatusOK, "test")
+	}
+
+	middleware := JWTWithConfig(JWTConfig{
+		SigningKey:    testHMACSecret,
+		SigningMethod: AlgorithmHS256,
+		PublicRoutes:  NewPublicRoutes("GET /health"),
+		Skipper: func(c echo.Context) bool {
+			return c.Request().Header.Get("X-Internal") == "true"
+		},
+	})
+
+	var test_cases = []struct {
+		method   string
+		path     string
+		internal bool
+		code     int
+	}{
+		{echo.GET, "/health", false, http.StatusOK},
+		{echo.GET, "/health/", false, http.StatusOK},
+		{echo.POST, "/health", false, http.StatusUnauthorized},
+		{echo.GET, "/login", false, http.StatusUnauthorized},
+		{echo.GET, "/orders", true, http.StatusOK},
+	}
+
+	e := echo.New()
+	for _, test_case := range test_cases {
+		req := httptest.NewRequest(test_case.method, test_case.path, nil)
+		if test_case.internal {
+			req.Header.Set("X-Internal", "true")
+		}
+		res := httptest.NewRecorder()
+		c := e.NewContext(req, res)
+
+		err := middleware(handler)(c)
+		code := res.Code
+		if he, ok := err.(*echo.HTTPError); ok {
+			code = he.Code
+		}
+		if code != test_case.code {
+			t.Errorf("expected status %d for %s %s and got %d", test_case.code, test_case.method, test_case.path, code)
+		}
+	}
+}
+
+func TestJWTPublicRoutesDotSegments(t *testing.T) {
+
+	e := echo.New()
+	e.Use(JWTWithConfig(JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256}))
+	e.GET("/files/*", func(c echo.Context) error {
+		return c.String(http.StatusOK, "secret")
+	})
+	e.GET("/:page", func(c echo.Context) error {
+		return c.String(http.StatusOK, "secret")
+	})
+
+	//the router dispatches these to protected handlers even if their cleaned or decoded path is public
+	for _, target := range []string{"/files/x/../../login", "/files/%2e%2e/%2e%2e/login", "/files/./../login", "/%6cogin"} {
+		req := httptest.NewRequest(echo.GET, target, nil)
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		if res.Code != http.StatusUnauthorized {
+			t.Errorf("expected %s to get status %d and got %d", target, http.StatusUnauthorized, res.Code)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package security
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// randomString returns n bytes read from crypto/rand encoded as unpadded url safe base64
+func randomString(n int) (string, error) {
+
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
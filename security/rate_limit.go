@@ -0,0 +1,426 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/guidola/go-utils/database"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+// Rate limiting algorithms
+const (
+	// TokenBucket lets clients burst up to the limit, refilling the bucket at limit requests per window.
+	TokenBucket = "token_bucket"
+	// SlidingWindowLog allows at most limit requests on any window long period.
+	SlidingWindowLog = "sliding_window_log"
+)
+
+// Rate limit response headers, as in the IETF RateLimit header fields draft
+const (
+	HeaderRateLimitLimit     = "RateLimit-Limit"
+	HeaderRateLimitRemaining = "RateLimit-Remaining"
+	HeaderRateLimitReset     = "RateLimit-Reset"
+	HeaderRateLimitPolicy    = "RateLimit-Policy"
+)
+
+// ErrUnknownRateLimitAlgorithm is returned for algorithms other than TokenBucket and SlidingWindowLog
+var ErrUnknownRateLimitAlgorithm = errors.New("unknown rate limiting algorithm")
+
+type (
+	// RateLimiter decides whether a request on key is allowed under a limit of requests per window.
+	RateLimiter interface {
+		Allow(key string, limit int, window time.Duration) (RateLimitResult, error)
+	}
+
+	// RateLimitResult is the decision of a RateLimiter.
+	RateLimitResult struct {
+		Allowed bool
+		// Limit of requests per window.
+		Limit int
+		// Requests left right now.
+		Remaining int
+		// Time until the quota is fully restored.
+		Reset time.Duration
+		// Time until the next request is allowed, zero if it is allowed right away.
+		RetryAfter time.Duration
+	}
+
+	// RateLimitConfig defines the config for the rate limiting middleware.
+	RateLimitConfig struct {
+		// Requests allowed per Window.
+		// Required.
+		Limit int
+
+		// Window the Limit applies to.
+		// Required.
+		Window time.Duration
+
+		// Limiter counting the requests.
+		// Optional. Default value a RedisRateLimiter running TokenBucket.
+		Limiter RateLimiter
+
+		// Fallback limiter used while Limiter fails, e.g. during a Redis outage. Its decisions are local to each
+		// instance.
+		// Optional. Default value a MemoryRateLimiter running the algorithm of Limiter.
+		Fallback RateLimiter
+
+		// KeyFunc returns the key requests are counted on.
+		// Optional. Default value RateLimitBySubject.
+		KeyFunc func(c echo.Context) string
+
+		// Skipper tells whether to let a request through without counting it.
+		// Optional. Default value nil.
+		Skipper func(c echo.Context) bool
+	}
+)
+
+// RateLimitByIP counts requests per client IP
+func RateLimitByIP(c echo.Context) string {
+	return "ip:" + c.RealIP()
+}
+
+// RateLimitBySubject counts requests per authenticated subject, as set by the jwt middleware, or per client IP for
+// unauthenticated requests
+func RateLimitBySubject(c echo.Context) string {
+	if claims, ok := ClaimsFromContext(c); ok && claims.Subject != "" {
+		return "sub:" + claims.Subject
+	}
+	return RateLimitByIP(c)
+}
+
+// RateLimitByAPIKey counts requests per API key, as authenticated by the APIKeyAuth middleware, or per client IP for
+// requests without a valid one. It has to run after APIKeyAuth, as keys sent on the request but not validated would
+// let clients pick a fresh bucket for every request.
+func RateLimitByAPIKey(c echo.Context) string {
+	if claims, ok := ClaimsFromContext(c); ok && claims.APIKeyID != "" {
+		return "key:" + claims.APIKeyID
+	}
+	return RateLimitByIP(c)
+}
+
+// RateLimit returns a rate limiting middleware allowing limit requests per window to each subject.
+// See: `RateLimitWithConfig()`.
+func RateLimit(limit int, window time.Duration) echo.MiddlewareFunc {
+	return RateLimitWithConfig(RateLimitConfig{Limit: limit, Window: window})
+}
+
+// RateLimitWithConfig returns a rate limiting middleware from config.
+// Every response carries the RateLimit-* headers. For requests over the limit it sends "429 - Too Many Requests"
+// response with a Retry-After header.
+func RateLimitWithConfig(config RateLimitConfig) echo.MiddlewareFunc {
+	// Defaults
+	if config.Limit <= 0 || config.Window <= 0 {
+		panic("rate limit middleware requires a positive limit and window")
+	}
+	if config.Limiter == nil {
+		config.Limiter = NewRedisRateLimiter(TokenBucket)
+	}
+	if config.Fallback == nil {
+		algorithm := TokenBucket
+		if l, ok := config.Limiter.(*RedisRateLimiter); ok {
+			algorithm = l.Algorithm
+		}
+		config.Fallback = NewMemoryRateLimiter(algorithm)
+	}
+	if config.KeyFunc == nil {
+		config.KeyFunc = RateLimitBySubject
+	}
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if config.Skipper != nil && config.Skipper(c) {
+				return next(c)
+			}
+
+			key := config.KeyFunc(c)
+			result, err := config.Limiter.Allow(key, config.Limit, config.Window)
+			if err != nil {
+				log.Warnf("Falling back to the local rate limiter: %s", err.Error())
+				if result, err = config.Fallback.Allow(key, config.Limit, config.Window); err != nil {
+					return err
+				}
+			}
+
+			header := c.Response().Header()
+			header.Set(HeaderRateLimitLimit, strconv.Itoa(result.Limit))
+			header.Set(HeaderRateLimitRemaining, strconv.Itoa(result.Remaining))
+			header.Set(HeaderRateLimitReset, strconv.FormatInt(ceilSeconds(result.Reset), 10))
+			header.Set(HeaderRateLimitPolicy, fmt.Sprintf("%d;w=%d", config.Limit, ceilSeconds(config.Window)))
+
+			if !result.Allowed {
+				header.Set("Retry-After", strconv.FormatInt(ceilSeconds(result.RetryAfter), 10))
+				return WriteProblem(c, NewProblem(http.StatusTooManyRequests, CodeTooManyRequests, "rate limit exceeded"))
+			}
+			return next(c)
+		}
+	}
+}
+
+// ceilSeconds returns d in whole seconds, rounded up
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// tokenBucketResult builds the result of a token bucket of limit tokens refilled over window, holding tokens after
+// the decision
+func tokenBucketResult(allowed bool, tokens float64, limit int, window time.Duration) RateLimitResult {
+
+	rate := float64(limit) / float64(window)
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(limit) - tokens) / rate),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) / rate)
+	}
+	return result
+}
+
+// slidingWindowResult builds the result of a sliding window log holding count requests, the oldest one at oldest
+func slidingWindowResult(allowed bool, count int, oldest time.Time, limit int, window time.Duration) RateLimitResult {
+
+	result := RateLimitResult{Allowed: allowed, Limit: limit, Remaining: limit - count}
+	if count > 0 {
+		result.Reset = time.Until(oldest.Add(window))
+	}
+	if !allowed {
+		result.RetryAfter = result.Reset
+	}
+	return result
+}
+
+// ****************************
+// Redis rate limiter
+// ****************************
+
+// DefaultRateLimitKeyPrefix is the prefix of the keys written by a RedisRateLimiter
+const DefaultRateLimitKeyPrefix = "ratelimit:"
+
+// tokenBucketScript refills the bucket for the time elapsed since it was last updated and takes a token if there is
+// one. Returns whether the request is allowed and the tokens left.
+const tokenBucketScript = `
+local limit = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = limit
+	ts = now
+end
+tokens = math.min(limit, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return {allowed, tostring(tokens)}
+`
+
+// slidingWindowLogScript drops the requests out of the window and logs the new one if there is room for it.
+// Returns whether the request is allowed, the requests in the window and the time of the oldest one.
+const slidingWindowLogScript = `
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	count = count + 1
+	allowed = 1
+end
+redis.call('PEXPIRE', KEYS[1], window)
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return {allowed, count, oldest[2] or tostring(now)}
+`
+
+// RedisRateLimiter is a RateLimiter shared by every instance of a service, running its algorithm atomically on the
+// global redis instance through a Lua script.
+type RedisRateLimiter struct {
+	// Algorithm, either TokenBucket or SlidingWindowLog.
+	// Optional. Default value TokenBucket.
+	Algorithm string
+
+	// Prefix of every key written by the limiter.
+	// Optional. Default value DefaultRateLimitKeyPrefix.
+	Prefix string
+}
+
+// NewRedisRateLimiter returns a rate limiter running algorithm on the global redis instance
+func NewRedisRateLimiter(algorithm string) *RedisRateLimiter {
+	return &RedisRateLimiter{Algorithm: algorithm, Prefix: DefaultRateLimitKeyPrefix}
+}
+
+func (l *RedisRateLimiter) Allow(key string, limit int, window time.Duration) (RateLimitResult, error) {
+
+	prefix := l.Prefix
+	if prefix == "" {
+		prefix = DefaultRateLimitKeyPrefix
+	}
+	key = prefix + key
+
+	now := time.Now()
+	nowMillis := now.UnixNano() / int64(time.Millisecond)
+	windowMillis := int64(window / time.Millisecond)
+	r := database.GetRedisInstance()
+
+	switch l.Algorithm {
+	case TokenBucket, "":
+		rate := float64(limit) / float64(windowMillis)
+		response, err := r.Execute("EVAL", tokenBucketScript, 1, key, limit,
+			strconv.FormatFloat(rate, 'f', -1, 64), nowMillis, windowMillis)
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		values, err := response.Array()
+		if err != nil || len(values) != 2 {
+			return RateLimitResult{}, fmt.Errorf("unexpected token bucket reply: %v", err)
+		}
+		allowed, _ := values[0].Int()
+		tokens, err := values[1].Float64()
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		return tokenBucketResult(allowed == 1, tokens, limit, window), nil
+
+	case SlidingWindowLog:
+		member, err := randomString(8)
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		response, err := r.Execute("EVAL", slidingWindowLogScript, 1, key, limit, windowMillis, nowMillis, member)
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		values, err := response.Array()
+		if err != nil || len(values) != 3 {
+			return RateLimitResult{}, fmt.Errorf("unexpected sliding window log reply: %v", err)
+		}
+		allowed, _ := values[0].Int()
+		count, _ := values[1].Int()
+		oldest, err := values[2].Float64()
+		if err != nil {
+			return RateLimitResult{}, err
+		}
+		return slidingWindowResult(allowed == 1, count, time.Unix(0, int64(oldest)*int64(time.Millisecond)),
+			limit, window), nil
+	}
+
+	return RateLimitResult{}, ErrUnknownRateLimitAlgorithm
+}
+
+// ****************************
+// In memory rate limiter
+// ****************************
+
+// MemoryRateLimiter is a RateLimiter keeping its counters in memory, so its limits apply to each instance on its
+// own. RedisRateLimiter falls back to it while redis is unreachable.
+type MemoryRateLimiter struct {
+	// Algorithm, either TokenBucket or SlidingWindowLog.
+	// Optional. Default value TokenBucket.
+	Algorithm string
+
+	mutex     sync.Mutex
+	buckets   map[string]*memoryBucket
+	logs      map[string][]time.Time
+	lastPrune time.Time
+}
+
+type memoryBucket struct {
+	tokens float64
+	ts     time.Time
+}
+
+// NewMemoryRateLimiter returns an in memory rate limiter running algorithm
+func NewMemoryRateLimiter(algorithm string) *MemoryRateLimiter {
+	return &MemoryRateLimiter{Algorithm: algorithm}
+}
+
+func (l *MemoryRateLimiter) Allow(key string, limit int, window time.Duration) (RateLimitResult, error) {
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.prune(now, window)
+
+	switch l.Algorithm {
+	case TokenBucket, "":
+		bucket, ok := l.buckets[key]
+		if !ok {
+			bucket = &memoryBucket{tokens: float64(limit), ts: now}
+			l.buckets[key] = bucket
+		}
+		rate := float64(limit) / float64(window)
+		bucket.tokens = math.Min(float64(limit), bucket.tokens+float64(now.Sub(bucket.ts))*rate)
+		bucket.ts = now
+
+		allowed := bucket.tokens >= 1
+		if allowed {
+			bucket.tokens--
+		}
+		return tokenBucketResult(allowed, bucket.tokens, limit, window), nil
+
+	case SlidingWindowLog:
+		requests := l.logs[key]
+		start := now.Add(-window)
+		i := 0
+		for i < len(requests) && !requests[i].After(start) {
+			i++
+		}
+		requests = requests[i:]
+
+		allowed := len(requests) < limit
+		if allowed {
+			requests = append(requests, now)
+		}
+		l.logs[key] = requests
+
+		var oldest time.Time
+		if len(requests) > 0 {
+			oldest = requests[0]
+		}
+		return slidingWindowResult(allowed, len(requests), oldest, limit, window), nil
+	}
+
+	return RateLimitResult{}, ErrUnknownRateLimitAlgorithm
+}
+
+// prune drops the counters idle for longer than window, at most once per window. Callers must hold the mutex.
+func (l *MemoryRateLimiter) prune(now time.Time, window time.Duration) {
+
+	if l.buckets == nil {
+		l.buckets = map[string]*memoryBucket{}
+		l.logs = map[string][]time.Time{}
+		l.lastPrune = now
+	}
+	if now.Sub(l.lastPrune) < window {
+		return
+	}
+	l.lastPrune = now
+
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.ts) > window {
+			delete(l.buckets, key)
+		}
+	}
+	for key, requests := range l.logs {
+		if len(requests) == 0 || now.Sub(requests[len(requests)-1]) > window {
+			delete(l.logs, key)
+		}
+	}
+}
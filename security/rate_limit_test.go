@@ -0,0 +1,165 @@
+package security
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type failingRateLimiter struct{}
+
+func (failingRateLimiter) Allow(key string, limit int, window time.Duration) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("connection refused")
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+
+	var test_cases = []struct {
+		algorithm string
+		remaining []int
+	}{
+		{TokenBucket, []int{2, 1, 0, 0}},
+		{SlidingWindowLog, []int{2, 1, 0, 0}},
+	}
+
+	for _, test_case := range test_cases {
+		limiter := NewMemoryRateLimiter(test_case.algorithm)
+		for i, remaining := range test_case.remaining {
+			result, err := limiter.Allow("ip:192.0.2.1", 3, time.Hour)
+			if err != nil {
+				t.Fatalf("%s: unexpected error %s", test_case.algorithm, err)
+			}
+			if allowed := i < 3; result.Allowed != allowed || result.Remaining != remaining {
+				t.Errorf("%s: expected request %d to be allowed %t with %d remaining and got %+v",
+					test_case.algorithm, i, allowed, remaining, result)
+			}
+			if !result.Allowed && (result.RetryAfter <= 0 || result.RetryAfter > time.Hour) {
+				t.Errorf("%s: expected retry after to be within the window and got %s", test_case.algorithm, result.RetryAfter)
+			}
+		}
+
+		if result, _ := limiter.Allow("ip:192.0.2.2", 3, time.Hour); !result.Allowed {
+			t.Errorf("%s: expected keys to be limited separately", test_case.algorithm)
+		}
+	}
+
+	if _, err := NewMemoryRateLimiter("leaky_bucket").Allow("ip:192.0.2.1", 3, time.Hour); err != ErrUnknownRateLimitAlgorithm {
+		t.Errorf("expected error %v and got %v", ErrUnknownRateLimitAlgorithm, err)
+	}
+}
+
+func TestMemoryRateLimiterRefill(t *testing.T) {
+
+	var test_cases = []string{TokenBucket, SlidingWindowLog}
+
+	for _, algorithm := range test_cases {
+		limiter := NewMemoryRateLimiter(algorithm)
+		limiter.Allow("ip:192.0.2.1", 1, 50*time.Millisecond)
+		if result, _ := limiter.Allow("ip:192.0.2.1", 1, 50*time.Millisecond); result.Allowed {
+			t.Errorf("%s: expected request over the limit to be rejected", algorithm)
+		}
+		time.Sleep(60 * time.Millisecond)
+		if result, _ := limiter.Allow("ip:192.0.2.1", 1, 50*time.Millisecond); !result.Allowed {
+			t.Errorf("%s: expected request to be allowed once the window passed", algorithm)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+
+	var test_cases = []struct {
+		name    string
+		limiter RateLimiter
+	}{
+		{"memory", NewMemoryRateLimiter(SlidingWindowLog)},
+		{"fallback", failingRateLimiter{}},
+	}
+
+	keys := APIKeyConfig{Store: NewMemoryAPIKeyStore()}
+	patata, _, _ := keys.GenerateAPIKey("patata-id", "ci", nil, 0)
+	ternera, _, _ := keys.GenerateAPIKey("patata-id", "deploy", nil, 0)
+
+	for _, test_case := range test_cases {
+		e := echo.New()
+		e.Use(APIKeyAuth(keys))
+		e.Use(RateLimitWithConfig(RateLimitConfig{
+			Limit:   2,
+			Window:  time.Minute,
+			Limiter: test_case.limiter,
+			KeyFunc: RateLimitByAPIKey,
+		}))
+		e.GET("/ping", func(c echo.Context) error {
+			return c.String(http.StatusOK, "pong")
+		})
+
+		request := func(key string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(echo.GET, "/ping", nil)
+			req.Header.Set("X-API-Key", key)
+			res := httptest.NewRecorder()
+			e.ServeHTTP(res, req)
+			return res
+		}
+
+		remaining := []string{"1", "0", "0"}
+		for i, code := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+			res := request(patata)
+			if res.Code != code {
+				t.Errorf("%s: expected request %d to get status %d and got %d", test_case.name, i, code, res.Code)
+			}
+			if res.Header().Get(HeaderRateLimitLimit) != "2" ||
+				res.Header().Get(HeaderRateLimitRemaining) != remaining[i] ||
+				res.Header().Get(HeaderRateLimitPolicy) != "2;w=60" {
+				t.Errorf("%s: unexpected rate limit headers %v", test_case.name, res.Header())
+			}
+			if reset, _ := strconv.Atoi(res.Header().Get(HeaderRateLimitReset)); reset <= 0 || reset > 60 {
+				t.Errorf("%s: expected reset to be within the window and got %d", test_case.name, reset)
+			}
+			if retry := res.Header().Get("Retry-After"); (code == http.StatusTooManyRequests) != (retry != "") {
+				t.Errorf("%s: unexpected Retry-After '%s' on status %d", test_case.name, retry, res.Code)
+			}
+		}
+
+		if res := request(ternera); res.Code != http.StatusOK {
+			t.Errorf("%s: expected a different API key to get status %d and got %d", test_case.name, http.StatusOK, res.Code)
+		}
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+
+	e := echo.New()
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	req.Header.Set(echo.HeaderXRealIP, "192.0.2.1")
+	c := e.NewContext(req, httptest.NewRecorder())
+
+	if key := RateLimitBySubject(c); key != "ip:192.0.2.1" {
+		t.Errorf("expected anonymous requests to be keyed by ip and got '%s'", key)
+	}
+	if key := RateLimitByAPIKey(c); key != "ip:192.0.2.1" {
+		t.Errorf("expected requests without API key to be keyed by ip and got '%s'", key)
+	}
+	req.Header.Set(DefaultAPIKeyHeader, "sk_random_secret")
+	if key := RateLimitByAPIKey(c); key != "ip:192.0.2.1" {
+		t.Errorf("expected requests with an unauthenticated API key to be keyed by ip and got '%s'", key)
+	}
+
+	c.Set(claimsContextKey, &Claims{Subject: "patata-id"})
+	if key := RateLimitBySubject(c); key != "sub:patata-id" {
+		t.Errorf("expected authenticated requests to be keyed by subject and got '%s'", key)
+	}
+
+	c.Set(claimsContextKey, &Claims{Subject: "patata-id", ID: "token-id", Custom: map[string]interface{}{"api_key": "ci"}})
+	if key := RateLimitByAPIKey(c); key != "ip:192.0.2.1" {
+		t.Errorf("expected tokens claiming an API key to be keyed by ip and got '%s'", key)
+	}
+
+	c.Set(claimsContextKey, &Claims{Subject: "patata-id", ID: "key-id", APIKeyID: "key-id"})
+	if key := RateLimitByAPIKey(c); key != "key:key-id" {
+		t.Errorf("expected requests with an API key to be keyed by its id and got '%s'", key)
+	}
+}
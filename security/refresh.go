@@ -0,0 +1,500 @@
+package security
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/guidola/go-utils/database"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// DefaultRefreshTokenTTL is the lifetime of a refresh token. Each rotation issues a token with a fresh lifetime.
+const DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+// RefreshTokenCookie is the cookie logout reads the refresh token from when it is not on the payload, for clients
+// keeping their refresh token on a cookie.
+const RefreshTokenCookie = "refresh_token"
+
+var (
+	// ErrInvalidRefreshToken is returned for unknown, expired or revoked refresh tokens
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+
+	// ErrRefreshTokenReused is returned when an already rotated refresh token is presented again. The whole token
+	// family gets revoked when that happens since either the legit client or an attacker holds a stolen token.
+	ErrRefreshTokenReused = errors.New("refresh token reuse detected, token family revoked")
+)
+
+type (
+	// RefreshRecord is the data stored for each issued refresh token.
+	RefreshRecord struct {
+		// Family groups all the tokens obtained by rotation from the same login.
+		Family        string `json:"family"`
+		Subject       string `json:"sub"`
+		IssuedAt      int64  `json:"iat"`
+		IssuedAtNanos int64  `json:"iat_ns"` // nanoseconds of the second in IssuedAt
+		ExpiresAt     int64  `json:"exp"`
+	}
+
+	// RefreshTokenStore persists refresh tokens by the hash of their value, so a leak of the store does not leak
+	// usable tokens.
+	RefreshTokenStore interface {
+		// Save stores record under hash until record.ExpiresAt.
+		Save(hash string, record RefreshRecord) error
+
+		// Claim atomically marks the token stored under hash as used. Returns its record and whether it had
+		// already been claimed before. ErrInvalidRefreshToken is returned if there is no such token.
+		Claim(hash string) (RefreshRecord, bool, error)
+
+		// RevokeFamily revokes every token of family. The revocation has to be kept at least until the given time.
+		RevokeFamily(family string, until time.Time) error
+
+		// IsFamilyRevoked reports whether family has been revoked.
+		IsFamilyRevoked(family string) (bool, error)
+	}
+
+	// RefreshSubjectRevoker is implemented by refresh token stores able to revoke every refresh token of a subject
+	// at once, used to log subjects out everywhere.
+	RefreshSubjectRevoker interface {
+		// RevokeSubject revokes every token of subject issued before the given time. The revocation has to be kept
+		// at least until the given time.
+		RevokeSubject(subject string, before time.Time, until time.Time) error
+
+		// SubjectRevokedBefore returns the time the tokens of subject issued before are revoked, the zero time if
+		// none are.
+		SubjectRevokedBefore(subject string) (time.Time, error)
+	}
+
+	refreshRequest struct {
+		RefreshToken string `json:"refresh_token" form:"refresh_token"`
+	}
+
+	// tokenResponse follows the successful response format of RFC 6749 section 5.1
+	tokenResponse struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int64  `json:"expires_in"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+	}
+)
+
+// hashRefreshToken returns the key a refresh token is stored under
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueRefreshToken returns a refresh token for subject starting a new token family
+func IssueRefreshToken(store RefreshTokenStore, subject string, ttl time.Duration) (string, error) {
+
+	family, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+
+	return issueRefreshToken(store, subject, family, ttl)
+}
+
+func issueRefreshToken(store RefreshTokenStore, subject string, family string, ttl time.Duration) (string, error) {
+
+	token, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	record := RefreshRecord{
+		Family:        family,
+		Subject:       subject,
+		IssuedAt:      now.Unix(),
+		IssuedAtNanos: int64(now.Nanosecond()),
+		ExpiresAt:     now.Add(ttl).Unix(),
+	}
+
+	if err := store.Save(hashRefreshToken(token), record); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// RotateRefreshToken consumes token and returns its subject along with a new refresh token of the same family.
+// Presenting a token that has already been rotated revokes its whole family and returns ErrRefreshTokenReused along
+// with the subject of the family.
+func RotateRefreshToken(store RefreshTokenStore, token string, ttl time.Duration) (string, string, error) {
+
+	record, reused, err := store.Claim(hashRefreshToken(token))
+	if err != nil {
+		return "", "", err
+	}
+
+	if reused {
+		if err := store.RevokeFamily(record.Family, time.Now().Add(ttl)); err != nil {
+			log.Warnf("Failed to revoke refresh token family of %s: %s", record.Subject, err.Error())
+		}
+		return record.Subject, "", ErrRefreshTokenReused
+	}
+
+	revoked, err := store.IsFamilyRevoked(record.Family)
+	if err != nil {
+		return "", "", err
+	}
+	if revoked {
+		return "", "", ErrInvalidRefreshToken
+	}
+
+	if revoker, ok := store.(RefreshSubjectRevoker); ok {
+		before, err := revoker.SubjectRevokedBefore(record.Subject)
+		if err != nil {
+			return "", "", err
+		}
+		if !time.Unix(record.IssuedAt, record.IssuedAtNanos).After(before) {
+			return "", "", ErrInvalidRefreshToken
+		}
+	}
+
+	rotated, err := issueRefreshToken(store, record.Subject, record.Family, ttl)
+	if err != nil {
+		return "", "", err
+	}
+
+	return record.Subject, rotated, nil
+}
+
+// revokeRefreshToken revokes the family of the refresh token of subject, so neither it nor any token rotated from
+// it can be used again. Unknown tokens and tokens of other subjects are ignored.
+func revokeRefreshToken(store RefreshTokenStore, subject string, token string, ttl time.Duration) error {
+
+	if token == "" {
+		return nil
+	}
+
+	record, _, err := store.Claim(hashRefreshToken(token))
+	if err == ErrInvalidRefreshToken || (err == nil && record.Subject != subject) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return store.RevokeFamily(record.Family, time.Now().Add(ttl))
+}
+
+// refreshTokenFromRequest returns the refresh token on the `refresh_token` field of the payload or, failing that, on
+// the RefreshTokenCookie. Empty if the request has none.
+func refreshTokenFromRequest(c echo.Context) string {
+
+	r := new(refreshRequest)
+	if c.Request().ContentLength != 0 && c.Bind(r) == nil && r.RefreshToken != "" {
+		return r.RefreshToken
+	}
+
+	if cookie, err := c.Cookie(RefreshTokenCookie); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// newTokenResponse issues the access token of subject and pairs it with refreshToken
+func newTokenResponse(issuer *TokenIssuer, subject string, refreshToken string) (tokenResponse, error) {
+
+	accessToken, err := issuer.Issue(subject, nil)
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	return tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(issuer.TTL() / time.Second),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// request handler that exchanges a refresh token for a new access token using the DefaultAuthenticationConfig
+func HandleRefreshRequest(c echo.Context) error {
+	return RefreshHandler(DefaultAuthenticationConfig)(c)
+}
+
+// RefreshHandler returns a request handler that rotates the refresh token given on the `refresh_token` field of the
+// payload and responds with a new access token and refresh token pair.
+// For invalid, expired, revoked or reused refresh tokens it sends "401 - Unauthorized" problem response.
+func RefreshHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.RefreshTokens == nil {
+		config.RefreshTokens = NewRedisRefreshTokenStore()
+	}
+	if config.RefreshTokenTTL == 0 {
+		config.RefreshTokenTTL = DefaultRefreshTokenTTL
+	}
+
+	return func(c echo.Context) error {
+
+		r := new(refreshRequest)
+		if err := c.Bind(r); err != nil {
+			return err
+		}
+		if r.RefreshToken == "" {
+			return WriteProblem(c, NewProblem(http.StatusBadRequest, CodeInvalidRequest, "missing refresh_token"))
+		}
+
+		issuer, err := issuerOrDefault(config.Issuer)
+		if err != nil {
+			return err
+		}
+
+		subject, rotated, err := RotateRefreshToken(config.RefreshTokens, r.RefreshToken, config.RefreshTokenTTL)
+		switch err {
+		case nil:
+			response, err := newTokenResponse(issuer, subject, rotated)
+			if err != nil {
+				return err
+			}
+			emitAuthEvent(config.Audit, c, EventTokenRefresh, subject, OutcomeSuccess, "")
+			return c.JSON(http.StatusOK, response)
+		case ErrRefreshTokenReused:
+			log.Warnf("Refresh token reuse detected for %s from %s", subject, c.RealIP())
+			emitAuthEvent(config.Audit, c, EventRefreshTokenReuse, subject, OutcomeFailure, "refresh token family revoked")
+			return WriteProblem(c, NewProblem(http.StatusUnauthorized, CodeInvalidRefreshToken, err.Error()))
+		case ErrInvalidRefreshToken:
+			emitAuthEvent(config.Audit, c, EventTokenRefresh, "", OutcomeFailure, err.Error())
+			return WriteProblem(c, NewProblem(http.StatusUnauthorized, CodeInvalidRefreshToken, err.Error()))
+		default:
+			log.Warnf("Failed to rotate refresh token: %s", err.Error())
+			return err
+		}
+	}
+}
+
+// ****************************
+// Redis refresh token store
+// ****************************
+
+// DefaultRefreshKeyPrefix namespaces the keys written by RedisRefreshTokenStore
+const DefaultRefreshKeyPrefix = "refresh:"
+
+// RedisRefreshTokenStore stores refresh tokens through the global database.Redis instance.
+type RedisRefreshTokenStore struct {
+	// Prefix of every key written by the store.
+	// Optional. Default value DefaultRefreshKeyPrefix.
+	Prefix string
+}
+
+// NewRedisRefreshTokenStore returns a refresh token store using the global redis instance
+func NewRedisRefreshTokenStore() *RedisRefreshTokenStore {
+	return &RedisRefreshTokenStore{Prefix: DefaultRefreshKeyPrefix}
+}
+
+func (s *RedisRefreshTokenStore) key(kind string, id string) string {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = DefaultRefreshKeyPrefix
+	}
+	return prefix + kind + ":" + id
+}
+
+func (s *RedisRefreshTokenStore) Save(hash string, record RefreshRecord) error {
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = database.GetRedisInstance().Execute("SET", s.key("token", hash), value,
+		"EX", secondsUntil(record.ExpiresAt))
+	return err
+}
+
+func (s *RedisRefreshTokenStore) Claim(hash string) (RefreshRecord, bool, error) {
+
+	var record RefreshRecord
+	r := database.GetRedisInstance()
+
+	response, err := r.Execute("GET", s.key("token", hash))
+	if err != nil {
+		return record, false, err
+	}
+	if response.IsType(redis.Nil) {
+		return record, false, ErrInvalidRefreshToken
+	}
+
+	value, err := response.Bytes()
+	if err != nil {
+		return record, false, err
+	}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return record, false, err
+	}
+
+	// SET NX only succeeds for the first claim, later ones get a nil reply
+	response, err = r.Execute("SET", s.key("used", hash), 1, "NX", "EX", secondsUntil(record.ExpiresAt))
+	if err != nil {
+		return record, false, err
+	}
+
+	return record, response.IsType(redis.Nil), nil
+}
+
+func (s *RedisRefreshTokenStore) RevokeFamily(family string, until time.Time) error {
+	_, err := database.GetRedisInstance().Execute("SET", s.key("revoked", family), 1,
+		"EX", secondsUntil(until.Unix()))
+	return err
+}
+
+func (s *RedisRefreshTokenStore) IsFamilyRevoked(family string) (bool, error) {
+
+	response, err := database.GetRedisInstance().Execute("EXISTS", s.key("revoked", family))
+	if err != nil {
+		return false, err
+	}
+
+	exists, err := response.Int()
+	return exists == 1, err
+}
+
+func (s *RedisRefreshTokenStore) RevokeSubject(subject string, before time.Time, until time.Time) error {
+	_, err := database.GetRedisInstance().Execute("SET", s.key("subject", subject), before.UnixNano(),
+		"EX", secondsUntil(until.Unix()))
+	return err
+}
+
+func (s *RedisRefreshTokenStore) SubjectRevokedBefore(subject string) (time.Time, error) {
+	return watermarkFromRedis(s.key("subject", subject))
+}
+
+// secondsUntil returns the seconds left until the given unix time, at least 1 so it can be used as a redis expiration
+func secondsUntil(unix int64) int64 {
+	if left := unix - time.Now().Unix(); left > 0 {
+		return left
+	}
+	return 1
+}
+
+// ****************************
+// In memory refresh token store
+// ****************************
+
+// MemoryRefreshTokenStore keeps refresh tokens in memory, pruning the expired ones as tokens are saved or revoked.
+type MemoryRefreshTokenStore struct {
+	mutex    sync.Mutex
+	tokens   map[string]*memoryRefreshEntry
+	revoked  map[string]time.Time
+	subjects map[string]memoryWatermark
+}
+
+type memoryWatermark struct {
+	before time.Time
+	until  time.Time
+}
+
+type memoryRefreshEntry struct {
+	record RefreshRecord
+	used   bool
+}
+
+// NewMemoryRefreshTokenStore returns an empty in memory refresh token store
+func NewMemoryRefreshTokenStore() *MemoryRefreshTokenStore {
+	return &MemoryRefreshTokenStore{
+		tokens:   map[string]*memoryRefreshEntry{},
+		revoked:  map[string]time.Time{},
+		subjects: map[string]memoryWatermark{},
+	}
+}
+
+// prune drops the expired tokens, family revocations and subject watermarks. Must be called holding the mutex.
+func (s *MemoryRefreshTokenStore) prune() {
+
+	now := time.Now()
+	for hash, entry := range s.tokens {
+		if now.Unix() >= entry.record.ExpiresAt {
+			delete(s.tokens, hash)
+		}
+	}
+	for family, until := range s.revoked {
+		if now.After(until) {
+			delete(s.revoked, family)
+		}
+	}
+	for subject, watermark := range s.subjects {
+		if now.After(watermark.until) {
+			delete(s.subjects, subject)
+		}
+	}
+}
+
+func (s *MemoryRefreshTokenStore) Save(hash string, record RefreshRecord) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.prune()
+	s.tokens[hash] = &memoryRefreshEntry{record: record}
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) Claim(hash string) (RefreshRecord, bool, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.tokens[hash]
+	if !ok || entry.record.ExpiresAt <= time.Now().Unix() {
+		delete(s.tokens, hash)
+		return RefreshRecord{}, false, ErrInvalidRefreshToken
+	}
+
+	used := entry.used
+	entry.used = true
+	return entry.record, used, nil
+}
+
+func (s *MemoryRefreshTokenStore) RevokeFamily(family string, until time.Time) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.prune()
+	s.revoked[family] = until
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) IsFamilyRevoked(family string) (bool, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	until, ok := s.revoked[family]
+	if ok && time.Now().After(until) {
+		delete(s.revoked, family)
+		return false, nil
+	}
+	return ok, nil
+}
+
+func (s *MemoryRefreshTokenStore) RevokeSubject(subject string, before time.Time, until time.Time) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.prune()
+	s.subjects[subject] = memoryWatermark{before: before, until: until}
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) SubjectRevokedBefore(subject string) (time.Time, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	watermark, ok := s.subjects[subject]
+	if ok && time.Now().After(watermark.until) {
+		delete(s.subjects, subject)
+		return time.Time{}, nil
+	}
+	return watermark.before, nil
+}
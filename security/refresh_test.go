@@ -0,0 +1,72 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRotateRefreshToken(t *testing.T) {
+
+	store := NewMemoryRefreshTokenStore()
+
+	first, err := IssueRefreshToken(store, "patata", time.Hour)
+	if err != nil {
+		t.Fatalf("expected err to be nil and got %s instead", err)
+	}
+
+	subject, second, err := RotateRefreshToken(store, first, time.Hour)
+	if err != nil || subject != "patata" || second == "" || second == first {
+		t.Fatalf("expected rotation to return a new token for patata and got ('%s', '%s', %v)", subject, second, err)
+	}
+
+	//replaying the already rotated token must be detected and revoke the whole family
+	if _, _, err := RotateRefreshToken(store, first, time.Hour); err != ErrRefreshTokenReused {
+		t.Errorf("expected err to be '%s' and got '%v' instead", ErrRefreshTokenReused, err)
+	}
+	if _, _, err := RotateRefreshToken(store, second, time.Hour); err != ErrInvalidRefreshToken {
+		t.Errorf("expected tokens of a revoked family to be rejected and got '%v' instead", err)
+	}
+
+	//other families are not affected
+	other, _ := IssueRefreshToken(store, "patata", time.Hour)
+	if _, _, err := RotateRefreshToken(store, other, time.Hour); err != nil {
+		t.Errorf("expected err to be nil and got %s instead", err)
+	}
+
+	if _, _, err := RotateRefreshToken(store, "tampered", time.Hour); err != ErrInvalidRefreshToken {
+		t.Errorf("expected err to be '%s' and got '%v' instead", ErrInvalidRefreshToken, err)
+	}
+
+	expired, _ := IssueRefreshToken(store, "patata", -time.Second)
+	if _, _, err := RotateRefreshToken(store, expired, time.Hour); err != ErrInvalidRefreshToken {
+		t.Errorf("expected expired token to be rejected and got '%v' instead", err)
+	}
+}
+
+func TestRevokeSubjectRefreshTokens(t *testing.T) {
+
+	store := NewMemoryRefreshTokenStore()
+	revoked, _ := IssueRefreshToken(store, "patata", time.Hour)
+	other, _ := IssueRefreshToken(store, "tomate", time.Hour)
+
+	//tokens issued right before the revocation are revoked, the ones issued right after it are not
+	store.RevokeSubject("patata", time.Now(), time.Now().Add(time.Hour))
+	fresh, _ := IssueRefreshToken(store, "patata", time.Hour)
+	if _, _, err := RotateRefreshToken(store, fresh, time.Hour); err != nil {
+		t.Errorf("expected tokens issued after the revocation to stay valid and got %s instead", err)
+	}
+
+	if _, _, err := RotateRefreshToken(store, revoked, time.Hour); err != ErrInvalidRefreshToken {
+		t.Errorf("expected tokens issued before the revocation to be rejected and got '%v' instead", err)
+	}
+	if _, _, err := RotateRefreshToken(store, other, time.Hour); err != nil {
+		t.Errorf("expected tokens of other subjects to stay valid and got %s instead", err)
+	}
+
+	//an expired revocation is forgotten
+	store.RevokeSubject("patata", time.Now(), time.Now().Add(-time.Second))
+	after, _ := IssueRefreshToken(store, "patata", time.Hour)
+	if _, _, err := RotateRefreshToken(store, after, time.Hour); err != nil {
+		t.Errorf("expected err to be nil and got %s instead", err)
+	}
+}
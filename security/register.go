@@ -0,0 +1,214 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+)
+
+var (
+	// ErrAccountExists is returned when registering an account whose email or username is already taken
+	ErrAccountExists = errors.New("an account with the same email or username already exists")
+
+	ErrInvalidEmail    = errors.New("invalid email address")
+	ErrInvalidUsername = errors.New("username must be 3 to 32 characters long and contain only letters, digits, '.', '_' or '-'")
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.\-]{3,32}$`)
+
+type (
+	// RegisterRequest is the payload accepted by the register handler.
+	RegisterRequest struct {
+		Email    string `json:"email" form:"email"`
+		Username string `json:"username" form:"username"`
+		Pwd      string `json:"pwd" form:"pwd"`
+	}
+
+	// CredentialRegistrar is implemented by credential stores able to create new accounts.
+	CredentialRegistrar interface {
+		// Register hashes secret and stores a new account with the email and username of credentials. Returns the
+		// stored credentials, including the subject assigned to the account. ErrAccountExists is returned if the
+		// email or the username is already taken.
+		Register(credentials Credentials, secret string) (Credentials, error)
+	}
+
+	// PasswordPolicy defines the requirements a password must meet to be accepted on registration.
+	PasswordPolicy struct {
+		MinLength     int
+		MaxLength     int
+		RequireUpper  bool
+		RequireLower  bool
+		RequireDigit  bool
+		RequireSymbol bool
+	}
+
+	registerResponse struct {
+		Subject string `json:"id"`
+		Token   string `json:"token,omitempty"`
+	}
+)
+
+var (
+	// DefaultPasswordPolicy only enforces the length of the password, see NIST SP 800-63B section 5.1.1.
+	DefaultPasswordPolicy = PasswordPolicy{
+		MinLength: 8,
+		MaxLength: 128,
+	}
+)
+
+// Validate returns an error describing the first requirement password does not meet
+func (p PasswordPolicy) Validate(password string) error {
+
+	length := len([]rune(password))
+	if length < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return fmt.Errorf("password must be at most %d characters long", p.MaxLength)
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	switch {
+	case p.RequireUpper && !upper:
+		return errors.New("password must contain an uppercase letter")
+	case p.RequireLower && !lower:
+		return errors.New("password must contain a lowercase letter")
+	case p.RequireDigit && !digit:
+		return errors.New("password must contain a digit")
+	case p.RequireSymbol && !symbol:
+		return errors.New("password must contain a symbol")
+	}
+
+	return nil
+}
+
+// validateEmail accepts bare addresses only, display names such as "Foo <foo@terno.io>" are rejected
+func validateEmail(email string) error {
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return ErrInvalidEmail
+	}
+	return nil
+}
+
+// validateRegisterRequest checks the format of the payload and the availability of the email and username
+func validateRegisterRequest(store CredentialStore, policy PasswordPolicy, r *RegisterRequest) error {
+
+	r.Email = strings.TrimSpace(r.Email)
+	r.Username = strings.TrimSpace(r.Username)
+
+	if err := validateEmail(r.Email); err != nil {
+		return err
+	}
+	if !usernamePattern.MatchString(r.Username) {
+		return ErrInvalidUsername
+	}
+	if err := policy.Validate(r.Pwd); err != nil {
+		return err
+	}
+
+	for _, identifier := range []string{r.Email, r.Username} {
+		if _, err := store.Lookup(identifier); err == nil {
+			return ErrAccountExists
+		} else if err != ErrUnknownAccount {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// request handler that registers a new account using the DefaultAuthenticationConfig
+func HandleRegisterRequest(c echo.Context) error {
+	return RegisterHandler(DefaultAuthenticationConfig)(c)
+}
+
+// RegisterHandler returns a request handler that validates the registration payload and stores the new account on the
+// credential store of config, which must implement CredentialRegistrar.
+// Responds "201 - Created" with the subject of the new account, and its token if config.IssueTokenOnRegister is set.
+// If config.AccountTokens is set an email verification token is mailed to the new account.
+// Responds "400 - Bad Request" if the payload is not valid and "409 - Conflict" if the account already exists.
+func RegisterHandler(config AuthenticationConfig) echo.HandlerFunc {
+	// Defaults
+	if config.Credentials == nil {
+		config.Credentials = DefaultAuthenticationConfig.Credentials
+	}
+	if config.PasswordPolicy == nil {
+		config.PasswordPolicy = &DefaultPasswordPolicy
+	}
+	if config.AccountTokens != nil {
+		tokens := config.AccountTokens.withDefaults()
+		config.AccountTokens = &tokens
+	}
+
+	registrar, ok := config.Credentials.(CredentialRegistrar)
+	if !ok {
+		panic("register handler requires a credential store implementing CredentialRegistrar")
+	}
+
+	return func(c echo.Context) error {
+
+		r := new(RegisterRequest)
+		if err := c.Bind(r); err != nil {
+			return err
+		}
+
+		err := validateRegisterRequest(config.Credentials, *config.PasswordPolicy, r)
+		if err == ErrAccountExists {
+			emitAuthEvent(config.Audit, c, EventRegister, r.Username, OutcomeFailure, err.Error())
+			return WriteProblem(c, NewProblem(http.StatusConflict, CodeAccountExists, err.Error()))
+		} else if err != nil {
+			return WriteProblem(c, NewProblem(http.StatusBadRequest, CodeInvalidRequest, err.Error()))
+		}
+
+		credentials, err := registrar.Register(Credentials{Email: r.Email, Username: r.Username}, r.Pwd)
+		if err == ErrAccountExists {
+			emitAuthEvent(config.Audit, c, EventRegister, r.Username, OutcomeFailure, err.Error())
+			return WriteProblem(c, NewProblem(http.StatusConflict, CodeAccountExists, err.Error()))
+		} else if err != nil {
+			log.Warnf("Failed to register account %s on the credential store: %s", r.Username, err.Error())
+			return err
+		}
+		emitAuthEvent(config.Audit, c, EventRegister, credentials.Subject, OutcomeSuccess, "")
+
+		if config.AccountTokens != nil {
+			err := config.AccountTokens.SendAccountToken(PurposeEmailVerification, credentials.Subject, credentials.Email)
+			if err != nil {
+				log.Warnf("Failed to send email verification token to %s: %s", credentials.Email, err.Error())
+			}
+		}
+
+		response := registerResponse{Subject: credentials.Subject}
+		if config.IssueTokenOnRegister {
+			issuer, err := issuerOrDefault(config.Issuer)
+			if err != nil {
+				return err
+			}
+			if response.Token, err = issuer.Issue(credentials.Subject, nil); err != nil {
+				return err
+			}
+		}
+
+		return c.JSON(http.StatusCreated, response)
+	}
+}
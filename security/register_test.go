@@ -0,0 +1,95 @@
+package security
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+
+	policy := PasswordPolicy{MinLength: 8, MaxLength: 16, RequireUpper: true, RequireDigit: true}
+
+	var test_cases = []struct {
+		password string
+		valid    bool
+	}{
+		{"Patata95", true},
+		{"Patata9", false},
+		{"patata95", false},
+		{"Patatassss", false},
+		{"Patata95Patata95!", false},
+		{"Pätätä95", true},
+	}
+
+	for _, test_case := range test_cases {
+		if err := policy.Validate(test_case.password); (err == nil) != test_case.valid {
+			t.Errorf("expected '%s' validity to be %t and got error '%v'", test_case.password, test_case.valid, err)
+		}
+	}
+}
+
+func TestRegisterHandler(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher}
+	store.Add(Credentials{Subject: "patata-id", Email: "patata@terno.io", Username: "patata", Secret: "pwned"})
+
+	e := echo.New()
+	e.POST("/register", RegisterHandler(AuthenticationConfig{Credentials: store}))
+
+	var test_cases = []struct {
+		payload string
+		code    int
+	}{
+		{`{"email":"tomate@terno.io","username":"tomate","pwd":"tomate1234"}`, http.StatusCreated},
+		{`{"email":"tomate2@terno.io","username":"tomate","pwd":"tomate1234"}`, http.StatusConflict},
+		{`{"email":"patata@terno.io","username":"patata2","pwd":"tomate1234"}`, http.StatusConflict},
+		{`{"email":"tomate3","username":"tomate3","pwd":"tomate1234"}`, http.StatusBadRequest},
+		{`{"email":"Tomate <tomate4@terno.io>","username":"tomate4","pwd":"tomate1234"}`, http.StatusBadRequest},
+		{`{"email":"tomate5@terno.io","username":"to","pwd":"tomate1234"}`, http.StatusBadRequest},
+		{`{"email":"tomate6@terno.io","username":"tomate@6","pwd":"tomate1234"}`, http.StatusBadRequest},
+		{`{"email":"tomate7@terno.io","username":"tomate7","pwd":"short"}`, http.StatusBadRequest},
+	}
+
+	for _, test_case := range test_cases {
+		req := httptest.NewRequest(echo.POST, "/register", bytes.NewBufferString(test_case.payload))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+
+		if res.Code != test_case.code {
+			t.Errorf("expected status %d registering %s and got %d", test_case.code, test_case.payload, res.Code)
+		}
+	}
+
+	//the registered account must be able to log in with its hashed password
+	allowed, subject, err := AuthenticateUser(store, "tomate@terno.io", "tomate1234")
+	if !allowed || err != nil || subject == "" {
+		t.Errorf("expected registered account to authenticate and got (%t, '%s', %v)", allowed, subject, err)
+	}
+
+	credentials, _ := store.Lookup("tomate")
+	if !testArgon2idHasher.Identifies(credentials.Secret) {
+		t.Errorf("expected stored secret to be hashed and got '%s'", credentials.Secret)
+	}
+
+	var response registerResponse
+	req := httptest.NewRequest(echo.POST, "/register",
+		bytes.NewBufferString(`{"email":"lechuga@terno.io","username":"lechuga","pwd":"lechuga1234"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	res := httptest.NewRecorder()
+	e.ServeHTTP(res, req)
+	json.Unmarshal(res.Body.Bytes(), &response)
+
+	if credentials, _ := store.Lookup("lechuga"); response.Subject == "" || response.Subject != credentials.Subject {
+		t.Errorf("expected response subject to be '%s' and got '%s'", credentials.Subject, response.Subject)
+	}
+	if response.Token != "" {
+		t.Errorf("expected no token to be issued and got '%s'", response.Token)
+	}
+}
@@ -0,0 +1,457 @@
+package security
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/guidola/go-utils/database"
+	"github.com/labstack/gommon/log"
+	"github.com/mediocregopher/radix.v2/redis"
+)
+
+// ErrRevocationUnavailable is returned when the revocation status of a token cannot be checked
+var ErrRevocationUnavailable = errors.New("token revocation status is unavailable")
+
+// RevocationPolicy tells how to treat tokens whose revocation status cannot be checked, e.g. during a Redis outage
+type RevocationPolicy int
+
+const (
+	// RevocationFailClosed rejects the tokens, the jwt middleware responds "503 - Service Unavailable".
+	RevocationFailClosed RevocationPolicy = iota
+	// RevocationFailOpen accepts the tokens, ignoring any revocation.
+	RevocationFailOpen
+	// RevocationFailLocal accepts the tokens unless they were revoked through this instance, which keeps a local
+	// denylist of every revocation it performs.
+	RevocationFailLocal
+)
+
+// String returns the name of the policy
+func (p RevocationPolicy) String() string {
+	switch p {
+	case RevocationFailClosed:
+		return "fail-closed"
+	case RevocationFailOpen:
+		return "fail-open"
+	case RevocationFailLocal:
+		return "fail-local"
+	}
+	return "unknown"
+}
+
+// RevocationStore keeps the revoked tokens, identified by their `jti`, and the per subject watermarks before which
+// every token of a subject is revoked. Entries only need to be kept until the given expiration, once every token
+// they apply to has expired.
+type RevocationStore interface {
+	// RevokeToken revokes the token identified by id until the given time.
+	RevokeToken(id string, until time.Time) error
+
+	// IsTokenRevoked reports whether the token identified by id has been revoked.
+	IsTokenRevoked(id string) (bool, error)
+
+	// RevokeSubject revokes every token of subject issued before the given time. The revocation has to be kept at
+	// least until the given time.
+	RevokeSubject(subject string, before time.Time, until time.Time) error
+
+	// SubjectRevokedBefore returns the time the tokens of subject issued before are revoked, the zero time if none
+	// are.
+	SubjectRevokedBefore(subject string) (time.Time, error)
+}
+
+var (
+	// DefaultRevocationStore is the store used when no other is configured.
+	DefaultRevocationStore RevocationStore = NewRedisRevocationStore()
+
+	// localDenylist holds the revocations performed by this instance, used by the RevocationFailLocal policy
+	localDenylist = NewMemoryRevocationStore()
+)
+
+// revocationStoreOrDefault returns s or the DefaultRevocationStore if s is nil
+func revocationStoreOrDefault(s RevocationStore) RevocationStore {
+	if s == nil {
+		return DefaultRevocationStore
+	}
+	return s
+}
+
+// tokenID returns the id token is revoked by, its `jti` or the raw token for tokens issued without one
+func tokenID(token jwt.Token) string {
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if jti, ok := claims["jti"].(string); ok && jti != "" {
+		return jti
+	}
+	return token.Raw
+}
+
+// RevokeToken revokes token on store until it expires. Tokens without `exp` are revoked for SessionRevocationTTL.
+// The revocation is kept on the local denylist as well.
+func RevokeToken(store RevocationStore, token jwt.Token) error {
+
+	claims, _ := token.Claims.(jwt.MapClaims)
+	exp, ok, err := numericClaim(claims, "exp")
+	if err != nil || !ok {
+		exp = time.Now().Add(SessionRevocationTTL).Unix()
+	}
+	if exp <= time.Now().Unix() {
+		// already expired, nothing to revoke
+		return nil
+	}
+
+	until := time.Unix(exp, 0)
+	localDenylist.RevokeToken(tokenID(token), until)
+	return store.RevokeToken(tokenID(token), until)
+}
+
+// RevokeSubject revokes on store every token issued to subject until now. The revocation is kept for
+// SessionRevocationTTL, on the local denylist as well.
+func RevokeSubject(store RevocationStore, subject string) error {
+
+	now := time.Now()
+	localDenylist.RevokeSubject(subject, now, now.Add(SessionRevocationTTL))
+	return store.RevokeSubject(subject, now, now.Add(SessionRevocationTTL))
+}
+
+// IsTokenRevoked reports whether token has been revoked on store, either on its own or by revoking every token of
+// its subject. Tokens issued by TokenIssuer carry the nanoseconds of their `iat`, so only the ones issued up to the
+// revocation are revoked. Tokens without them, which cannot be told apart from the ones issued right before it, are
+// revoked when issued on the second of the revocation.
+func IsTokenRevoked(store RevocationStore, token jwt.Token) (bool, error) {
+
+	revoked, err := store.IsTokenRevoked(tokenID(token))
+	if err != nil || revoked {
+		return revoked, err
+	}
+
+	// tokens issued before the subject got logged out everywhere are no longer valid
+	claims, _ := token.Claims.(jwt.MapClaims)
+	subject, _ := claims["sub"].(string)
+	before, err := store.SubjectRevokedBefore(subject)
+	if err != nil || before.IsZero() {
+		return false, err
+	}
+
+	issued, ok, _ := issuedAt(claims)
+	if _, precise := claims[issuedAtNanosClaim]; !precise {
+		return !ok || issued.Unix() <= before.Unix(), nil
+	}
+	return !issued.After(before), nil
+}
+
+// checkRevocation reports whether token has not been revoked, applying the revocation policy of config when its
+// status cannot be checked. The returned error wraps ErrRevocationUnavailable.
+func (config JWTConfig) checkRevocation(token jwt.Token) (bool, error) {
+
+	revoked, err := IsTokenRevoked(revocationStoreOrDefault(config.Revocations), token)
+	if err == nil {
+		return !revoked, nil
+	}
+
+	switch config.RevocationPolicy {
+	case RevocationFailOpen:
+		log.Warnf("Accepting token without checking its revocation: %s", err.Error())
+		return true, nil
+	case RevocationFailLocal:
+		log.Warnf("Checking token revocation against the local denylist: %s", err.Error())
+		revoked, _ := IsTokenRevoked(localDenylist, token)
+		return !revoked, nil
+	}
+
+	return false, wrapRevocationError(err)
+}
+
+// wrapRevocationError wraps err as ErrRevocationUnavailable
+func wrapRevocationError(err error) error {
+	if errors.Is(err, ErrRevocationUnavailable) {
+		return err
+	}
+	return fmt.Errorf("%w: %s", ErrRevocationUnavailable, err.Error())
+}
+
+// ****************************
+// Redis revocation store
+// ****************************
+
+// DefaultRevocationKeyPrefix is the prefix of the keys written by a RedisRevocationStore
+const DefaultRevocationKeyPrefix = "revoked:"
+
+// RevocationStore persisting revocations on the global redis instance, shared by every instance of a service.
+type RedisRevocationStore struct {
+	// Prefix of every key written by the store.
+	// Optional. Default value DefaultRevocationKeyPrefix.
+	Prefix string
+}
+
+// NewRedisRevocationStore returns a revocation store using the global redis instance
+func NewRedisRevocationStore() *RedisRevocationStore {
+	return &RedisRevocationStore{Prefix: DefaultRevocationKeyPrefix}
+}
+
+func (s *RedisRevocationStore) key(kind string, id string) string {
+	prefix := s.Prefix
+	if prefix == "" {
+		prefix = DefaultRevocationKeyPrefix
+	}
+	return prefix + kind + ":" + id
+}
+
+func (s *RedisRevocationStore) RevokeToken(id string, until time.Time) error {
+	_, err := database.GetRedisInstance().Execute("SET", s.key("jti", id), 0, "EX", secondsUntil(until.Unix()))
+	return err
+}
+
+func (s *RedisRevocationStore) IsTokenRevoked(id string) (bool, error) {
+
+	response, err := database.GetRedisInstance().Execute("EXISTS", s.key("jti", id))
+	if err != nil {
+		return false, err
+	}
+
+	exists, err := response.Int()
+	return exists == 1, err
+}
+
+func (s *RedisRevocationStore) RevokeSubject(subject string, before time.Time, until time.Time) error {
+	_, err := database.GetRedisInstance().Execute("SET", s.key("sub", subject), before.UnixNano(),
+		"EX", secondsUntil(until.Unix()))
+	return err
+}
+
+func (s *RedisRevocationStore) SubjectRevokedBefore(subject string) (time.Time, error) {
+	return watermarkFromRedis(s.key("sub", subject))
+}
+
+// watermarkFromRedis returns the unix time in nanoseconds stored under key, the zero time if there is none
+func watermarkFromRedis(key string) (time.Time, error) {
+
+	response, err := database.GetRedisInstance().Execute("GET", key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if response.IsType(redis.Nil) {
+		return time.Time{}, nil
+	}
+
+	nanos, err := response.Int64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// ****************************
+// In memory revocation store
+// ****************************
+
+// MemoryRevocationStore keeps revocations in memory, dropping them once expired.
+type MemoryRevocationStore struct {
+	mutex    sync.Mutex
+	tokens   map[string]time.Time
+	subjects map[string]memoryWatermark
+}
+
+// NewMemoryRevocationStore returns an empty in memory revocation store
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{tokens: map[string]time.Time{}, subjects: map[string]memoryWatermark{}}
+}
+
+func (s *MemoryRevocationStore) RevokeToken(id string, until time.Time) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.prune()
+	s.tokens[id] = until
+	return nil
+}
+
+func (s *MemoryRevocationStore) IsTokenRevoked(id string) (bool, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	until, ok := s.tokens[id]
+	return ok && time.Now().Before(until), nil
+}
+
+func (s *MemoryRevocationStore) RevokeSubject(subject string, before time.Time, until time.Time) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.prune()
+	s.subjects[subject] = memoryWatermark{before: before, until: until}
+	return nil
+}
+
+func (s *MemoryRevocationStore) SubjectRevokedBefore(subject string) (time.Time, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	watermark, ok := s.subjects[subject]
+	if !ok || time.Now().After(watermark.until) {
+		return time.Time{}, nil
+	}
+	return watermark.before, nil
+}
+
+// prune drops the expired entries, callers must hold the mutex
+func (s *MemoryRevocationStore) prune() {
+	now := time.Now()
+	for id, until := range s.tokens {
+		if now.After(until) {
+			delete(s.tokens, id)
+		}
+	}
+	for subject, watermark := range s.subjects {
+		if now.After(watermark.until) {
+			delete(s.subjects, subject)
+		}
+	}
+}
+
+// ****************************
+// Cached revocation store
+// ****************************
+
+// Cached revocation store defaults
+const (
+	DefaultRevocationCacheSize = 10000
+	DefaultRevocationCacheTTL  = 5 * time.Second
+)
+
+// CachedRevocationStore keeps the answers of a shared store, usually a RedisRevocationStore, on a local LRU cache so
+// checking a token does not take a round trip per request. Revocations performed through another instance are only
+// seen once the cached answers expire, after at most TTL. Revocations performed through this one are seen right
+// away.
+type CachedRevocationStore struct {
+	// Store the revocations are persisted on.
+	// Required.
+	Store RevocationStore
+
+	// Maximum number of cached answers.
+	// Optional. Default value DefaultRevocationCacheSize.
+	Size int
+
+	// How long answers are cached.
+	// Optional. Default value DefaultRevocationCacheTTL.
+	TTL time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type revocationCacheEntry struct {
+	key       string
+	revoked   bool
+	before    time.Time
+	expiresAt time.Time
+}
+
+// NewCachedRevocationStore returns a store caching the answers of store with the default cache settings
+func NewCachedRevocationStore(store RevocationStore) *CachedRevocationStore {
+	return &CachedRevocationStore{Store: store}
+}
+
+func (s *CachedRevocationStore) RevokeToken(id string, until time.Time) error {
+	if err := s.Store.RevokeToken(id, until); err != nil {
+		return err
+	}
+	s.put(&revocationCacheEntry{key: "jti:" + id, revoked: true})
+	return nil
+}
+
+func (s *CachedRevocationStore) IsTokenRevoked(id string) (bool, error) {
+
+	if entry, ok := s.get("jti:" + id); ok {
+		return entry.revoked, nil
+	}
+
+	revoked, err := s.Store.IsTokenRevoked(id)
+	if err != nil {
+		return false, err
+	}
+	s.put(&revocationCacheEntry{key: "jti:" + id, revoked: revoked})
+	return revoked, nil
+}
+
+func (s *CachedRevocationStore) RevokeSubject(subject string, before time.Time, until time.Time) error {
+	if err := s.Store.RevokeSubject(subject, before, until); err != nil {
+		return err
+	}
+	s.put(&revocationCacheEntry{key: "sub:" + subject, before: before})
+	return nil
+}
+
+func (s *CachedRevocationStore) SubjectRevokedBefore(subject string) (time.Time, error) {
+
+	if entry, ok := s.get("sub:" + subject); ok {
+		return entry.before, nil
+	}
+
+	before, err := s.Store.SubjectRevokedBefore(subject)
+	if err != nil {
+		return time.Time{}, err
+	}
+	s.put(&revocationCacheEntry{key: "sub:" + subject, before: before})
+	return before, nil
+}
+
+// get returns the cached answer for key, if there is one not expired yet
+func (s *CachedRevocationStore) get(key string) (*revocationCacheEntry, bool) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	element, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*revocationCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		s.lru.Remove(element)
+		delete(s.entries, key)
+		return nil, false
+	}
+	s.lru.MoveToFront(element)
+	return entry, true
+}
+
+// put caches entry for TTL, evicting the least recently used entries beyond Size
+func (s *CachedRevocationStore) put(entry *revocationCacheEntry) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.entries == nil {
+		s.entries = map[string]*list.Element{}
+		s.lru = list.New()
+	}
+
+	ttl := s.TTL
+	if ttl == 0 {
+		ttl = DefaultRevocationCacheTTL
+	}
+	size := s.Size
+	if size == 0 {
+		size = DefaultRevocationCacheSize
+	}
+
+	entry.expiresAt = time.Now().Add(ttl)
+	if element, ok := s.entries[entry.key]; ok {
+		element.Value = entry
+		s.lru.MoveToFront(element)
+		return
+	}
+
+	s.entries[entry.key] = s.lru.PushFront(entry)
+	for s.lru.Len() > size {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*revocationCacheEntry).key)
+	}
+}
@@ -0,0 +1,224 @@
+package security
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+)
+
+// failingRevocationStore fails every call, as a RedisRevocationStore does during an outage
+type failingRevocationStore struct{}
+
+var errTestOutage = errors.New("connection refused")
+
+func (failingRevocationStore) RevokeToken(id string, until time.Time) error { return errTestOutage }
+func (failingRevocationStore) IsTokenRevoked(id string) (bool, error)       { return false, errTestOutage }
+func (failingRevocationStore) RevokeSubject(subject string, before time.Time, until time.Time) error {
+	return errTestOutage
+}
+func (failingRevocationStore) SubjectRevokedBefore(subject string) (time.Time, error) {
+	return time.Time{}, errTestOutage
+}
+
+// countingRevocationStore counts the calls reaching the wrapped store
+type countingRevocationStore struct {
+	RevocationStore
+	calls int
+}
+
+func (s *countingRevocationStore) IsTokenRevoked(id string) (bool, error) {
+	s.calls++
+	return s.RevocationStore.IsTokenRevoked(id)
+}
+
+func (s *countingRevocationStore) SubjectRevokedBefore(subject string) (time.Time, error) {
+	s.calls++
+	return s.RevocationStore.SubjectRevokedBefore(subject)
+}
+
+func TestTokenID(t *testing.T) {
+
+	var test_cases = []struct {
+		token jwt.Token
+		id    string
+	}{
+		{jwt.Token{Raw: "raw", Claims: jwt.MapClaims{"jti": "token-id"}}, "token-id"},
+		{jwt.Token{Raw: "raw", Claims: jwt.MapClaims{"sub": "patata"}}, "raw"},
+	}
+
+	for _, test_case := range test_cases {
+		if id := tokenID(test_case.token); id != test_case.id {
+			t.Errorf("expected id to be '%s' and got '%s'", test_case.id, id)
+		}
+	}
+}
+
+func TestMemoryRevocationStore(t *testing.T) {
+
+	now := time.Now()
+	token := func(claims jwt.MapClaims) jwt.Token {
+		return jwt.Token{Raw: "raw", Claims: claims}
+	}
+	issued := func(at time.Time) jwt.MapClaims {
+		return jwt.MapClaims{"sub": "patata", "iat": float64(at.Unix()), issuedAtNanosClaim: float64(at.Nanosecond())}
+	}
+
+	store := NewMemoryRevocationStore()
+	store.RevokeToken("revoked", now.Add(time.Hour))
+	store.RevokeToken("expired", now.Add(-time.Second))
+	store.RevokeSubject("patata", now, now.Add(time.Hour))
+	store.RevokeSubject("tomate", now, now.Add(-time.Second))
+
+	var test_cases = []struct {
+		name    string
+		token   jwt.Token
+		revoked bool
+	}{
+		{"revoked token", token(jwt.MapClaims{"jti": "revoked", "sub": "cebolla"}), true},
+		{"expired revocation", token(jwt.MapClaims{"jti": "expired", "sub": "cebolla"}), false},
+		{"other token", token(jwt.MapClaims{"jti": "other", "sub": "cebolla"}), false},
+		{"issued before watermark", token(jwt.MapClaims{"sub": "patata", "iat": float64(now.Unix() - 60)}), true},
+		{"issued right before watermark", token(issued(now.Add(-time.Millisecond))), true},
+		{"issued right after watermark", token(issued(now.Add(time.Millisecond))), false},
+		{"issued on the watermark second without nanoseconds", token(jwt.MapClaims{"sub": "patata", "iat": float64(now.Unix())}), true},
+		{"issued after watermark", token(jwt.MapClaims{"sub": "patata", "iat": float64(now.Unix() + 60)}), false},
+		{"without iat", token(jwt.MapClaims{"sub": "patata"}), true},
+		{"expired watermark", token(jwt.MapClaims{"sub": "tomate", "iat": float64(now.Unix() - 60)}), false},
+	}
+
+	for _, test_case := range test_cases {
+		revoked, err := IsTokenRevoked(store, test_case.token)
+		if err != nil || revoked != test_case.revoked {
+			t.Errorf("%s: expected revoked to be %t and got (%t, %v)", test_case.name, test_case.revoked, revoked, err)
+		}
+	}
+
+	//expired entries get dropped on the next revocation
+	store.RevokeToken("another", now.Add(time.Hour))
+	if len(store.tokens) != 2 || len(store.subjects) != 1 {
+		t.Errorf("expected expired entries to be pruned and got %v and %v", store.tokens, store.subjects)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+
+	store := NewMemoryRevocationStore()
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+	config := JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256, Revocations: store}
+
+	first, _ := issuer.Issue("patata", nil)
+	second, _ := issuer.Issue("patata", nil)
+	firstToken, _ := config.parseToken(first)
+	secondToken, _ := config.parseToken(second)
+
+	if err := RevokeToken(store, *firstToken); err != nil {
+		t.Fatalf("expected err to be nil and got %s instead", err)
+	}
+	if valid, _ := config.checkRevocation(*firstToken); valid {
+		t.Errorf("expected revoked token to be invalid")
+	}
+	if valid, _ := config.checkRevocation(*secondToken); !valid {
+		t.Errorf("expected other tokens of the subject to stay valid")
+	}
+
+	if err := RevokeSubject(store, "patata"); err != nil {
+		t.Fatalf("expected err to be nil and got %s instead", err)
+	}
+	//tokens issued right after the revocation are valid, even on the same second
+	third, _ := issuer.Issue("patata", nil)
+	thirdToken, _ := config.parseToken(third)
+	if valid, _ := config.checkRevocation(*thirdToken); !valid {
+		t.Errorf("expected tokens issued after the revocation to be valid")
+	}
+}
+
+func TestCachedRevocationStore(t *testing.T) {
+
+	backend := &countingRevocationStore{RevocationStore: NewMemoryRevocationStore()}
+	store := NewCachedRevocationStore(backend)
+	store.Size = 2
+
+	token := jwt.Token{Claims: jwt.MapClaims{"jti": "token-id", "sub": "patata", "iat": float64(time.Now().Unix())}}
+	for i := 0; i < 3; i++ {
+		if revoked, err := IsTokenRevoked(store, token); revoked || err != nil {
+			t.Errorf("expected token not to be revoked and got (%t, %v)", revoked, err)
+		}
+	}
+	if backend.calls != 2 {
+		t.Errorf("expected the answers to be cached and got %d calls to the backend", backend.calls)
+	}
+
+	//revocations through the cache are seen right away
+	store.RevokeToken("token-id", time.Now().Add(time.Hour))
+	if revoked, _ := IsTokenRevoked(store, token); !revoked {
+		t.Errorf("expected token revoked through the cache to be revoked")
+	}
+
+	//revocations through other instances are seen once the cached answers expire
+	backend.RevokeToken("other-id", time.Now().Add(time.Hour))
+	other := jwt.Token{Claims: jwt.MapClaims{"jti": "other-id"}}
+	store.put(&revocationCacheEntry{key: "jti:other-id", revoked: false})
+	if revoked, _ := IsTokenRevoked(store, other); revoked {
+		t.Errorf("expected the cached answer to be served")
+	}
+	store.TTL = -time.Second
+	store.put(&revocationCacheEntry{key: "jti:other-id", revoked: false})
+	if revoked, _ := IsTokenRevoked(store, other); !revoked {
+		t.Errorf("expected expired answers to be fetched again")
+	}
+
+	if len(store.entries) > 2 || store.lru.Len() > 2 {
+		t.Errorf("expected the cache to hold at most 2 entries and got %d", store.lru.Len())
+	}
+}
+
+func TestRevocationPolicy(t *testing.T) {
+
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+	parser := JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256}
+
+	accepted, _ := issuer.Issue("patata", nil)
+	revoked, _ := issuer.Issue("patata", nil)
+	acceptedToken, _ := parser.parseToken(accepted)
+	revokedToken, _ := parser.parseToken(revoked)
+
+	//revocations are kept on the local denylist even if the store fails
+	RevokeToken(failingRevocationStore{}, *revokedToken)
+
+	var test_cases = []struct {
+		policy RevocationPolicy
+		token  *jwt.Token
+		valid  bool
+		err    error
+	}{
+		{RevocationFailClosed, acceptedToken, false, ErrRevocationUnavailable},
+		{RevocationFailOpen, acceptedToken, true, nil},
+		{RevocationFailOpen, revokedToken, true, nil},
+		{RevocationFailLocal, acceptedToken, true, nil},
+		{RevocationFailLocal, revokedToken, false, nil},
+	}
+
+	for _, test_case := range test_cases {
+		config := JWTConfig{Revocations: failingRevocationStore{}, RevocationPolicy: test_case.policy}
+		valid, err := config.checkRevocation(*test_case.token)
+		if valid != test_case.valid || !errors.Is(err, test_case.err) || (test_case.err == nil && err != nil) {
+			t.Errorf("%s: expected (%t, %v) and got (%t, %v)", test_case.policy, test_case.valid, test_case.err, valid, err)
+		}
+	}
+
+	//the middleware responds 503 rather than accepting the token
+	middleware := JWTWithConfig(JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256,
+		Revocations: failingRevocationStore{}})
+	req := httptest.NewRequest(echo.GET, "/", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+accepted)
+	res := httptest.NewRecorder()
+	middleware(func(c echo.Context) error { return nil })(echo.New().NewContext(req, res))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d and got %d", http.StatusServiceUnavailable, res.Code)
+	}
+}
@@ -0,0 +1,168 @@
+package security
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Default names of the session and CSRF cookies and of the header echoing the CSRF token
+const (
+	DefaultSessionCookieName = "session"
+	DefaultCSRFCookieName    = "csrf"
+	DefaultCSRFHeader        = "X-CSRF-Token"
+)
+
+type (
+	// SessionCookieConfig defines the cookies used to keep browser clients authenticated. The token is stored on an
+	// HttpOnly cookie, out of reach of scripts, so the jwt middleware has to look it up with a "cookie:<Name>" entry
+	// on its TokenLookup. Since browsers attach cookies to cross site requests on their own, state changing requests
+	// must be protected with the CSRF middleware, which checks the double submitted CSRF token.
+	SessionCookieConfig struct {
+		// Name of the cookie holding the token.
+		// Optional. Default value DefaultSessionCookieName.
+		Name string
+
+		// Path and Domain the cookies are scoped to.
+		// Optional. Default value "/" and the host of the request.
+		Path   string
+		Domain string
+
+		// Insecure lets the cookies be sent over plain http. Only meant for local development.
+		// Optional. Default value false, cookies are Secure.
+		Insecure bool
+
+		// SameSite policy of the cookies.
+		// Optional. Default value http.SameSiteLaxMode.
+		SameSite http.SameSite
+
+		// Name of the cookie holding the CSRF token, readable by scripts so they can echo it on CSRFHeader.
+		// Optional. Default value DefaultCSRFCookieName.
+		CSRFCookieName string
+
+		// Header state changing requests must echo the CSRF token on.
+		// Optional. Default value DefaultCSRFHeader.
+		CSRFHeader string
+	}
+
+	// sessionResponse is the body of a login in session mode, where the token itself travels on a cookie
+	sessionResponse struct {
+		CSRFToken string `json:"csrf_token"`
+		ExpiresIn int64  `json:"expires_in"`
+	}
+)
+
+var (
+	// DefaultSessionCookieConfig is the default session cookie config.
+	DefaultSessionCookieConfig = SessionCookieConfig{
+		Name:           DefaultSessionCookieName,
+		Path:           "/",
+		SameSite:       http.SameSiteLaxMode,
+		CSRFCookieName: DefaultCSRFCookieName,
+		CSRFHeader:     DefaultCSRFHeader,
+	}
+)
+
+// withDefaults returns config with its unset fields taken from DefaultSessionCookieConfig
+func (config SessionCookieConfig) withDefaults() SessionCookieConfig {
+	if config.Name == "" {
+		config.Name = DefaultSessionCookieConfig.Name
+	}
+	if config.Path == "" {
+		config.Path = DefaultSessionCookieConfig.Path
+	}
+	if config.SameSite == 0 {
+		config.SameSite = DefaultSessionCookieConfig.SameSite
+	}
+	if config.CSRFCookieName == "" {
+		config.CSRFCookieName = DefaultSessionCookieConfig.CSRFCookieName
+	}
+	if config.CSRFHeader == "" {
+		config.CSRFHeader = DefaultSessionCookieConfig.CSRFHeader
+	}
+	return config
+}
+
+// SetSession sets the session cookie holding tokenstring, valid for ttl, along with a new CSRF cookie, and returns
+// the CSRF token
+func (config SessionCookieConfig) SetSession(c echo.Context, tokenstring string, ttl time.Duration) (string, error) {
+
+	config = config.withDefaults()
+
+	csrf, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	c.SetCookie(config.cookie(config.Name, tokenstring, ttl, true))
+	c.SetCookie(config.cookie(config.CSRFCookieName, csrf, ttl, false))
+	return csrf, nil
+}
+
+// ClearSession expires the session and CSRF cookies
+func (config SessionCookieConfig) ClearSession(c echo.Context) {
+
+	config = config.withDefaults()
+
+	c.SetCookie(config.cookie(config.Name, "", -1, true))
+	c.SetCookie(config.cookie(config.CSRFCookieName, "", -1, false))
+}
+
+// cookie returns a cookie scoped as configured. A negative ttl deletes it.
+func (config SessionCookieConfig) cookie(name, value string, ttl time.Duration, httpOnly bool) *http.Cookie {
+
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     config.Path,
+		Domain:   config.Domain,
+		Secure:   !config.Insecure,
+		HttpOnly: httpOnly,
+		SameSite: config.SameSite,
+		MaxAge:   int(ttl / time.Second),
+	}
+	if ttl < 0 {
+		cookie.MaxAge = -1
+		cookie.Expires = time.Unix(0, 0)
+	} else {
+		cookie.Expires = time.Now().Add(ttl)
+	}
+	return cookie
+}
+
+// CSRF returns a double submit CSRF protection middleware using the DefaultSessionCookieConfig.
+// See: `CSRFWithConfig()`.
+func CSRF() echo.MiddlewareFunc {
+	return CSRFWithConfig(DefaultSessionCookieConfig)
+}
+
+// CSRFWithConfig returns a double submit CSRF protection middleware for the session cookies of config.
+// Requests with a state changing method that carry the session cookie must echo the value of the CSRF cookie on the
+// CSRF header, otherwise it sends "403 - Forbidden" problem response. Requests without the session cookie, e.g. those
+// authenticated with an Authorization header, cannot be forged by a third party site and go through.
+func CSRFWithConfig(config SessionCookieConfig) echo.MiddlewareFunc {
+	config = config.withDefaults()
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+
+			switch c.Request().Method {
+			case echo.GET, echo.HEAD, echo.OPTIONS, echo.TRACE:
+				return next(c)
+			}
+
+			if session, err := c.Cookie(config.Name); err != nil || session.Value == "" {
+				return next(c)
+			}
+
+			cookie, err := c.Cookie(config.CSRFCookieName)
+			header := c.Request().Header.Get(config.CSRFHeader)
+			if err != nil || cookie.Value == "" || !secretsMatch(cookie.Value, header) {
+				return WriteProblem(c, NewProblem(http.StatusForbidden, CodeInvalidCSRFToken, "missing or invalid csrf token"))
+			}
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package security
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestSessionLogin(t *testing.T) {
+
+	store := NewMemoryCredentialStore()
+	store.Hasher = &PasswordHasher{Algorithm: testArgon2idHasher}
+	secret, _ := store.Hasher.Hash("pwned")
+	store.Add(Credentials{Subject: "patata-id", Email: "patata@terno.io", Secret: secret})
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+
+	e := echo.New()
+	e.POST("/login", LoginHandler(AuthenticationConfig{Credentials: store, Issuer: issuer, SessionCookie: &SessionCookieConfig{}}))
+
+	req := httptest.NewRequest(echo.POST, "/login", bytes.NewBufferString(`{"uuid":"patata@terno.io","pwd":"pwned"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	res := httptest.NewRecorder()
+	e.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status %d and got %d", http.StatusOK, res.Code)
+	}
+
+	var body sessionResponse
+	json.Unmarshal(res.Body.Bytes(), &body)
+	cookies := map[string]*http.Cookie{}
+	for _, cookie := range res.Result().Cookies() {
+		cookies[cookie.Name] = cookie
+	}
+
+	session, csrf := cookies[DefaultSessionCookieName], cookies[DefaultCSRFCookieName]
+	if session == nil || csrf == nil {
+		t.Fatalf("expected session and csrf cookies and got %v", cookies)
+	}
+	if !session.HttpOnly || !session.Secure || session.SameSite != http.SameSiteLaxMode || session.MaxAge != ExpirationTime {
+		t.Errorf("unexpected session cookie attributes %+v", session)
+	}
+	if csrf.HttpOnly || csrf.Value != body.CSRFToken || body.CSRFToken == "" {
+		t.Errorf("expected csrf cookie readable by scripts holding %s and got %+v", body.CSRFToken, csrf)
+	}
+
+	config := JWTConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256}
+	if token, err := config.parseToken(session.Value); err != nil || !token.Valid {
+		t.Errorf("expected session cookie to hold a valid token and got %v", err)
+	}
+}
+
+func TestSessionLogoutClearsCookies(t *testing.T) {
+
+	issuer, _ := NewTokenIssuer(TokenIssuerConfig{SigningKey: testHMACSecret, SigningMethod: AlgorithmHS256})
+	token, _ := issuer.Issue("patata", nil)
+
+	var test_cases = []struct {
+		name        string
+		session     string
+		revocations RevocationStore
+		status      int
+		code        string
+		cleared     bool
+	}{
+		{"invalid token", "not.a.token", NewMemoryRevocationStore(), http.StatusUnauthorized, CodeMalformedToken, false},
+		{"revocation unavailable", token, failingRevocationStore{}, http.StatusServiceUnavailable, CodeRevocationUnavailable, false},
+		{"revoked", token, NewMemoryRevocationStore(), http.StatusOK, "", true},
+	}
+
+	for _, test_case := range test_cases {
+		e := echo.New()
+		LoadAuthenticationRoutesWithConfig(e, AuthenticationConfig{Issuer: issuer, Revocations: test_case.revocations,
+			SessionCookie: &SessionCookieConfig{Name: "sid"}})
+
+		req := httptest.NewRequest(echo.POST, "/logout", nil)
+		req.AddCookie(&http.Cookie{Name: "sid", Value: test_case.session})
+		res := httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+
+		if res.Code != test_case.status || !strings.Contains(res.Body.String(), test_case.code) {
+			t.Errorf("%s: expected status %d with a '%s' problem and got %d %s", test_case.name, test_case.status,
+				test_case.code, res.Code, res.Body.String())
+		}
+
+		cleared := 0
+		for _, cookie := range res.Result().Cookies() {
+			if (cookie.Name == "sid" || cookie.Name == DefaultCSRFCookieName) && cookie.MaxAge < 0 && cookie.Value == "" {
+				cleared++
+			}
+		}
+		if (cleared == 2) != test_case.cleared {
+			t.Errorf("%s: expected the session and csrf cookies to be cleared %t and got %v", test_case.name,
+				test_case.cleared, res.Result().Cookies())
+		}
+
+		//cross-site links cannot log session users out
+		req = httptest.NewRequest(echo.GET, "/logout", nil)
+		res = httptest.NewRecorder()
+		e.ServeHTTP(res, req)
+		if res.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: expected GET logout to get status %d in session mode and got %d", test_case.name,
+				http.StatusMethodNotAllowed, res.Code)
+		}
+	}
+}
+
+func TestCSRF(t *testing.T) {
+
+	handler := func(c echo.Context) error {
+		return c.String(http.StatusOK, "test")
+	}
+	middleware := CSRF()
+
+	var test_cases = []struct {
+		method  string
+		session string
+		cookie  string
+		header  string
+		code    int
+	}{
+		{echo.GET, "token", "csrf", "", http.StatusOK},
+		{echo.POST, "token", "csrf", "csrf", http.StatusOK},
+		{echo.POST, "token", "csrf", "", http.StatusForbidden},
+		{echo.DELETE, "token", "csrf", "forged", http.StatusForbidden},
+		{echo.PUT, "token", "", "", http.StatusForbidden},
+		{echo.POST, "", "", "", http.StatusOK},
+	}
+
+	e := echo.New()
+	for _, test_case := range test_cases {
+		req := httptest.NewRequest(test_case.method, "/", nil)
+		if test_case.session != "" {
+			req.AddCookie(&http.Cookie{Name: DefaultSessionCookieName, Value: test_case.session})
+		}
+		if test_case.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: DefaultCSRFCookieName, Value: test_case.cookie})
+		}
+		if test_case.header != "" {
+			req.Header.Set(DefaultCSRFHeader, test_case.header)
+		}
+		res := httptest.NewRecorder()
+		c := e.NewContext(req, res)
+
+		err := middleware(handler)(c)
+		code := res.Code
+		if he, ok := err.(*echo.HTTPError); ok {
+			code = he.Code
+		}
+		if code != test_case.code {
+			t.Errorf("expected status %d for %+v and got %d", test_case.code, test_case, code)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidTOTPSecret is returned when a TOTP secret is not valid unpadded base32
+var ErrInvalidTOTPSecret = errors.New("totp secret is not valid base32")
+
+// TOTP generates and verifies RFC 6238 time based one time passwords. Codes are HMAC-SHA1 based, the only algorithm
+// every authenticator app supports.
+type TOTP struct {
+	// Number of digits of each code.
+	// Optional. Default value 6.
+	Digits int
+
+	// Period each code is valid for.
+	// Optional. Default value 30 seconds.
+	Period time.Duration
+
+	// Periods accepted before and after the current one, to make up for clock drift between server and device.
+	// Optional. Default value 0, only the code of the current period is accepted.
+	Skew int
+}
+
+// DefaultTOTP is the TOTP setup expected by authenticator apps, accepting the codes of the previous and next period.
+var DefaultTOTP = TOTP{Digits: 6, Period: 30 * time.Second, Skew: 1}
+
+// totpEncoding is the base32 encoding TOTP secrets are shared with
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a new random 160 bit TOTP secret encoded as unpadded base32, as RFC 4226 recommends
+func GenerateTOTPSecret() (string, error) {
+
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// withDefaults returns t with its unset fields taken from DefaultTOTP
+func (t TOTP) withDefaults() TOTP {
+	if t.Digits == 0 {
+		t.Digits = DefaultTOTP.Digits
+	}
+	if t.Period == 0 {
+		t.Period = DefaultTOTP.Period
+	}
+	return t
+}
+
+// URI returns the otpauth:// URI authenticator apps enroll secret from, usually shown as a QR code. Account is the
+// name the code is listed under, next to issuer.
+func (t TOTP) URI(secret string, issuer string, account string) string {
+
+	t = t.withDefaults()
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(t.Digits))
+	query.Set("period", strconv.FormatInt(int64(t.Period/time.Second), 10))
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + query.Encode()
+}
+
+// counter returns the period at belongs to
+func (t TOTP) counter(at time.Time) int64 {
+	return at.Unix() / int64(t.Period/time.Second)
+}
+
+// Code returns the code of secret for the period at belongs to
+func (t TOTP) Code(secret string, at time.Time) (string, error) {
+
+	t = t.withDefaults()
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return hotp(key, t.counter(at), t.Digits), nil
+}
+
+// Verify checks code against the codes of secret for the period at belongs to and the Skew periods around it.
+// Codes of periods up to lastCounter are rejected so every code can only be used once, being lastCounter the one
+// returned by the last successful verification. Returns the period matched by code.
+func (t TOTP) Verify(secret string, code string, at time.Time, lastCounter int64) (int64, bool, error) {
+
+	t = t.withDefaults()
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return 0, false, err
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) != t.Digits {
+		return 0, false, nil
+	}
+
+	current := t.counter(at)
+	for counter := current - int64(t.Skew); counter <= current+int64(t.Skew); counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		if secretsMatch(hotp(key, counter, t.Digits), code) {
+			return counter, true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// decodeTOTPSecret decodes a base32 secret, ignoring case, spaces and padding
+func decodeTOTPSecret(secret string) ([]byte, error) {
+
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	key, err := totpEncoding.DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidTOTPSecret
+	}
+	return key, nil
+}
+
+// hotp returns the RFC 4226 one time password of key for counter
+func hotp(key []byte, counter int64, digits int) string {
+
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulo)
+}
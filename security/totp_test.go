@@ -0,0 +1,94 @@
+package security
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+
+	//RFC 6238 appendix B test vectors for HMAC-SHA1
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	totp := TOTP{Digits: 8, Period: 30 * time.Second}
+
+	var test_cases = []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, test_case := range test_cases {
+		if code, err := totp.Code(secret, time.Unix(test_case.unix, 0)); err != nil || code != test_case.code {
+			t.Errorf("expected code at %d to be %s and got %s (%v)", test_case.unix, test_case.code, code, err)
+		}
+	}
+
+	if _, err := totp.Code("not base32!", time.Now()); err != ErrInvalidTOTPSecret {
+		t.Errorf("expected error %v and got %v", ErrInvalidTOTPSecret, err)
+	}
+}
+
+func TestTOTPVerify(t *testing.T) {
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	counter := DefaultTOTP.counter(now)
+	code := func(at time.Time) string {
+		code, _ := DefaultTOTP.Code(secret, at)
+		return code
+	}
+
+	var test_cases = []struct {
+		totp        TOTP
+		code        string
+		lastCounter int64
+		ok          bool
+	}{
+		{DefaultTOTP, code(now), 0, true},
+		{DefaultTOTP, code(now.Add(-30 * time.Second)), 0, true},
+		{DefaultTOTP, code(now.Add(30 * time.Second)), 0, true},
+		{DefaultTOTP, code(now.Add(-60 * time.Second)), 0, false},
+		{TOTP{}, code(now.Add(-30 * time.Second)), 0, false},
+		{DefaultTOTP, code(now), counter, false},
+		{DefaultTOTP, code(now), counter - 1, true},
+		{DefaultTOTP, "12345", 0, false},
+	}
+
+	for i, test_case := range test_cases {
+		if _, ok, err := test_case.totp.Verify(secret, test_case.code, now, test_case.lastCounter); err != nil || ok != test_case.ok {
+			t.Errorf("case %d: expected verification to be %t and got %t (%v)", i, test_case.ok, ok, err)
+		}
+	}
+
+	if matched, _, _ := DefaultTOTP.Verify(secret, code(now.Add(30*time.Second)), now, 0); matched != counter+1 {
+		t.Errorf("expected matched counter %d and got %d", counter+1, matched)
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+
+	uri, err := url.Parse(DefaultTOTP.URI("JBSWY3DPEHPK3PXP", "terno.io", "patata@terno.io"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/terno.io:patata@terno.io" {
+		t.Errorf("unexpected otpauth uri %s", uri)
+	}
+
+	query := uri.Query()
+	if query.Get("secret") != "JBSWY3DPEHPK3PXP" || query.Get("issuer") != "terno.io" ||
+		query.Get("digits") != "6" || query.Get("period") != "30" || query.Get("algorithm") != "SHA1" {
+		t.Errorf("unexpected otpauth parameters %v", query)
+	}
+}